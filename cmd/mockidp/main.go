@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+
+	"postman-task/internal/sso/mockidp"
+)
+
+// Runs the mock OIDC provider for trying SSO locally
+func main() {
+	addr := flag.String("addr", ":9000", "listen address")
+	issuer := flag.String("issuer", "http://localhost:9000", "issuer url, must match sso.oidc.issuer")
+	clientID := flag.String("client-id", "campus-api", "client id")
+	clientSecret := flag.String("client-secret", "mock-secret", "client secret")
+	email := flag.String("email", "sso.student@university.edu", "email of the logged in user")
+	name := flag.String("name", "SSO Student", "name of the logged in user")
+	subject := flag.String("sub", "mock-user-1", "subject of the logged in user")
+	groups := flag.String("groups", "", "comma separated groups claim")
+	dept := flag.String("dept", "CS", "department claim")
+	flag.Parse()
+
+	claims := map[string]interface{}{"department": *dept}
+	if *groups != "" {
+		claims["groups"] = strings.Split(*groups, ",")
+	}
+
+	server, err := mockidp.New(*clientID, *clientSecret, mockidp.User{
+		Subject: *subject,
+		Email:   *email,
+		Name:    *name,
+		Claims:  claims,
+	})
+	if err != nil {
+		log.Fatalf("Failed to start mock IdP: %v", err)
+	}
+	server.Issuer = *issuer
+
+	log.Printf("Mock IdP %s listening on %s\n", *issuer, *addr)
+	log.Fatal(http.ListenAndServe(*addr, server))
+}
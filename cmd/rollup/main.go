@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"time"
+
+	"postman-task/internal/rollup"
+	"postman-task/pkg/config"
+	"postman-task/pkg/db"
+)
+
+// Rebuilds the analytics rollups, for backfills and after changing the
+// attendance status policy. Reads config.yaml like the server.
+func main() {
+	from := flag.String("from", "", "first day to rebuild, e.g. 2025-08-01, empty for the earliest data")
+	to := flag.String("to", "", "last day to rebuild, empty for today")
+	flag.Parse()
+
+	var start, end time.Time
+	for _, f := range []struct {
+		value string
+		dst   *time.Time
+	}{{*from, &start}, {*to, &end}} {
+		if f.value == "" {
+			continue
+		}
+		t, err := time.Parse("2006-01-02", f.value)
+		if err != nil {
+			log.Fatalf("Dates must look like 2006-01-02: %v", err)
+		}
+		*f.dst = t
+	}
+
+	cfg := config.Load()
+	if err := db.ConnectDB(cfg.Database.URL); err != nil {
+		log.Fatal("error in connecting to database")
+	}
+	defer db.CloseDB()
+
+	if err := rollup.Migrate(db.DB); err != nil {
+		log.Fatalf("Failed to create rollup tables: %v", err)
+	}
+
+	began := time.Now()
+	if err := rollup.Rebuild(context.Background(), db.DB, cfg.Attendance, start, end); err != nil {
+		log.Fatalf("Rebuild failed: %v", err)
+	}
+	log.Printf("Rebuilt analytics rollups in %s", time.Since(began).Round(time.Millisecond))
+}
@@ -1,15 +1,26 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 
 	"postman-task/internal/api"
+	"postman-task/internal/attendance"
 	"postman-task/internal/auth"
 	"postman-task/internal/core"
+	"postman-task/internal/directory"
+	"postman-task/internal/leaves"
+	"postman-task/internal/metrics"
+	"postman-task/internal/reports"
+	"postman-task/internal/rollup"
+	"postman-task/internal/storage"
+	"postman-task/internal/tracing"
+	"postman-task/internal/users"
 	"postman-task/pkg/config"
 	"postman-task/pkg/db"
 
@@ -20,18 +31,64 @@ func main() {
 	// Load config
 	cfg := config.Load()
 
+	// Setup tracing, no-op unless an exporter is configured
+	shutdownTracing, err := tracing.Setup(cfg.Tracing)
+	if err != nil {
+		log.Fatalf("Failed to setup tracing: %v", err)
+	}
+	defer shutdownTracing(context.Background())
+
 	// Connect to database using url from config
-	err := db.ConnectDB(cfg.Database.URL)
+	err = db.ConnectDB(cfg.Database.URL)
 	if err != nil {
 		log.Fatal("error in connecting to database")
 	}
 	defer db.CloseDB()
 
+	// Trace database queries
+	err = db.DB.Use(tracing.GormPlugin{})
+	if err != nil {
+		log.Fatalf("Failed to setup query tracing: %v", err)
+	}
+
+	// Export connection pool stats
+	sqlDB, err := db.DB.DB()
+	if err == nil {
+		metrics.RegisterDB(sqlDB)
+	}
+
 	// Load the models and migrate db to use latest schema
-	err = db.MigrateDB(&core.User{}, &core.LeaveRequest{}, &core.Attendance{})
+	err = db.MigrateDB(&core.User{}, &core.LeaveRequest{}, &core.Attendance{}, &core.UserToken{}, &core.ExternalIdentity{},
+		&core.RecoveryCode{}, &core.TwoFactorChallenge{}, &core.TwoFactorPolicy{}, &core.APIKey{}, &core.ImpersonationSession{},
+		&core.Delegation{}, &core.LeaveAttachment{}, &core.CalendarEvent{}, &core.ReportDefinition{}, &core.Report{})
 	if err != nil {
 		log.Println("error in migration")
 	}
+	if err := attendance.Migrate(db.DB); err != nil {
+		log.Printf("Could not add attendance unique index: %v", err)
+	}
+	if err := leaves.Migrate(db.DB, cfg.Leaves); err != nil {
+		log.Printf("Could not backfill leave requests: %v", err)
+	}
+	if err := leaves.MigrateDelegations(db.DB); err != nil {
+		log.Printf("Could not hand delegated leave requests back to advisors: %v", err)
+	}
+	if err := leaves.MigrateDecidedAt(db.DB); err != nil {
+		log.Printf("Could not backfill leave decision times: %v", err)
+	}
+	if err := leaves.MigrateCalendar(db.DB); err != nil {
+		log.Printf("Could not update calendar event kinds: %v", err)
+	}
+	if err := leaves.MigrateOverlap(db.DB); err != nil {
+		// Without the constraint two racing requests can both be approved
+		if cfg.Server.Mode != "development" {
+			log.Fatalf("Refusing to start without the leave overlap constraint: %v", err)
+		}
+		log.Printf("Could not add leave overlap constraint, overlaps are only checked on apply: %v", err)
+	}
+	if err := rollup.Migrate(db.DB); err != nil {
+		log.Printf("Could not create analytics rollup tables: %v", err)
+	}
 
 	// Check if admin user exists
 	var adminUser core.User
@@ -45,12 +102,14 @@ func main() {
 			}
 
 			// Create admin user as it was not found
+			now := time.Now()
 			admin := core.User{
-				Name:     "Admin",
-				Email:    cfg.Admin.Email,
-				Password: string(hashedPassword),
-				Role:     "admin",
-				Dept:     "Administration",
+				Name:            "Admin",
+				Email:           cfg.Admin.Email,
+				Password:        string(hashedPassword),
+				Role:            "admin",
+				Dept:            "Administration",
+				EmailVerifiedAt: &now,
 			}
 
 			// Save admin user to database
@@ -64,17 +123,56 @@ func main() {
 		}
 	}
 
+	if err := users.SeedTwoFactorPolicy(db.DB, cfg.TwoFactor.RequiredRoles); err != nil {
+		log.Printf("Failed to seed two-factor policy: %v", err)
+	}
+
 	// Setup jwt auth
-	jwt := auth.NewJWTManager(cfg.JWT.SecretKey)
+	if cfg.JWT.UsesDefaultSecret() && cfg.Server.Mode != "development" {
+		log.Fatal("Refusing to start: set jwt.secret_key or use an asymmetric jwt.algorithm outside development mode")
+	}
+	if cfg.JWT.UsesDefaultKeyEncryptionKey() && cfg.Server.Mode != "development" {
+		log.Fatal("Refusing to start: set jwt.key_encryption_key (or JWT_KEY_ENCRYPTION_KEY) outside development mode")
+	}
+	if cfg.Leaves.GatePass.UsesDefaultSecret() && cfg.Server.Mode != "development" {
+		log.Fatal("Refusing to start: set leaves.gate_pass.secret (or GATE_PASS_SECRET) outside development mode")
+	}
+	jwt := auth.NewJWTManager(cfg.JWT)
+	if cfg.JWT.Algorithm != "HS256" {
+		keys, err := auth.NewKeyRing(db.DB, cfg.JWT)
+		if err != nil {
+			log.Fatalf("Failed to load signing keys: %v", err)
+		}
+		jwt.SetKeyRing(keys)
+		go keys.Run(context.Background())
+	}
 
 	// Set release mode
 	if os.Getenv("GIN_MODE") == "release" {
 		gin.SetMode("release")
 	}
 
+	// Prometheus metrics, on their own listener so they aren't public
+	if cfg.Server.MetricsAddr != "" {
+		go func() {
+			log.Printf("Serving metrics on %s\n", cfg.Server.MetricsAddr)
+			if err := metrics.Serve(cfg.Server.MetricsAddr); err != nil {
+				log.Printf("Metrics server stopped: %v", err)
+			}
+		}()
+	}
+
 	// Create gin router
 	r := gin.Default()
 
+	// Only believe X-Forwarded-For from our own proxies, or anyone could
+	// pick the IP that rate limits and API key allowlists see
+	if err := r.SetTrustedProxies(cfg.Server.TrustedProxies); err != nil {
+		log.Fatalf("Invalid server.trusted_proxies: %v", err)
+	}
+	r.Use(tracing.Middleware())
+	r.Use(metrics.Middleware())
+
 	// Simple health check
 	r.GET("/api/v1/health", func(c *gin.Context) {
 		c.JSON(200, gin.H{
@@ -83,8 +181,39 @@ func main() {
 		})
 	})
 
+	// LDAP directory, nil unless enabled
+	dir := directory.New(db.DB, cfg.LDAP)
+	if dir != nil && cfg.LDAP.SyncInterval > 0 {
+		go dir.RunSync(context.Background(), cfg.LDAP.SyncInterval)
+	}
+
+	// Keep attendance in line with approved leave
+	if cfg.Attendance.ReconcileInterval > 0 {
+		go leaves.RunReconcile(context.Background(), db.DB, cfg.Leaves, cfg.Attendance.ReconcileInterval)
+	}
+
+	// Keep the analytics rollups up to date
+	if cfg.Analytics.RollupInterval > 0 {
+		go rollup.Run(context.Background(), db.DB, cfg.Attendance, cfg.Analytics.RollupInterval)
+	}
+
+	// Attachment storage and virus scanning
+	files, err := storage.NewStore(cfg.Storage)
+	if err != nil {
+		log.Fatalf("Failed to set up file storage: %v", err)
+	}
+	scanner, err := storage.NewScanner(cfg.Attachments.Scanner, cfg.Attachments.ClamAVAddr)
+	if err != nil {
+		log.Fatalf("Failed to set up virus scanner: %v", err)
+	}
+
+	// Email scheduled reports
+	if cfg.Reports.CheckInterval > 0 {
+		go reports.Run(context.Background(), db.DB, files, cfg.Reports.CheckInterval)
+	}
+
 	// Setup routes
-	api.SetupRoutes(r, db.DB, jwt)
+	api.SetupRoutes(r, db.DB, jwt, dir, files, scanner, cfg)
 
 	// Start server
 	port := "8080"
@@ -1,13 +1,18 @@
 package api
 
 import (
+	"strconv"
+	"strings"
+	"time"
+
 	"postman-task/internal/core"
+	"postman-task/internal/rollup"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 )
 
-// Handles basic stats
+// Handles dashboard stats, read from the daily rollups
 type AnalyticsHandler struct {
 	db *gorm.DB
 }
@@ -17,49 +22,415 @@ func NewAnalyticsHandler(db *gorm.DB) *AnalyticsHandler {
 	return &AnalyticsHandler{db: db}
 }
 
-// Gets basic stats
+// Longest range a single analytics query may cover
+const maxAnalyticsRange = 3 * 366 * 24 * time.Hour
+
+// Filters shared by the analytics endpoints
+type analyticsFilter struct {
+	from, to time.Time // inclusive days
+	dept     string
+	interval string // day, week or month
+}
+
+// Reads from, to, dept and interval from the query. The range defaults to
+// the last 90 days and the interval to week.
+func parseAnalyticsFilter(c *gin.Context) (analyticsFilter, bool) {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	f := analyticsFilter{
+		from:     today.AddDate(0, 0, -89),
+		to:       today,
+		dept:     c.Query("dept"),
+		interval: c.DefaultQuery("interval", "week"),
+	}
+
+	for name, dst := range map[string]*time.Time{"from": &f.from, "to": &f.to} {
+		if v := c.Query(name); v != "" {
+			t, err := time.Parse("2006-01-02", v)
+			if err != nil {
+				c.JSON(400, gin.H{"error": name + " must be a date like 2006-01-02"})
+				return f, false
+			}
+			*dst = t
+		}
+	}
+	if f.to.Before(f.from) {
+		c.JSON(400, gin.H{"error": "to must not be before from"})
+		return f, false
+	}
+	if f.to.Sub(f.from) > maxAnalyticsRange {
+		c.JSON(400, gin.H{"error": "Date range is limited to three years"})
+		return f, false
+	}
+	switch f.interval {
+	case "day", "week", "month":
+	default:
+		c.JSON(400, gin.H{"error": "interval must be day, week or month"})
+		return f, false
+	}
+	return f, true
+}
+
+// The condition on column for the filter's dept, if it has one
+func (f analyticsFilter) deptClause(column string, args []interface{}) (string, []interface{}) {
+	if f.dept == "" {
+		return "", args
+	}
+	return " AND " + column + " = ?", append(args, f.dept)
+}
+
+// The filter as echoed back in responses
+func (f analyticsFilter) describe() gin.H {
+	return gin.H{
+		"from":     f.from.Format("2006-01-02"),
+		"to":       f.to.Format("2006-01-02"),
+		"dept":     f.dept,
+		"interval": f.interval,
+	}
+}
+
+// When the rollups behind a response were last refreshed, nil if never
+func refreshedAt(db *gorm.DB) *time.Time {
+	at, err := rollup.RefreshedAt(db)
+	if err != nil || at.IsZero() {
+		return nil
+	}
+	return &at
+}
+
+// Gets totals of users by role, leaves by status and attendance
 func (h *AnalyticsHandler) GetSummary(c *gin.Context) {
-	// Count users by role
-	var studentCount, facultyCount, wardenCount, adminCount int64
-	h.db.Model(&core.User{}).Where("role = ?", "student").Count(&studentCount)
-	h.db.Model(&core.User{}).Where("role = ?", "faculty").Count(&facultyCount)
-	h.db.Model(&core.User{}).Where("role = ?", "warden").Count(&wardenCount)
-	h.db.Model(&core.User{}).Where("role = ?", "admin").Count(&adminCount)
-
-	// Count leave requests by status
-	var pending, approved, rejected int64
-	h.db.Model(&core.LeaveRequest{}).Where("status = ?", "pending").Count(&pending)
-	h.db.Model(&core.LeaveRequest{}).Where("status = ?", "approved").Count(&approved)
-	h.db.Model(&core.LeaveRequest{}).Where("status = ?", "rejected").Count(&rejected)
+	db := h.db.WithContext(c.Request.Context())
+
+	type count struct {
+		Key   string
+		Count int64
+	}
+	group := func(query string) (map[string]int64, error) {
+		var rows []count
+		if err := db.Raw(query).Scan(&rows).Error; err != nil {
+			return nil, err
+		}
+		counts := make(map[string]int64, len(rows))
+		for _, r := range rows {
+			counts[r.Key] = r.Count
+		}
+		return counts, nil
+	}
+
+	roles, err := group(`SELECT role AS key, COUNT(*) AS count FROM users
+		WHERE deleted_at IS NULL GROUP BY role`)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to count users"})
+		return
+	}
+	leaves, err := group(`SELECT status AS key, SUM(count) AS count FROM rollup_leave_days GROUP BY status`)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to count leaves"})
+		return
+	}
+
+	var attendance struct {
+		Present  float64
+		Counted  float64
+		Excluded float64
+	}
+	err = db.Raw(`SELECT COALESCE(SUM(present), 0) AS present, COALESCE(SUM(counted), 0) AS counted,
+		COALESCE(SUM(excluded), 0) AS excluded FROM rollup_dept_days`).Scan(&attendance).Error
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to count attendance"})
+		return
+	}
 
 	// Get recent leaves
 	var recentLeaves []core.LeaveRequest
-	h.db.Preload("Student").
+	db.Preload("Student").
 		Order("created_at DESC").
 		Limit(10).
 		Find(&recentLeaves)
 
-	// Basic attendance stats
-	var present, absent int64
-	h.db.Model(&core.Attendance{}).Where("present = ?", true).Count(&present)
-	h.db.Model(&core.Attendance{}).Where("present = ?", false).Count(&absent)
-
 	c.JSON(200, gin.H{
 		"users": gin.H{
-			"students": studentCount,
-			"faculty":  facultyCount,
-			"wardens":  wardenCount,
-			"admins":   adminCount,
+			"students": roles["student"],
+			"faculty":  roles["faculty"],
+			"wardens":  roles["warden"],
+			"admins":   roles["admin"],
 		},
 		"leaves": gin.H{
-			"pending":  pending,
-			"approved": approved,
-			"rejected": rejected,
+			"pending":  leaves["pending"],
+			"approved": leaves["approved"],
+			"rejected": leaves["rejected"],
 		},
 		"attendance": gin.H{
-			"present": present,
-			"absent":  absent,
+			"present":  attendance.Present,
+			"absent":   attendance.Counted - attendance.Present,
+			"excluded": attendance.Excluded,
 		},
 		"recent_leaves": recentLeaves,
+		"refreshed_at":  refreshedAt(db),
+	})
+}
+
+// Leaves applied for in a bucket, by type and status
+type leaveVolume struct {
+	Bucket    time.Time `json:"bucket"`
+	LeaveType string    `json:"leave_type"`
+	Status    string    `json:"status"`
+	Count     int64     `json:"count"`
+	Hours     float64   `json:"hours"`
+}
+
+// Gets the number of leaves applied for per interval, by type and status
+func (h *AnalyticsHandler) GetLeaveVolume(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	f, ok := parseAnalyticsFilter(c)
+	if !ok {
+		return
+	}
+
+	args := []interface{}{f.interval, f.from, f.to}
+	dept, args := f.deptClause("dept", args)
+	var series []leaveVolume
+	err := db.Raw(`SELECT date_trunc(?, date) AS bucket, leave_type, status,
+			SUM(count) AS count, SUM(hours) AS hours
+		FROM rollup_leave_days
+		WHERE date >= ? AND date <= ?`+dept+`
+		GROUP BY 1, 2, 3 ORDER BY 1, 2, 3`, args...).Scan(&series).Error
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to load leave volume"})
+		return
+	}
+
+	byType := map[string]int64{}
+	byStatus := map[string]int64{}
+	var total int64
+	for _, row := range series {
+		byType[row.LeaveType] += row.Count
+		byStatus[row.Status] += row.Count
+		total += row.Count
+	}
+
+	c.JSON(200, gin.H{
+		"filter":       f.describe(),
+		"refreshed_at": refreshedAt(db),
+		"total":        total,
+		"by_type":      byType,
+		"by_status":    byStatus,
+		"series":       series,
+	})
+}
+
+// Turnaround of decided leaves, overall when LeaveType is empty
+type turnaround struct {
+	LeaveType string  `json:"leave_type,omitempty"`
+	Decided   int64   `json:"decided"`
+	AvgHours  float64 `json:"avg_hours"`
+	P50Hours  float64 `json:"p50_hours"`
+	P90Hours  float64 `json:"p90_hours"`
+	P95Hours  float64 `json:"p95_hours"`
+	MaxHours  float64 `json:"max_hours"`
+}
+
+// Turnaround histogram buckets, in hours
+var turnaroundBuckets = []struct {
+	label string
+	upTo  float64
+}{
+	{"<1h", 1},
+	{"1-4h", 4},
+	{"4-24h", 24},
+	{"1-3d", 72},
+	{"3-7d", 168},
+}
+
+// Gets how long leaves took from application to decision, as percentiles
+// per leave type and a histogram. Percentiles can't be added up from daily
+// rollups, so this reads decided leaves directly.
+func (h *AnalyticsHandler) GetLeaveTurnaround(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	f, ok := parseAnalyticsFilter(c)
+	if !ok {
+		return
+	}
+
+	args := []interface{}{f.from, f.to.AddDate(0, 0, 1)}
+	dept, args := f.deptClause("u.dept", args)
+	decided := `SELECT l.leave_type, EXTRACT(EPOCH FROM l.decided_at - l.created_at)::float8 / 3600 AS hours
+		FROM leave_requests l JOIN users u ON u.id = l.student_id
+		WHERE l.deleted_at IS NULL AND l.decided_at IS NOT NULL
+			AND l.decided_at >= ? AND l.decided_at < ?` + dept
+
+	var rows []turnaround
+	err := db.Raw(`SELECT COALESCE(leave_type, '') AS leave_type, COUNT(*) AS decided,
+			AVG(hours) AS avg_hours,
+			percentile_cont(0.5) WITHIN GROUP (ORDER BY hours) AS p50_hours,
+			percentile_cont(0.9) WITHIN GROUP (ORDER BY hours) AS p90_hours,
+			percentile_cont(0.95) WITHIN GROUP (ORDER BY hours) AS p95_hours,
+			MAX(hours) AS max_hours
+		FROM (`+decided+`) d
+		GROUP BY GROUPING SETS ((leave_type), ())
+		ORDER BY leave_type NULLS FIRST`, args...).Scan(&rows).Error
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to load turnaround"})
+		return
+	}
+
+	// One CASE per bucket, anything slower lands in the last one
+	var cases strings.Builder
+	caseArgs := []interface{}{}
+	for _, b := range turnaroundBuckets {
+		cases.WriteString(" WHEN hours < ? THEN ?")
+		caseArgs = append(caseArgs, b.upTo, b.label)
+	}
+	var buckets []struct {
+		Bucket string
+		Count  int64
+	}
+	err = db.Raw(`SELECT CASE`+cases.String()+` ELSE '>7d' END AS bucket, COUNT(*) AS count
+		FROM (`+decided+`) d GROUP BY 1`, append(caseArgs, args...)...).Scan(&buckets).Error
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to load turnaround"})
+		return
+	}
+	counts := map[string]int64{}
+	for _, b := range buckets {
+		counts[b.Bucket] = b.Count
+	}
+	histogram := make([]gin.H, 0, len(turnaroundBuckets)+1)
+	for _, b := range turnaroundBuckets {
+		histogram = append(histogram, gin.H{"bucket": b.label, "count": counts[b.label]})
+	}
+	histogram = append(histogram, gin.H{"bucket": ">7d", "count": counts[">7d"]})
+
+	overall := turnaround{}
+	byType := []turnaround{}
+	for _, row := range rows {
+		if row.LeaveType == "" {
+			overall = row
+		} else {
+			byType = append(byType, row)
+		}
+	}
+
+	c.JSON(200, gin.H{
+		"filter":    f.describe(),
+		"overall":   overall,
+		"by_type":   byType,
+		"histogram": histogram,
+	})
+}
+
+// Attendance of a department or course in a bucket
+type attendanceTrend struct {
+	Bucket     time.Time `json:"bucket"`
+	Group      string    `json:"group"`
+	Students   int64     `json:"students"` // most students marked on one day
+	Present    float64   `json:"present"`
+	Counted    float64   `json:"counted"`
+	Excluded   float64   `json:"excluded"`
+	Percentage float64   `json:"percentage"`
+}
+
+// Gets attendance per interval for each department or course. Half days
+// count 0.5, and excluded statuses such as leave are left out of the total.
+func (h *AnalyticsHandler) GetAttendanceTrends(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	f, ok := parseAnalyticsFilter(c)
+	if !ok {
+		return
+	}
+
+	group := c.DefaultQuery("group", "dept")
+	table := map[string]string{"dept": "rollup_dept_days", "course": "rollup_course_days"}[group]
+	if table == "" {
+		c.JSON(400, gin.H{"error": "group must be dept or course"})
+		return
+	}
+
+	args := []interface{}{f.interval, f.from, f.to}
+	dept, args := f.deptClause("dept", args)
+
+	// Courses are kept per department, add them up per day first
+	var series []attendanceTrend
+	err := db.Raw(`SELECT date_trunc(?, date) AS bucket, grp AS "group", MAX(students) AS students,
+			SUM(present) AS present, SUM(counted) AS counted, SUM(excluded) AS excluded
+		FROM (
+			SELECT date, `+group+` AS grp, SUM(students) AS students,
+				SUM(present) AS present, SUM(counted) AS counted, SUM(excluded) AS excluded
+			FROM `+table+`
+			WHERE date >= ? AND date <= ?`+dept+`
+			GROUP BY 1, 2
+		) d
+		GROUP BY 1, 2 ORDER BY 2, 1`, args...).Scan(&series).Error
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to load attendance trends"})
+		return
+	}
+	for i := range series {
+		if series[i].Counted > 0 {
+			series[i].Percentage = series[i].Present / series[i].Counted * 100
+		}
+	}
+
+	c.JSON(200, gin.H{
+		"filter":       f.describe(),
+		"refreshed_at": refreshedAt(db),
+		"group":        group,
+		"series":       series,
+	})
+}
+
+// A student's absences over the filtered range
+type absentee struct {
+	StudentID  uint    `json:"student_id"`
+	Name       string  `json:"name"`
+	Dept       string  `json:"dept"`
+	Course     string  `json:"course,omitempty"`
+	Absent     float64 `json:"absent_days"`
+	Counted    float64 `json:"counted_days"`
+	Percentage float64 `json:"attendance_percentage"`
+}
+
+// Gets the students with the most absences, up to limit (default 10, max 100)
+func (h *AnalyticsHandler) GetTopAbsentees(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	f, ok := parseAnalyticsFilter(c)
+	if !ok {
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	if err != nil || limit < 1 || limit > 100 {
+		c.JSON(400, gin.H{"error": "limit must be between 1 and 100"})
+		return
+	}
+
+	args := []interface{}{f.from, f.to}
+	dept, args := f.deptClause("r.dept", args)
+	args = append(args, limit)
+
+	var students []absentee
+	err = db.Raw(`SELECT s.student_id, u.name, u.dept, u.course, counted - present AS absent, counted,
+			CASE WHEN counted > 0 THEN present * 100.0 / counted ELSE 0 END AS percentage
+		FROM (
+			SELECT r.student_id, SUM(r.present) AS present, SUM(r.counted) AS counted
+			FROM rollup_student_days r
+			WHERE r.date >= ? AND r.date <= ?`+dept+`
+			GROUP BY r.student_id
+		) s JOIN users u ON u.id = s.student_id
+		WHERE counted > present
+		ORDER BY absent DESC, percentage, s.student_id
+		LIMIT ?`, args...).Scan(&students).Error
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to load absentees"})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"filter":       f.describe(),
+		"refreshed_at": refreshedAt(db),
+		"students":     students,
 	})
 }
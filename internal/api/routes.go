@@ -1,53 +1,175 @@
 package api
 
 import (
+	"log"
+
 	"postman-task/internal/attendance"
 	"postman-task/internal/auth"
+	"postman-task/internal/directory"
+	"postman-task/internal/idempotency"
 	"postman-task/internal/leaves"
+	"postman-task/internal/ratelimit"
+	"postman-task/internal/reports"
+	"postman-task/internal/serviceaccounts"
+	"postman-task/internal/sso"
+	"postman-task/internal/storage"
 	"postman-task/internal/users"
+	"postman-task/pkg/config"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 )
 
 // Setup the API routes
-func SetupRoutes(r *gin.Engine, db *gorm.DB, jwt *auth.JWTManager) {
+func SetupRoutes(r *gin.Engine, db *gorm.DB, jwt *auth.JWTManager, dir *directory.Directory, files storage.Store, scanner storage.Scanner, cfg *config.Config) {
+	// Rate limit store, fall back to memory if the configured one fails
+	store, err := ratelimit.NewStore(db, cfg.RateLimit.Store)
+	if err != nil {
+		log.Printf("Rate limit store error, using memory: %v", err)
+		store = ratelimit.NewMemoryStore()
+	}
+	limiter := ratelimit.NewLimiter(store)
+
+	// Idempotency store, same fallback
+	keys, err := idempotency.NewStore(db, cfg.Idempotency.Store)
+	if err != nil {
+		log.Printf("Idempotency store error, using memory: %v", err)
+		keys = idempotency.NewMemoryStore()
+	}
+	keeper := idempotency.NewKeeper(keys, cfg.Idempotency.Window)
+
+	loginPerIP := ratelimit.Rule{Name: "login_ip", Limit: cfg.RateLimit.LoginPerIP, Window: cfg.RateLimit.Window}
+	registerPerIP := ratelimit.Rule{Name: "register_ip", Limit: cfg.RateLimit.RegisterPerIP, Window: cfg.RateLimit.Window}
+	resetPerIP := ratelimit.Rule{Name: "reset_ip", Limit: cfg.RateLimit.ResetPerIP, Window: cfg.RateLimit.Window}
+
+	// Revoked tokens and deactivated users are rejected by AuthMiddleware
+	jwt.SetUserCheck(users.NewUserCheck(db))
+	jwt.SetAPIKeyCheck(serviceaccounts.NewKeyCheck(db))
+
 	// Create handlers
-	userH := users.NewUserHandler(db, jwt)
-	leaveH := leaves.NewLeaveHandler(db)
-	attendanceH := attendance.NewAttendanceHandler(db)
+	userH := users.NewUserHandler(db, jwt, limiter, dir, cfg)
+	directoryH := directory.NewHandler(dir)
+	serviceH := serviceaccounts.NewHandler(db)
+	ssoH := sso.NewHandler(db, userH.CompleteLogin, cfg)
+	leaveH := leaves.NewLeaveHandler(db, files, scanner, cfg.Attachments, cfg.Leaves)
+	attendanceH := attendance.NewAttendanceHandler(db, cfg.Attendance)
 	analyticsH := NewAnalyticsHandler(db)
+	reportH := reports.NewHandler(db, files)
+
+	// Public keys for services verifying our tokens
+	r.GET("/.well-known/jwks.json", jwt.JWKS)
 
 	// User routes
-	r.POST("/api/v1/auth/register", userH.Register)
-	r.POST("/api/v1/auth/login", userH.Login)
+	r.POST("/api/v1/auth/register", limiter.PerIP(registerPerIP), keeper.Middleware(), userH.Register)
+	r.POST("/api/v1/auth/login", limiter.PerIP(loginPerIP), userH.Login)
+	r.POST("/api/v1/auth/login/2fa", limiter.PerIP(loginPerIP), keeper.Middleware(), userH.LoginTwoFactor)
+	r.POST("/api/v1/auth/2fa/setup", limiter.PerIP(loginPerIP), userH.SetupTwoFactorChallenge)
+	r.POST("/api/v1/auth/2fa/confirm", limiter.PerIP(loginPerIP), userH.ConfirmTwoFactorChallenge)
+
+	// Single sign-on
+	r.GET("/api/v1/auth/oidc/login", limiter.PerIP(loginPerIP), ssoH.OIDCLogin)
+	r.GET("/api/v1/auth/oidc/callback", limiter.PerIP(loginPerIP), ssoH.OIDCCallback)
+	r.GET("/api/v1/auth/saml/metadata", ssoH.SAMLMetadata)
+	r.GET("/api/v1/auth/saml/login", limiter.PerIP(loginPerIP), ssoH.SAMLLogin)
+	r.POST("/api/v1/auth/saml/acs", limiter.PerIP(loginPerIP), ssoH.SAMLACS)
+
+	// Email verification and password reset
+	r.POST("/api/v1/auth/verify-email", limiter.PerIP(resetPerIP), userH.VerifyEmail)
+	r.POST("/api/v1/auth/resend-verification", limiter.PerIP(resetPerIP), keeper.Middleware(), userH.ResendVerification)
+	r.POST("/api/v1/auth/forgot-password", limiter.PerIP(resetPerIP), keeper.Middleware(), userH.ForgotPassword)
+	r.POST("/api/v1/auth/reset-password", limiter.PerIP(resetPerIP), keeper.Middleware(), userH.ResetPassword)
+
+	// Checked at the gate by scanning the pass, no login
+	r.GET("/api/v1/gate-pass/verify", leaveH.VerifyGatePass)
 
 	// Needs token
 	authorized := r.Group("/api/v1")
-	authorized.Use(jwt.AuthMiddleware())
+	authorized.Use(jwt.AuthMiddleware(), keeper.Middleware())
 	{
 		// User routes
+		authorized.GET("/users/me", userH.GetMe)
+		authorized.PATCH("/users/me", jwt.NoImpersonation(), userH.UpdateMe)
+		authorized.PUT("/users/me/password", jwt.NoImpersonation(), userH.ChangePassword)
+		authorized.POST("/users/me/2fa/setup", jwt.NoImpersonation(), userH.SetupTwoFactor)
+		authorized.POST("/users/me/2fa/confirm", jwt.NoImpersonation(), userH.ConfirmTwoFactor)
+		authorized.POST("/users/me/2fa/recovery-codes", jwt.NoImpersonation(), userH.RegenerateRecoveryCodes)
+		authorized.DELETE("/users/me/2fa", jwt.NoImpersonation(), userH.DisableTwoFactor)
+		authorized.POST("/impersonation/end", userH.EndImpersonation)
 		authorized.GET("/users", jwt.AdminOnly(), userH.GetUsers)
 		authorized.GET("/users/:id", userH.GetUserByID)
 
+		// Admin user management
+		authorized.PATCH("/users/:id", jwt.AdminOnly(), userH.UpdateUser)
+		authorized.POST("/users/:id/unlock", jwt.AdminOnly(), userH.UnlockUser)
+		authorized.POST("/users/:id/deactivate", jwt.AdminOnly(), userH.DeactivateUser)
+		authorized.POST("/users/:id/reactivate", jwt.AdminOnly(), userH.ReactivateUser)
+		authorized.DELETE("/users/:id", jwt.AdminOnly(), userH.DeleteUser)
+		authorized.POST("/users/:id/2fa/reset", jwt.AdminOnly(), userH.ResetTwoFactor)
+		authorized.POST("/users/:id/impersonate", jwt.AdminOnly(), userH.Impersonate)
+
 		// Leave routes
-		authorized.POST("/leaves/apply", leaveH.ApplyLeave)
+		authorized.POST("/leaves/apply", jwt.NoImpersonation(), leaveH.ApplyLeave)
 		authorized.GET("/leaves/my", leaveH.GetMyLeaves)
+		authorized.GET("/leaves/balance", leaveH.GetLeaveBalance)
 		authorized.GET("/leaves", jwt.FacultyOrWarden(), leaveH.GetAllLeaves)
+		authorized.GET("/leaves/:id", leaveH.GetLeave)
+
+		// Supporting documents
+		authorized.POST("/leaves/:id/attachments", jwt.NoImpersonation(), leaveH.UploadAttachment)
+		authorized.GET("/leaves/:id/attachments", leaveH.GetAttachments)
+		authorized.GET("/leaves/:id/attachments/:attachment_id", leaveH.DownloadAttachment)
+		authorized.DELETE("/leaves/:id/attachments/:attachment_id", jwt.NoImpersonation(), leaveH.DeleteAttachment)
+
+		// Printable letter with a signed QR code for the gate
+		authorized.GET("/leaves/:id/gate-pass", leaveH.GetGatePass)
 
 		// Handle both approve and reject
 		authorized.PUT("/leaves/:id/:action", jwt.FacultyOrWarden(), leaveH.HandleLeaveAction)
 
+		// Delegating approval rights while away
+		authorized.POST("/delegations", jwt.FacultyOrWarden(), jwt.NoImpersonation(), leaveH.CreateDelegation)
+		authorized.GET("/delegations", jwt.FacultyOrWarden(), leaveH.GetMyDelegations)
+		authorized.DELETE("/delegations/:id", jwt.NoImpersonation(), leaveH.RevokeDelegation)
+
+		// Academic calendar, exams block leave applications
+		authorized.GET("/calendar", leaveH.GetCalendar)
+
 		// Attendance routes
 		authorized.POST("/attendance/mark", attendanceH.MarkAttendance)
 		authorized.GET("/attendance/stats/:student_id", attendanceH.GetAttendanceStats)
 		authorized.GET("/attendance/history/:student_id", attendanceH.GetAttendanceHistory)
+		authorized.GET("/attendance/records/:id", attendanceH.GetAttendanceRecord)
 
 		// Admin only routes
 		admin := authorized.Group("")
 		admin.Use(jwt.AdminOnly())
 		{
 			admin.GET("/analytics/summary", analyticsH.GetSummary)
+			admin.GET("/analytics/leaves", analyticsH.GetLeaveVolume)
+			admin.GET("/analytics/leaves/turnaround", analyticsH.GetLeaveTurnaround)
+			admin.GET("/analytics/attendance/trends", analyticsH.GetAttendanceTrends)
+			admin.GET("/analytics/attendance/absentees", analyticsH.GetTopAbsentees)
+			admin.GET("/reports/definitions", reportH.GetDefinitions)
+			admin.POST("/reports/definitions", reportH.CreateDefinition)
+			admin.DELETE("/reports/definitions/:id", reportH.DeleteDefinition)
+			admin.POST("/reports/definitions/:id/run", reportH.RunDefinition)
+			admin.GET("/reports", reportH.GetReports)
+			admin.GET("/reports/:id/download", reportH.DownloadReport)
+			admin.POST("/directory/sync", directoryH.Sync)
+			admin.GET("/two-factor/policy", userH.GetTwoFactorPolicy)
+			admin.PUT("/two-factor/policy", userH.SetTwoFactorPolicy)
+			admin.GET("/impersonation/sessions", userH.GetImpersonationSessions)
+			admin.POST("/calendar", leaveH.CreateCalendarEvent)
+			admin.POST("/attendance/reconcile", leaveH.ReconcileAttendance)
+			admin.DELETE("/calendar/:id", leaveH.DeleteCalendarEvent)
+
+			// Service accounts and their API keys
+			admin.GET("/service-accounts/scopes", serviceH.GetScopes)
+			admin.GET("/service-accounts", serviceH.GetServiceAccounts)
+			admin.POST("/service-accounts", serviceH.CreateServiceAccount)
+			admin.DELETE("/service-accounts/:id", serviceH.DeleteServiceAccount)
+			admin.POST("/service-accounts/:id/keys", serviceH.CreateAPIKey)
+			admin.DELETE("/service-accounts/:id/keys/:key_id", serviceH.RevokeAPIKey)
 		}
 	}
 }
@@ -5,27 +5,35 @@ import (
 	"time"
 
 	"postman-task/internal/core"
+	"postman-task/internal/etag"
+	"postman-task/internal/metrics"
+	"postman-task/pkg/config"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 )
 
 type AttendanceHandler struct {
-	db *gorm.DB
+	db     *gorm.DB
+	policy config.AttendanceConfig
 }
 
 // Creates new handler
-func NewAttendanceHandler(db *gorm.DB) *AttendanceHandler {
+func NewAttendanceHandler(db *gorm.DB, policy config.AttendanceConfig) *AttendanceHandler {
 	return &AttendanceHandler{
-		db: db,
+		db:     db,
+		policy: policy,
 	}
 }
 
 func (h *AttendanceHandler) MarkAttendance(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
 	var data struct {
 		StudentID uint   `json:"student_id"`
 		Date      string `json:"date"`
 		Present   bool   `json:"present"`
+		Status    string `json:"status" binding:"omitempty,oneof=present absent on_leave medical excused late"`
 	}
 
 	if err := c.ShouldBindJSON(&data); err != nil {
@@ -33,6 +41,15 @@ func (h *AttendanceHandler) MarkAttendance(c *gin.Context) {
 		return
 	}
 
+	// Older clients only send present
+	if data.Status == "" {
+		data.Status = "absent"
+		if data.Present {
+			data.Status = "present"
+		}
+	}
+	data.Present = data.Status == "present" || data.Status == "late"
+
 	// Get user ID
 	markerID, exists := c.Get("user_id")
 	if !exists {
@@ -49,73 +66,168 @@ func (h *AttendanceHandler) MarkAttendance(c *gin.Context) {
 
 	// Check if attendance exists
 	var att core.Attendance
-	result := h.db.Where("student_id = ? AND date = ?", data.StudentID, date).First(&att)
+	result := db.Where("student_id = ? AND date = ? AND session = 'full'", data.StudentID, date).First(&att)
 
 	if result.Error == nil {
-		// Update existing
+		// Changing a mark needs the version the marker last saw
+		if !etag.Match(c, att.Version) {
+			return
+		}
+		// A manual mark replaces any leave entry
+		ok, err := etag.Update(db, &att, att.Version, map[string]interface{}{
+			"status":     data.Status,
+			"present":    data.Present,
+			"leave_id":   nil,
+			"from_leave": false,
+			"marked_by":  markerID,
+		})
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Database error"})
+			return
+		}
+		if !ok {
+			etag.Stale(c)
+			return
+		}
+		att.Status = data.Status
 		att.Present = data.Present
-		att.MarkedBy = markerID.(uint)
-		h.db.Save(&att)
+		att.Version++
 	} else if result.Error == gorm.ErrRecordNotFound {
 		// Create new
 		att = core.Attendance{
 			StudentID: data.StudentID,
 			Date:      date,
+			Status:    data.Status,
 			Present:   data.Present,
 			MarkedBy:  markerID.(uint),
 		}
-		h.db.Create(&att)
+		if err := db.Create(&att).Error; err != nil {
+			// Someone else marked the day first
+			c.JSON(409, gin.H{"error": "Attendance was already marked, reload it and try again"})
+			return
+		}
 	} else {
 		// Error
 		c.JSON(500, gin.H{"error": "Database error"})
 		return
 	}
+	metrics.AttendanceMarked(att.Present)
 
+	etag.Set(c, att.Version)
 	c.JSON(200, gin.H{
 		"message": "Attendance marked",
 		"id":      att.ID,
+		"status":  att.Status,
+		"version": att.Version,
 	})
 }
 
-// Gets attendance stats for a student
-func (h *AttendanceHandler) GetAttendanceStats(c *gin.Context) {
-	// Get student id from url
-	studentID := c.Param("student_id")
+// Gets a single attendance record
+func (h *AttendanceHandler) GetAttendanceRecord(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
 
-	// Get current month's attendance
+	var att core.Attendance
+	if err := db.First(&att, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Attendance record not found"})
+		return
+	}
+
+	etag.Set(c, att.Version)
+	c.JSON(200, att)
+}
+
+// Works out the stats period from the query: ?from=&to= dates, ?term= a
+// term in the calendar, or ?academic_year= the year it starts in. Defaults
+// to the current month. Periods end today at the latest.
+func (h *AttendanceHandler) period(c *gin.Context, db *gorm.DB) (time.Time, time.Time, bool) {
 	now := time.Now()
-	firstOfMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	to := today
+
+	switch {
+	case c.Query("term") != "":
+		var term core.CalendarEvent
+		if err := db.Where("kind = 'term'").First(&term, c.Query("term")).Error; err != nil {
+			c.JSON(404, gin.H{"error": "Term not found"})
+			return from, to, false
+		}
+		from, to = dayOf(term.StartDate), dayOf(term.EndDate)
+
+	case c.Query("academic_year") != "":
+		year, err := strconv.Atoi(c.Query("academic_year"))
+		if err != nil {
+			c.JSON(400, gin.H{"error": "Invalid academic year"})
+			return from, to, false
+		}
+		from = time.Date(year, time.Month(h.policy.YearStartMonth), 1, 0, 0, 0, 0, time.UTC)
+		to = from.AddDate(1, 0, -1)
+
+	case c.Query("from") != "" || c.Query("to") != "":
+		var err1, err2 error
+		if v := c.Query("from"); v != "" {
+			from, err1 = time.Parse("2006-01-02", v)
+		}
+		if v := c.Query("to"); v != "" {
+			to, err2 = time.Parse("2006-01-02", v)
+		}
+		if err1 != nil || err2 != nil {
+			c.JSON(400, gin.H{"error": "Invalid date format. Use YYYY-MM-DD"})
+			return from, to, false
+		}
+	}
+
+	to = minDate(to, today)
+	if to.Before(from) {
+		c.JSON(400, gin.H{"error": "The period has not started yet or ends before it starts"})
+		return from, to, false
+	}
+	if to.Sub(from) > 3*366*24*time.Hour {
+		c.JSON(400, gin.H{"error": "Period can't be longer than three years"})
+		return from, to, false
+	}
+	return from, to, true
+}
 
-	// Count present days this month
-	var presentDays int64
-	h.db.Model(&core.Attendance{}).
-		Where("student_id = ? AND present = ? AND date >= ?", studentID, true, firstOfMonth).
-		Count(&presentDays)
+// Gets attendance stats for a student over a period, with weekly and
+// monthly breakdowns, streaks and the department average
+func (h *AttendanceHandler) GetAttendanceStats(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
 
-	// Total school days this month
-	totalDays := now.Day()
-	weekendDays := (now.Day() / 7) * 2
-	totalSchoolDays := totalDays - weekendDays
-	if totalSchoolDays < 0 {
-		totalSchoolDays = 0
+	var student core.User
+	if err := db.Select("id", "dept").First(&student, c.Param("student_id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Student not found"})
+		return
 	}
 
-	// Calculate percentage
-	var percentage float64
-	if totalSchoolDays > 0 {
-		percentage = float64(presentDays) / float64(totalSchoolDays) * 100
+	from, to, ok := h.period(c, db)
+	if !ok {
+		return
 	}
 
-	c.JSON(200, gin.H{
-		"student_id":   studentID,
-		"present_days": presentDays,
-		"total_days":   totalSchoolDays,
-		"percentage":   percentage,
-	})
+	records, err := loadRecords(db, []uint{student.ID}, from, to)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Database error"})
+		return
+	}
+	stats := h.studentStats(records, from, to)
+	stats.StudentID = student.ID
+
+	stats.Dept = student.Dept
+	stats.DeptPercentage, err = h.deptPercentage(db, student.Dept, from, to)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Database error"})
+		return
+	}
+	stats.DeptDifference = stats.AttendancePercentage - stats.DeptPercentage
+
+	c.JSON(200, stats)
 }
 
 // Gets attendance history
 func (h *AttendanceHandler) GetAttendanceHistory(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
 	// Get student id from url
 	studentID := c.Param("student_id")
 
@@ -133,7 +245,7 @@ func (h *AttendanceHandler) GetAttendanceHistory(c *gin.Context) {
 
 	// Get attendance records
 	var records []core.Attendance
-	h.db.Where("student_id = ?", studentID).
+	db.Where("student_id = ?", studentID).
 		Order("date DESC").
 		Offset(offset).
 		Limit(pageSize).
@@ -141,7 +253,7 @@ func (h *AttendanceHandler) GetAttendanceHistory(c *gin.Context) {
 
 	// Get total count
 	var total int64
-	h.db.Model(&core.Attendance{}).Where("student_id = ?", studentID).Count(&total)
+	db.Model(&core.Attendance{}).Where("student_id = ?", studentID).Count(&total)
 
 	c.JSON(200, gin.H{
 		"data":  records,
@@ -0,0 +1,32 @@
+package attendance
+
+import "gorm.io/gorm"
+
+// Keeps one record per student, day and session. Older duplicates left by
+// concurrent marking are soft deleted before the unique index is added.
+// Records from before statuses get one from their present flag, and leave
+// entries never edited since they were inserted are flagged as such.
+func Migrate(db *gorm.DB) error {
+	err := db.Exec(`UPDATE attendances SET status = 'present' WHERE present AND status = 'absent'`).Error
+	if err != nil {
+		return err
+	}
+
+	// Excusing an absence bumps its version, a manual mark clears leave_id
+	err = db.Exec(`UPDATE attendances SET from_leave = true
+		WHERE leave_id IS NOT NULL AND version = 1 AND NOT from_leave`).Error
+	if err != nil {
+		return err
+	}
+
+	err = db.Exec(`UPDATE attendances SET deleted_at = now()
+		WHERE deleted_at IS NULL AND id NOT IN (
+			SELECT DISTINCT ON (student_id, date, session) id FROM attendances
+			WHERE deleted_at IS NULL
+			ORDER BY student_id, date, session, updated_at DESC, id DESC)`).Error
+	if err != nil {
+		return err
+	}
+	return db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_attendance_student_day
+		ON attendances (student_id, date, session) WHERE deleted_at IS NULL`).Error
+}
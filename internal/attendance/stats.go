@@ -0,0 +1,219 @@
+package attendance
+
+import (
+	"slices"
+	"time"
+
+	"postman-task/internal/core"
+
+	"gorm.io/gorm"
+)
+
+// A school day's attendance under the status policy
+type dayResult struct {
+	attended float64 // 0, 0.5 or 1
+	excluded float64 // left out of the total
+	statuses map[string]float64
+}
+
+// The UTC midnight starting t's date. Postgres returns dates in the local
+// zone, and time.Time map keys only match with the same location.
+func dayOf(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
+
+func isSchoolDay(d time.Time) bool {
+	return d.Weekday() != time.Saturday && d.Weekday() != time.Sunday
+}
+
+// Counts the weekdays from from to to, inclusive
+func schoolDays(from, to time.Time) int {
+	n := 0
+	for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+		if isSchoolDay(d) {
+			n++
+		}
+	}
+	return n
+}
+
+// Scores each school day with records, keyed by dayOf. A half-day entry,
+// left by a partial leave, takes half of the day's full mark.
+func (h *AttendanceHandler) scoreDays(records []core.Attendance) map[time.Time]*dayResult {
+	present := func(status string) bool { return slices.Contains(h.policy.PresentStatuses, status) }
+	excluded := func(status string) bool { return slices.Contains(h.policy.ExcludedStatuses, status) }
+
+	full := map[time.Time]string{}
+	halves := map[time.Time][]string{}
+	for _, r := range records {
+		date := dayOf(r.Date)
+		if !isSchoolDay(date) {
+			continue
+		}
+		if r.Session == "full" {
+			full[date] = r.Status
+		} else {
+			halves[date] = append(halves[date], r.Status)
+			if _, ok := full[date]; !ok {
+				full[date] = ""
+			}
+		}
+	}
+
+	days := make(map[time.Time]*dayResult, len(full))
+	for date, status := range full {
+		d := &dayResult{statuses: map[string]float64{}}
+		if status != "" {
+			d.statuses[status]++
+		}
+		for _, half := range halves[date] {
+			d.statuses[half] += 0.5
+		}
+
+		switch {
+		case excluded(status):
+			d.excluded = 1
+		case present(status):
+			d.attended = 1
+			for _, half := range halves[date] {
+				if !present(half) {
+					d.attended -= 0.5
+				}
+			}
+			d.attended = max(d.attended, 0)
+		}
+		if !excluded(status) {
+			for _, half := range halves[date] {
+				if excluded(half) {
+					d.excluded += 0.5
+				}
+			}
+		}
+		days[date] = d
+	}
+	return days
+}
+
+// Adds up scored days from from to to into a period
+func sumPeriod(days map[time.Time]*dayResult, from, to time.Time) core.AttendancePeriod {
+	from, to = dayOf(from), dayOf(to)
+	p := core.AttendancePeriod{
+		Start: from.Format("2006-01-02"),
+		End:   to.Format("2006-01-02"),
+	}
+	var excluded float64
+	for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+		if r, ok := days[d]; ok {
+			p.PresentDays += r.attended
+			excluded += r.excluded
+		}
+	}
+	p.TotalDays = max(float64(schoolDays(from, to))-excluded, 0)
+	if p.TotalDays > 0 {
+		p.Percentage = p.PresentDays / p.TotalDays * 100
+	}
+	return p
+}
+
+// Loads the records of the given students from from to to
+func loadRecords(db *gorm.DB, studentIDs interface{}, from, to time.Time) ([]core.Attendance, error) {
+	var records []core.Attendance
+	err := db.Select("student_id", "date", "session", "status").
+		Where("student_id IN ? AND date >= ? AND date <= ?", studentIDs, from, to).
+		Find(&records).Error
+	return records, err
+}
+
+// Works out a student's stats from from to to, with weekly and monthly
+// breakdowns and streaks
+func (h *AttendanceHandler) studentStats(records []core.Attendance, from, to time.Time) core.AttendanceStats {
+	from, to = dayOf(from), dayOf(to)
+	days := h.scoreDays(records)
+	total := sumPeriod(days, from, to)
+
+	stats := core.AttendanceStats{
+		PresentDays:          total.PresentDays,
+		TotalDays:            total.TotalDays,
+		AttendancePercentage: total.Percentage,
+		From:                 total.Start,
+		To:                   total.End,
+		SchoolDays:           schoolDays(from, to),
+		ByStatus:             map[string]float64{},
+		Weekly:               []core.AttendancePeriod{},
+		Monthly:              []core.AttendancePeriod{},
+	}
+	for _, d := range days {
+		stats.ExcludedDays += d.excluded
+		for status, n := range d.statuses {
+			stats.ByStatus[status] += n
+		}
+	}
+
+	// Weeks run Monday to Sunday, clipped to the period
+	for start := from; !start.After(to); {
+		end := start.AddDate(0, 0, (7-int(start.Weekday()))%7)
+		stats.Weekly = append(stats.Weekly, sumPeriod(days, start, minDate(end, to)))
+		start = end.AddDate(0, 0, 1)
+	}
+	for start := from; !start.After(to); {
+		end := time.Date(start.Year(), start.Month()+1, 0, 0, 0, 0, 0, time.UTC)
+		stats.Monthly = append(stats.Monthly, sumPeriod(days, start, minDate(end, to)))
+		start = end.AddDate(0, 0, 1)
+	}
+
+	// Unmarked and excluded days neither extend nor break a streak
+	present, absent := 0, 0
+	for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+		r, ok := days[d]
+		if !isSchoolDay(d) || !ok || r.excluded >= 1 {
+			continue
+		}
+		if r.attended >= 1 {
+			present++
+			absent = 0
+		} else {
+			present = 0
+			if r.attended == 0 {
+				absent++
+			}
+		}
+		stats.LongestStreak = max(stats.LongestStreak, present)
+		stats.LongestAbsenceStreak = max(stats.LongestAbsenceStreak, absent)
+	}
+	stats.CurrentStreak = present
+
+	return stats
+}
+
+func minDate(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+// Averages the attendance percentage of a department's students
+func (h *AttendanceHandler) deptPercentage(db *gorm.DB, dept string, from, to time.Time) (float64, error) {
+	var ids []uint
+	err := db.Model(&core.User{}).
+		Where("dept = ? AND role = 'student' AND deactivated_at IS NULL", dept).
+		Pluck("id", &ids).Error
+	if err != nil || len(ids) == 0 {
+		return 0, err
+	}
+
+	records, err := loadRecords(db, ids, from, to)
+	if err != nil {
+		return 0, err
+	}
+	byStudent := map[uint][]core.Attendance{}
+	for _, r := range records {
+		byStudent[r.StudentID] = append(byStudent[r.StudentID], r)
+	}
+
+	var sum float64
+	for _, id := range ids {
+		sum += sumPeriod(h.scoreDays(byStudent[id]), from, to).Percentage
+	}
+	return sum / float64(len(ids)), nil
+}
@@ -0,0 +1,203 @@
+package attendance
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"postman-task/internal/core"
+	"postman-task/pkg/config"
+)
+
+func testHandler() *AttendanceHandler {
+	return NewAttendanceHandler(nil, config.AttendanceConfig{
+		PresentStatuses:  []string{"present", "late"},
+		ExcludedStatuses: []string{"on_leave", "medical"},
+	})
+}
+
+// A day in May 2025, which starts on a Thursday. The 5th is a Monday.
+func may(day int) time.Time {
+	return time.Date(2025, time.May, day, 0, 0, 0, 0, time.UTC)
+}
+
+func rec(day int, session, status string) core.Attendance {
+	return core.Attendance{Date: may(day), Session: session, Status: status}
+}
+
+func TestScoreDays(t *testing.T) {
+	tests := []struct {
+		name         string
+		records      []core.Attendance
+		wantAttended float64
+		wantExcluded float64
+		wantStatuses map[string]float64
+	}{
+		{"present", []core.Attendance{rec(5, "full", "present")}, 1, 0, map[string]float64{"present": 1}},
+		{"late counts as present", []core.Attendance{rec(5, "full", "late")}, 1, 0, map[string]float64{"late": 1}},
+		{"absent", []core.Attendance{rec(5, "full", "absent")}, 0, 0, map[string]float64{"absent": 1}},
+		{"on leave", []core.Attendance{rec(5, "full", "on_leave")}, 0, 1, map[string]float64{"on_leave": 1}},
+		{"half day on leave",
+			[]core.Attendance{rec(5, "full", "present"), rec(5, "first_half", "on_leave")},
+			0.5, 0.5, map[string]float64{"present": 1, "on_leave": 0.5}},
+		{"half day absent",
+			[]core.Attendance{rec(5, "full", "present"), rec(5, "second_half", "absent")},
+			0.5, 0, map[string]float64{"present": 1, "absent": 0.5}},
+		{"both halves away",
+			[]core.Attendance{rec(5, "full", "present"), rec(5, "first_half", "absent"), rec(5, "second_half", "absent")},
+			0, 0, map[string]float64{"present": 1, "absent": 1}},
+		{"half day without a full record",
+			[]core.Attendance{rec(5, "first_half", "on_leave")},
+			0, 0.5, map[string]float64{"on_leave": 0.5}},
+		{"half day on a day already excluded",
+			[]core.Attendance{rec(5, "full", "medical"), rec(5, "first_half", "on_leave")},
+			0, 1, map[string]float64{"medical": 1, "on_leave": 0.5}},
+	}
+	h := testHandler()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			days := h.scoreDays(tt.records)
+			d, ok := days[may(5)]
+			if !ok || len(days) != 1 {
+				t.Fatalf("scored %d days, want the 5th only", len(days))
+			}
+			if d.attended != tt.wantAttended || d.excluded != tt.wantExcluded {
+				t.Fatalf("attended %v excluded %v, want %v %v", d.attended, d.excluded, tt.wantAttended, tt.wantExcluded)
+			}
+			if len(d.statuses) != len(tt.wantStatuses) {
+				t.Fatalf("statuses %v, want %v", d.statuses, tt.wantStatuses)
+			}
+			for status, n := range tt.wantStatuses {
+				if d.statuses[status] != n {
+					t.Fatalf("statuses %v, want %v", d.statuses, tt.wantStatuses)
+				}
+			}
+		})
+	}
+}
+
+func TestScoreDaysSkipsWeekends(t *testing.T) {
+	days := testHandler().scoreDays([]core.Attendance{rec(3, "full", "present"), rec(4, "first_half", "absent")})
+	if len(days) != 0 {
+		t.Fatalf("scored %d weekend days", len(days))
+	}
+}
+
+func TestSumPeriod(t *testing.T) {
+	tests := []struct {
+		name        string
+		records     []core.Attendance
+		from, to    int
+		wantPresent float64
+		wantTotal   float64
+		wantPercent float64
+	}{
+		{"nothing marked", nil, 5, 11, 0, 5, 0},
+		{"mixed week",
+			[]core.Attendance{
+				rec(5, "full", "present"),
+				rec(6, "full", "absent"),
+				rec(7, "full", "on_leave"),
+				rec(8, "full", "present"), rec(8, "first_half", "on_leave"),
+			},
+			5, 11, 1.5, 3.5, 1.5 / 3.5 * 100},
+		{"records outside the period are ignored",
+			[]core.Attendance{rec(2, "full", "present"), rec(5, "full", "present"), rec(12, "full", "on_leave")},
+			5, 9, 1, 5, 20},
+		{"all excluded",
+			[]core.Attendance{rec(5, "full", "on_leave"), rec(6, "full", "medical")},
+			5, 6, 0, 0, 0},
+		{"weekend only", []core.Attendance{rec(3, "full", "present")}, 3, 4, 0, 0, 0},
+	}
+	h := testHandler()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := sumPeriod(h.scoreDays(tt.records), may(tt.from), may(tt.to))
+			if p.PresentDays != tt.wantPresent || p.TotalDays != tt.wantTotal {
+				t.Fatalf("present %v of %v, want %v of %v", p.PresentDays, p.TotalDays, tt.wantPresent, tt.wantTotal)
+			}
+			if math.Abs(p.Percentage-tt.wantPercent) > 1e-9 {
+				t.Fatalf("percentage %v, want %v", p.Percentage, tt.wantPercent)
+			}
+			if p.Start != may(tt.from).Format("2006-01-02") || p.End != may(tt.to).Format("2006-01-02") {
+				t.Fatalf("period %s to %s", p.Start, p.End)
+			}
+		})
+	}
+}
+
+func TestStreaks(t *testing.T) {
+	tests := []struct {
+		name                                  string
+		records                               []core.Attendance
+		wantLongest, wantCurrent, wantAbsence int
+	}{
+		{"present all week",
+			[]core.Attendance{rec(5, "full", "present"), rec(6, "full", "present"), rec(7, "full", "present"),
+				rec(8, "full", "present"), rec(9, "full", "late")},
+			5, 5, 0},
+		{"weekends and unmarked days don't break a streak",
+			[]core.Attendance{rec(9, "full", "present"), rec(12, "full", "present"), rec(14, "full", "present")},
+			3, 3, 0},
+		{"excluded days are skipped",
+			[]core.Attendance{rec(5, "full", "present"), rec(6, "full", "on_leave"), rec(7, "full", "present")},
+			2, 2, 0},
+		{"absence resets the streak",
+			[]core.Attendance{rec(5, "full", "present"), rec(6, "full", "present"), rec(7, "full", "absent"),
+				rec(8, "full", "present")},
+			2, 1, 1},
+		{"absences in a row",
+			[]core.Attendance{rec(9, "full", "absent"), rec(12, "full", "absent"), rec(13, "full", "absent"),
+				rec(14, "full", "present")},
+			1, 1, 3},
+		{"half day breaks a streak",
+			[]core.Attendance{rec(5, "full", "present"), rec(6, "full", "present"), rec(6, "second_half", "absent"),
+				rec(7, "full", "present")},
+			1, 1, 0},
+		{"ends on an absence", []core.Attendance{rec(5, "full", "present"), rec(16, "full", "absent")}, 1, 0, 1},
+	}
+	h := testHandler()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := h.studentStats(tt.records, may(5), may(16))
+			if s.LongestStreak != tt.wantLongest || s.CurrentStreak != tt.wantCurrent || s.LongestAbsenceStreak != tt.wantAbsence {
+				t.Fatalf("longest %d current %d absence %d, want %d %d %d", s.LongestStreak, s.CurrentStreak,
+					s.LongestAbsenceStreak, tt.wantLongest, tt.wantCurrent, tt.wantAbsence)
+			}
+		})
+	}
+}
+
+// Records read from postgres carry the local zone, not time.UTC
+func TestStatsWithLocalDates(t *testing.T) {
+	ist := time.FixedZone("IST", 5*3600+1800)
+	pst := time.FixedZone("PST", -8*3600)
+	var records []core.Attendance
+	for _, r := range []core.Attendance{
+		rec(5, "full", "present"), rec(6, "full", "present"), rec(7, "full", "absent"),
+		rec(8, "full", "present"), rec(8, "first_half", "on_leave"),
+	} {
+		r.Date = r.Date.In(ist)
+		records = append(records, r)
+	}
+
+	h := testHandler()
+	days := h.scoreDays(records)
+	if _, ok := days[may(5)]; !ok {
+		t.Fatal("day not found under its UTC date")
+	}
+
+	// Periods may come from the database too, in another zone
+	p := sumPeriod(days, may(5).In(pst), may(9).In(pst))
+	if p.PresentDays != 2.5 || p.TotalDays != 4.5 {
+		t.Fatalf("present %v of %v, want 2.5 of 4.5", p.PresentDays, p.TotalDays)
+	}
+	if p.Start != "2025-05-05" || p.End != "2025-05-09" {
+		t.Fatalf("period %s to %s", p.Start, p.End)
+	}
+
+	s := h.studentStats(records, may(5).In(ist), may(9).In(ist))
+	if s.LongestStreak != 2 || s.LongestAbsenceStreak != 1 || s.PresentDays != 2.5 {
+		t.Fatalf("longest %d absence %d present %v, want 2 1 2.5", s.LongestStreak, s.LongestAbsenceStreak, s.PresentDays)
+	}
+}
@@ -1,41 +1,115 @@
 package auth
 
 import (
+	"context"
 	"errors"
+	"strconv"
 	"time"
 
+	"postman-task/pkg/config"
+
+	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type JWTManager struct {
-	secretKey string
+	secretKey   string
+	issuer      string
+	audience    string
+	leeway      time.Duration
+	ttl         time.Duration
+	keys        *KeyRing
+	checkUser   UserCheck
+	checkAPIKey APIKeyCheck
 }
 
 type Claims struct {
-	UserID uint   `json:"user_id"`
-	Email  string `json:"email"`
-	Role   string `json:"role"`
+	UserID  uint   `json:"user_id"`
+	Email   string `json:"email"`
+	Role    string `json:"role"`
+	Version int    `json:"ver"`
+	Actor   *Actor `json:"act,omitempty"` // set while an admin impersonates the user
+	jwt.RegisteredClaims
+}
+
+// The admin behind an impersonation token
+type Actor struct {
+	UserID    uint `json:"user_id"`
+	SessionID uint `json:"sid"`
 }
 
+// Checks that the user behind a valid token may still use it,
+// e.g. is not deactivated and the token version is current
+type UserCheck func(ctx context.Context, claims *Claims) error
+
 // Creates a JWT manager
-func NewJWTManager(secretKey string) *JWTManager {
+func NewJWTManager(cfg config.JWTConfig) *JWTManager {
 	return &JWTManager{
-		secretKey: secretKey,
+		secretKey: cfg.SecretKey,
+		issuer:    cfg.Issuer,
+		audience:  cfg.Audience,
+		leeway:    cfg.Leeway,
+		ttl:       cfg.TokenTTL,
 	}
 }
 
+// Signs and verifies with the key ring instead of the shared secret
+func (j *JWTManager) SetKeyRing(keys *KeyRing) {
+	j.keys = keys
+}
+
+// Sets the check run by AuthMiddleware on every request
+func (j *JWTManager) SetUserCheck(check UserCheck) {
+	j.checkUser = check
+}
+
 // Creates a new JWT token
-func (j *JWTManager) GenerateToken(userID uint, email, role string) (string, error) {
-	// Create token
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"user_id": userID,
-		"email":   email,
-		"role":    role,
-		"exp":     time.Now().Add(24 * time.Hour).Unix(),
-	})
+func (j *JWTManager) GenerateToken(userID uint, email, role string, version int) (string, error) {
+	return j.sign(Claims{
+		UserID:  userID,
+		Email:   email,
+		Role:    role,
+		Version: version,
+	}, j.ttl)
+}
+
+// Creates a short-lived token for user that records the admin acting as them
+func (j *JWTManager) GenerateImpersonationToken(userID uint, email, role string, version int, actor Actor, ttl time.Duration) (string, error) {
+	return j.sign(Claims{
+		UserID:  userID,
+		Email:   email,
+		Role:    role,
+		Version: version,
+		Actor:   &actor,
+	}, ttl)
+}
+
+// Fills in the registered claims and signs
+func (j *JWTManager) sign(claims Claims, ttl time.Duration) (string, error) {
+	now := time.Now()
+	claims.RegisteredClaims = jwt.RegisteredClaims{
+		Issuer:    j.issuer,
+		Subject:   strconv.FormatUint(uint64(claims.UserID), 10),
+		Audience:  jwt.ClaimStrings{j.audience},
+		IssuedAt:  jwt.NewNumericDate(now),
+		NotBefore: jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+	}
+
+	// Sign with the newest key when using the key ring
+	if j.keys != nil {
+		key, err := j.keys.current()
+		if err != nil {
+			return "", err
+		}
+		token := jwt.NewWithClaims(key.method, claims)
+		token.Header["kid"] = key.kid
+		return token.SignedString(key.private)
+	}
 
 	// Sign the token
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	tokenString, err := token.SignedString([]byte(j.secretKey))
 	if err != nil {
 		return "", err
@@ -44,33 +118,65 @@ func (j *JWTManager) GenerateToken(userID uint, email, role string) (string, err
 	return tokenString, nil
 }
 
-// Validates a token and returns claims
+// Validates a token and returns claims. Checks the signature, iss, aud,
+// nbf and exp (with leeway for clock skew), and that the claims are well typed.
 func (j *JWTManager) ValidateToken(tokenString string) (*Claims, error) {
+	method := jwt.SigningMethodHS256.Alg()
+	if j.keys != nil {
+		method = j.keys.method.Alg()
+	}
+
 	// Parse the token
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		// Check signing method
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, errors.New("invalid token")
+	var claims Claims
+	token, err := jwt.ParseWithClaims(tokenString, &claims, func(token *jwt.Token) (interface{}, error) {
+		if j.keys != nil {
+			return j.keys.verifyKey(token)
 		}
 		return []byte(j.secretKey), nil
-	})
+	},
+		jwt.WithValidMethods([]string{method}),
+		jwt.WithIssuer(j.issuer),
+		jwt.WithAudience(j.audience),
+		jwt.WithLeeway(j.leeway),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	)
+	if err != nil {
+		return nil, err
+	}
 
+	if !token.Valid || claims.UserID == 0 || claims.Role == "" {
+		return nil, errors.New("invalid token")
+	}
+	if claims.Actor != nil && (claims.Actor.UserID == 0 || claims.Actor.SessionID == 0) {
+		return nil, errors.New("invalid token")
+	}
+	return &claims, nil
+}
+
+// Validates a token and runs the user check, if one is set
+func (j *JWTManager) Authenticate(ctx context.Context, tokenString string) (*Claims, error) {
+	claims, err := j.ValidateToken(tokenString)
 	if err != nil {
 		return nil, err
 	}
 
-	// Check if token is valid
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if ok && token.Valid {
-		// Convert claims to our Claims type
-		return &Claims{
-			UserID: uint(claims["user_id"].(float64)),
-			Email:  claims["email"].(string),
-			Role:   claims["role"].(string),
-		}, nil
+	if j.checkUser != nil {
+		if err := j.checkUser(ctx, claims); err != nil {
+			return nil, err
+		}
 	}
+	return claims, nil
+}
 
-	return nil, errors.New("invalid token")
+// Serves the public keys at /.well-known/jwks.json, empty with a shared secret
+func (j *JWTManager) JWKS(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	if j.keys == nil {
+		c.JSON(200, gin.H{"keys": []gin.H{}})
+		return
+	}
+	c.JSON(200, j.keys.JWKS())
 }
 
 // Hashes a password
@@ -0,0 +1,424 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"sync"
+	"time"
+
+	"postman-task/internal/metrics"
+	"postman-task/pkg/config"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+)
+
+// How often the ring checks for rotation and for keys made by other instances
+const keyCheckInterval = time.Minute
+
+// How often a token with an unknown kid may reload the ring. Only one
+// request does it, the others are refused straight away.
+const missRefreshInterval = 10 * time.Second
+
+var errUnknownKey = errors.New("unknown signing key")
+
+// A private key used to sign tokens.
+// Kept in postgres so every instance signs and verifies with the same keys.
+type SigningKey struct {
+	KID        string    `gorm:"primaryKey"`
+	Algorithm  string    `gorm:"not null"`
+	PrivateKey []byte    `gorm:"not null"`               // PKCS#8 DER, sealed with AES-GCM when Encrypted
+	Encrypted  bool      `gorm:"not null;default:false"` // rows from before encryption are sealed on first load
+	CreatedAt  time.Time `gorm:"not null"`
+	ExpiresAt  time.Time `gorm:"not null;index"` // tokens signed with it stop verifying after this
+}
+
+func (SigningKey) TableName() string {
+	return "jwt_signing_keys"
+}
+
+type ringKey struct {
+	kid       string
+	method    jwt.SigningMethod
+	private   crypto.Signer
+	createdAt time.Time
+}
+
+// Holds the asymmetric keys for signing and verifying tokens.
+// The newest key signs; older ones keep verifying until they expire,
+// so tokens issued just before a rotation stay valid.
+type KeyRing struct {
+	db       *gorm.DB
+	seal     cipher.AEAD
+	method   jwt.SigningMethod
+	rotation time.Duration
+	overlap  time.Duration
+
+	mu            sync.RWMutex
+	keys          []ringKey // newest first
+	refreshedAt   time.Time
+	missRefreshAt time.Time // last reload for an unknown kid
+}
+
+// Creates a key ring for cfg.Algorithm, making the first key if needed
+func NewKeyRing(db *gorm.DB, cfg config.JWTConfig) (*KeyRing, error) {
+	method, err := signingMethod(cfg.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	seal, err := newKeyCipher(cfg.KeyEncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRotation(cfg); err != nil {
+		return nil, err
+	}
+	if err := db.AutoMigrate(&SigningKey{}); err != nil {
+		return nil, err
+	}
+
+	k := &KeyRing{
+		db:       db,
+		seal:     seal,
+		method:   method,
+		rotation: cfg.RotationInterval,
+		overlap:  cfg.KeyOverlap,
+	}
+	if err := k.Refresh(context.Background()); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func signingMethod(alg string) (jwt.SigningMethod, error) {
+	switch alg {
+	case "RS256":
+		return jwt.SigningMethodRS256, nil
+	case "ES256":
+		return jwt.SigningMethodES256, nil
+	case "EdDSA":
+		return jwt.SigningMethodEdDSA, nil
+	}
+	return nil, fmt.Errorf("unsupported signing algorithm %q", alg)
+}
+
+// A retired key must keep verifying until every token it signed has
+// expired, impersonation tokens included
+func checkRotation(cfg config.JWTConfig) error {
+	if cfg.RotationInterval <= 0 {
+		return errors.New("jwt.rotation_interval must be positive")
+	}
+	lifetime := max(cfg.TokenTTL, cfg.ImpersonationTTL) + cfg.Leeway
+	if cfg.KeyOverlap <= lifetime {
+		return fmt.Errorf("jwt.key_overlap must be longer than the token lifetime and leeway (%s)", lifetime)
+	}
+	return nil
+}
+
+// AES-256-GCM keyed by the SHA-256 of the configured secret, so any
+// passphrase works
+func newKeyCipher(secret string) (cipher.AEAD, error) {
+	if secret == "" {
+		return nil, errors.New("jwt.key_encryption_key is not set")
+	}
+	sum := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypts a private key, bound to its kid so rows can't be swapped
+func (k *KeyRing) sealKey(kid string, der []byte) ([]byte, error) {
+	nonce := make([]byte, k.seal.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return k.seal.Seal(nonce, nonce, der, []byte(kid)), nil
+}
+
+func (k *KeyRing) openKey(kid string, sealed []byte) ([]byte, error) {
+	size := k.seal.NonceSize()
+	if len(sealed) < size {
+		return nil, errors.New("sealed key is too short")
+	}
+	der, err := k.seal.Open(nil, sealed[:size], sealed[size:], []byte(kid))
+	if err != nil {
+		return nil, errors.New("can't decrypt, was jwt.key_encryption_key changed?")
+	}
+	return der, nil
+}
+
+// Reloads the keys, creating a new one when the newest is due for rotation
+func (k *KeyRing) Refresh(ctx context.Context) error {
+	keys, err := k.load(ctx)
+	if err != nil {
+		return err
+	}
+
+	if k.rotationDue(keys) {
+		if err := k.rotate(ctx); err != nil {
+			return err
+		}
+		if keys, err = k.load(ctx); err != nil {
+			return err
+		}
+	}
+
+	k.mu.Lock()
+	k.keys = keys
+	k.refreshedAt = time.Now()
+	k.mu.Unlock()
+	return nil
+}
+
+// Whether keys, newest first, need a new key
+func (k *KeyRing) rotationDue(keys []ringKey) bool {
+	return len(keys) == 0 || time.Since(keys[0].createdAt) >= k.rotation
+}
+
+// Loads the unexpired keys for our algorithm
+func (k *KeyRing) load(ctx context.Context) ([]ringKey, error) {
+	var rows []SigningKey
+	err := k.db.WithContext(ctx).
+		Where("algorithm = ? AND expires_at > ?", k.method.Alg(), time.Now()).
+		Order("created_at DESC").
+		Find(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]ringKey, 0, len(rows))
+	for _, row := range rows {
+		der := row.PrivateKey
+		if row.Encrypted {
+			if der, err = k.openKey(row.KID, row.PrivateKey); err != nil {
+				return nil, fmt.Errorf("signing key %s: %w", row.KID, err)
+			}
+		} else if err := k.sealStored(ctx, row); err != nil {
+			return nil, fmt.Errorf("signing key %s: %w", row.KID, err)
+		}
+
+		parsed, err := x509.ParsePKCS8PrivateKey(der)
+		if err != nil {
+			return nil, fmt.Errorf("signing key %s: %w", row.KID, err)
+		}
+		signer, ok := parsed.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("signing key %s: not a signing key", row.KID)
+		}
+		keys = append(keys, ringKey{
+			kid:       row.KID,
+			method:    k.method,
+			private:   signer,
+			createdAt: row.CreatedAt,
+		})
+	}
+	return keys, nil
+}
+
+// Encrypts a key stored before keys were sealed
+func (k *KeyRing) sealStored(ctx context.Context, row SigningKey) error {
+	sealed, err := k.sealKey(row.KID, row.PrivateKey)
+	if err != nil {
+		return err
+	}
+	return k.db.WithContext(ctx).Model(&SigningKey{}).
+		Where("kid = ? AND encrypted = ?", row.KID, false).
+		Updates(map[string]interface{}{"private_key": sealed, "encrypted": true}).Error
+}
+
+// Stores a new key and drops expired ones. Two instances rotating at
+// once just make two keys; the newest signs and both verify.
+func (k *KeyRing) rotate(ctx context.Context) error {
+	private, err := generateKey(k.method)
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return err
+	}
+
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	kid := base64.RawURLEncoding.EncodeToString(id)
+	sealed, err := k.sealKey(kid, der)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	db := k.db.WithContext(ctx)
+	err = db.Create(&SigningKey{
+		KID:        kid,
+		Algorithm:  k.method.Alg(),
+		PrivateKey: sealed,
+		Encrypted:  true,
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(k.rotation + k.overlap),
+	}).Error
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Created new %s token signing key", k.method.Alg())
+	return db.Where("expires_at <= ?", now).Delete(&SigningKey{}).Error
+}
+
+func generateKey(method jwt.SigningMethod) (crypto.Signer, error) {
+	switch method {
+	case jwt.SigningMethodRS256:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case jwt.SigningMethodES256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		return private, err
+	}
+}
+
+// Refreshes the ring every minute until ctx is cancelled
+func (k *KeyRing) Run(ctx context.Context) {
+	ticker := time.NewTicker(keyCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			start := time.Now()
+			err := k.Refresh(ctx)
+			metrics.JobRun("jwt_key_refresh", start, err)
+			if err != nil {
+				log.Printf("Signing key refresh failed: %v", err)
+			}
+		}
+	}
+}
+
+// Returns the key new tokens are signed with
+func (k *KeyRing) current() (ringKey, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if len(k.keys) == 0 {
+		return ringKey{}, errUnknownKey
+	}
+	return k.keys[0], nil
+}
+
+// Finds the key with kid. A miss reloads the ring once in a while,
+// in case another instance has just rotated.
+func (k *KeyRing) lookup(kid string) (ringKey, error) {
+	if key, ok := k.find(kid); ok {
+		return key, nil
+	}
+
+	if k.claimMissRefresh() {
+		if err := k.Refresh(context.Background()); err != nil {
+			return ringKey{}, err
+		}
+		if key, ok := k.find(kid); ok {
+			return key, nil
+		}
+	}
+	return ringKey{}, errUnknownKey
+}
+
+// Lets one caller reload the ring for an unknown kid, unless it was
+// reloaded lately, so made up kids can't send every request to postgres
+func (k *KeyRing) claimMissRefresh() bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	now := time.Now()
+	if now.Sub(k.refreshedAt) < missRefreshInterval || now.Sub(k.missRefreshAt) < missRefreshInterval {
+		return false
+	}
+	k.missRefreshAt = now
+	return true
+}
+
+func (k *KeyRing) find(kid string) (ringKey, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	for _, key := range k.keys {
+		if key.kid == kid {
+			return key, true
+		}
+	}
+	return ringKey{}, false
+}
+
+// Picks the public key for a token by its kid header
+func (k *KeyRing) verifyKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, err := k.lookup(kid)
+	if err != nil {
+		return nil, err
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, errors.New("invalid token")
+	}
+	return key.private.Public(), nil
+}
+
+// Returns the public keys as a JSON Web Key Set
+func (k *KeyRing) JWKS() gin.H {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	keys := make([]gin.H, 0, len(k.keys))
+	for _, key := range k.keys {
+		jwk := gin.H{
+			"kid": key.kid,
+			"alg": key.method.Alg(),
+			"use": "sig",
+		}
+		switch pub := key.private.Public().(type) {
+		case *rsa.PublicKey:
+			jwk["kty"] = "RSA"
+			jwk["n"] = b64(pub.N.Bytes())
+			jwk["e"] = b64(big.NewInt(int64(pub.E)).Bytes())
+		case *ecdsa.PublicKey:
+			// Uncompressed point, 0x04 || X || Y
+			point, err := pub.ECDH()
+			if err != nil {
+				continue
+			}
+			raw := point.Bytes()[1:]
+			jwk["kty"] = "EC"
+			jwk["crv"] = "P-256"
+			jwk["x"] = b64(raw[:len(raw)/2])
+			jwk["y"] = b64(raw[len(raw)/2:])
+		case ed25519.PublicKey:
+			jwk["kty"] = "OKP"
+			jwk["crv"] = "Ed25519"
+			jwk["x"] = b64(pub)
+		}
+		keys = append(keys, jwk)
+	}
+	return gin.H{"keys": keys}
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,299 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"postman-task/pkg/config"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// A ring without a database, holding one key per age, newest first. It
+// counts as just refreshed, so lookups never reach for postgres.
+func testRing(t *testing.T, method jwt.SigningMethod, ages ...time.Duration) *KeyRing {
+	t.Helper()
+	seal, err := newKeyCipher("test-key-encryption-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := &KeyRing{seal: seal, method: method, rotation: 24 * time.Hour, overlap: 48 * time.Hour, refreshedAt: time.Now()}
+	for i, age := range ages {
+		k.keys = append(k.keys, testKey(t, method, "kid-"+string(rune('a'+i)), age))
+	}
+	return k
+}
+
+func testKey(t *testing.T, method jwt.SigningMethod, kid string, age time.Duration) ringKey {
+	t.Helper()
+	private, err := generateKey(method)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ringKey{kid: kid, method: method, private: private, createdAt: time.Now().Add(-age)}
+}
+
+func ringManager(k *KeyRing) *JWTManager {
+	j := testManager()
+	j.SetKeyRing(k)
+	return j
+}
+
+func TestSigningMethod(t *testing.T) {
+	for _, alg := range []string{"RS256", "ES256", "EdDSA"} {
+		method, err := signingMethod(alg)
+		if err != nil || method.Alg() != alg {
+			t.Errorf("%s: got %v, %v", alg, method, err)
+		}
+	}
+	for _, alg := range []string{"HS256", "none", ""} {
+		if _, err := signingMethod(alg); err == nil {
+			t.Errorf("%q was accepted", alg)
+		}
+	}
+}
+
+func TestSealedKeyRoundTrip(t *testing.T) {
+	k := testRing(t, jwt.SigningMethodEdDSA)
+	der := []byte("private key bytes")
+
+	sealed, err := k.sealKey("kid-a", der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(sealed), string(der)) {
+		t.Fatal("sealed key contains the plain key")
+	}
+	opened, err := k.openKey("kid-a", sealed)
+	if err != nil || string(opened) != string(der) {
+		t.Fatalf("opened %q, %v", opened, err)
+	}
+
+	again, _ := k.sealKey("kid-a", der)
+	if string(again) == string(sealed) {
+		t.Fatal("sealing twice gave the same bytes, the nonce is not random")
+	}
+
+	other := testRing(t, jwt.SigningMethodEdDSA)
+	other.seal, _ = newKeyCipher("another-key-encryption-key")
+	tampered := append([]byte{}, sealed...)
+	tampered[len(tampered)-1] ^= 1
+
+	tests := []struct {
+		name   string
+		ring   *KeyRing
+		kid    string
+		sealed []byte
+	}{
+		{"other kid", k, "kid-b", sealed},
+		{"other encryption key", other, "kid-a", sealed},
+		{"tampered", k, "kid-a", tampered},
+		{"too short", k, "kid-a", sealed[:4]},
+		{"empty", k, "kid-a", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.ring.openKey(tt.kid, tt.sealed); err == nil {
+				t.Fatal("opened")
+			}
+		})
+	}
+}
+
+func TestNewKeyRingChecksConfig(t *testing.T) {
+	valid := config.JWTConfig{
+		Algorithm:        "ES256",
+		KeyEncryptionKey: "test-key-encryption-key",
+		RotationInterval: 720 * time.Hour,
+		KeyOverlap:       48 * time.Hour,
+		TokenTTL:         24 * time.Hour,
+		Leeway:           30 * time.Second,
+		ImpersonationTTL: 15 * time.Minute,
+	}
+	if err := checkRotation(valid); err != nil {
+		t.Fatalf("default settings refused: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(*config.JWTConfig)
+	}{
+		{"unknown algorithm", func(c *config.JWTConfig) { c.Algorithm = "HS512" }},
+		{"no encryption key", func(c *config.JWTConfig) { c.KeyEncryptionKey = "" }},
+		{"no rotation", func(c *config.JWTConfig) { c.RotationInterval = 0 }},
+		{"overlap shorter than tokens", func(c *config.JWTConfig) { c.KeyOverlap = time.Hour }},
+		{"overlap equal to tokens", func(c *config.JWTConfig) { c.KeyOverlap = 24 * time.Hour }},
+		{"overlap eaten by leeway", func(c *config.JWTConfig) { c.KeyOverlap = 24*time.Hour + 10*time.Second }},
+		{"overlap shorter than impersonation", func(c *config.JWTConfig) {
+			c.TokenTTL, c.ImpersonationTTL, c.KeyOverlap = time.Minute, time.Hour, 30*time.Minute
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := valid
+			tt.change(&cfg)
+			// Refused before the database is touched
+			if _, err := NewKeyRing(nil, cfg); err == nil {
+				t.Fatal("accepted")
+			}
+		})
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	k := testRing(t, jwt.SigningMethodES256)
+	if !k.rotationDue(k.keys) {
+		t.Fatal("an empty ring is not due for a key")
+	}
+	k.keys = []ringKey{testKey(t, k.method, "old", 25*time.Hour)}
+	if !k.rotationDue(k.keys) {
+		t.Fatal("a key older than the rotation interval is not due for rotation")
+	}
+
+	j := ringManager(k)
+	oldToken, err := j.GenerateToken(1, "a@b.c", "student", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// What Refresh ends up with after rotate, the new key first
+	k.keys = append([]ringKey{testKey(t, k.method, "new", 0)}, k.keys...)
+	if k.rotationDue(k.keys) {
+		t.Fatal("a fresh key is due for rotation")
+	}
+	newToken, err := j.GenerateToken(1, "a@b.c", "student", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, _, _ := jwt.NewParser().ParseUnverified(newToken, &Claims{})
+	if parsed.Header["kid"] != "new" {
+		t.Fatalf("signed with %v, want the new key", parsed.Header["kid"])
+	}
+
+	// Both verify during the overlap
+	for _, token := range []string{oldToken, newToken} {
+		if _, err := j.ValidateToken(token); err != nil {
+			t.Fatalf("token refused during the overlap: %v", err)
+		}
+	}
+
+	// Once the old key expires its tokens stop verifying
+	k.keys = k.keys[:1]
+	if _, err := j.ValidateToken(oldToken); !errors.Is(err, errUnknownKey) {
+		t.Fatalf("token of an expired key: %v", err)
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	for _, method := range []jwt.SigningMethod{jwt.SigningMethodRS256, jwt.SigningMethodES256, jwt.SigningMethodEdDSA} {
+		t.Run(method.Alg(), func(t *testing.T) {
+			k := testRing(t, method, 0, time.Hour)
+			token, err := ringManager(k).GenerateToken(1, "a@b.c", "student", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			keys := k.JWKS()["keys"].([]gin.H)
+			if len(keys) != 2 {
+				t.Fatalf("got %d keys, want 2", len(keys))
+			}
+			for i, jwk := range keys {
+				if jwk["kid"] != k.keys[i].kid || jwk["alg"] != method.Alg() || jwk["use"] != "sig" {
+					t.Fatalf("key %d: %v", i, jwk)
+				}
+			}
+
+			// A verifier holding only the JWKS accepts our token
+			public := publicFromJWK(t, keys[0])
+			_, err = jwt.Parse(token, func(*jwt.Token) (interface{}, error) { return public, nil },
+				jwt.WithValidMethods([]string{method.Alg()}))
+			if err != nil {
+				t.Fatalf("token does not verify with the published key: %v", err)
+			}
+
+			// and no private parts are published
+			for _, field := range []string{"d", "p", "q", "dp", "dq", "qi"} {
+				if _, ok := keys[0][field]; ok {
+					t.Fatalf("published private field %q", field)
+				}
+			}
+		})
+	}
+}
+
+// Rebuilds a public key from a JWK as a relying party would
+func publicFromJWK(t *testing.T, jwk gin.H) interface{} {
+	t.Helper()
+	field := func(name string) []byte {
+		b, err := base64.RawURLEncoding.DecodeString(jwk[name].(string))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		return b
+	}
+	switch jwk["kty"] {
+	case "RSA":
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(field("n")), E: int(new(big.Int).SetBytes(field("e")).Int64())}
+	case "EC":
+		if jwk["crv"] != "P-256" || len(field("x")) != 32 || len(field("y")) != 32 {
+			t.Fatalf("bad EC key %v", jwk)
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(field("x")), Y: new(big.Int).SetBytes(field("y"))}
+	case "OKP":
+		if jwk["crv"] != "Ed25519" {
+			t.Fatalf("bad OKP key %v", jwk)
+		}
+		return ed25519.PublicKey(field("x"))
+	}
+	t.Fatalf("unknown key type %v", jwk["kty"])
+	return nil
+}
+
+func TestUnknownKidRefreshIsRateLimited(t *testing.T) {
+	k := testRing(t, jwt.SigningMethodEdDSA, 0)
+
+	// Just refreshed, a made up kid is refused without a reload. The ring
+	// has no database, so a reload would panic.
+	if _, err := k.lookup("made-up"); !errors.Is(err, errUnknownKey) {
+		t.Fatalf("got %v, want errUnknownKey", err)
+	}
+
+	// Once the ring is stale only one of many concurrent misses reloads
+	k.refreshedAt = time.Now().Add(-time.Minute)
+	var claimed atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if k.claimMissRefresh() {
+				claimed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := claimed.Load(); n != 1 {
+		t.Fatalf("%d reloads, want 1", n)
+	}
+
+	// and the next one waits out the interval, even if that reload failed
+	// and left refreshedAt behind
+	if k.claimMissRefresh() {
+		t.Fatal("reloaded again straight away")
+	}
+	k.missRefreshAt = time.Now().Add(-missRefreshInterval)
+	if !k.claimMissRefresh() {
+		t.Fatal("no reload after the interval")
+	}
+}
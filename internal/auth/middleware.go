@@ -1,14 +1,23 @@
 package auth
 
 import (
+	"log"
 	"strings"
 
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Checks for valid JWT token
 func (j *JWTManager) AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		// Service accounts use an API key instead of a token
+		if key := c.GetHeader(APIKeyHeader); key != "" && j.checkAPIKey != nil {
+			j.authenticateAPIKey(c, key)
+			return
+		}
+
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
 			c.JSON(401, gin.H{"error": "No token provided"})
@@ -32,17 +41,88 @@ func (j *JWTManager) AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
+		// Make sure the token hasn't been revoked
+		if j.checkUser != nil {
+			if err := j.checkUser(c.Request.Context(), claims); err != nil {
+				c.JSON(401, gin.H{"error": "Token no longer valid"})
+				c.Abort()
+				return
+			}
+		}
+
 		// Add user info to context
 		c.Set("user_id", claims.UserID)
 		c.Set("user_role", claims.Role)
 
+		if claims.Actor == nil {
+			c.Next()
+			return
+		}
+
+		// Attribute everything done while impersonating to both users
+		c.Set("actor_id", claims.Actor.UserID)
+		trace.SpanFromContext(c.Request.Context()).SetAttributes(
+			attribute.Int64("enduser.id", int64(claims.UserID)),
+			attribute.Int64("enduser.actor_id", int64(claims.Actor.UserID)),
+			attribute.Int64("impersonation.session_id", int64(claims.Actor.SessionID)),
+		)
+
 		c.Next()
+
+		log.Printf("Impersonation session %d: admin %d as user %d: %s %s -> %d",
+			claims.Actor.SessionID, claims.Actor.UserID, claims.UserID,
+			c.Request.Method, c.Request.URL.Path, c.Writer.Status())
 	}
 }
 
+// Blocks sensitive operations, like changing the password, while impersonating
+func (j *JWTManager) NoImpersonation() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := c.Get("actor_id"); ok {
+			c.JSON(403, gin.H{"error": "Not allowed while impersonating"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// Authenticates a service account, only on routes its key's scopes open
+func (j *JWTManager) authenticateAPIKey(c *gin.Context, key string) {
+	principal, err := j.checkAPIKey(c.Request.Context(), key, c.ClientIP())
+	if err != nil {
+		c.JSON(401, gin.H{"error": "Invalid API key"})
+		c.Abort()
+		return
+	}
+
+	if !ScopesAllow(principal.Scopes, c.Request.Method+" "+c.FullPath()) {
+		c.JSON(403, gin.H{"error": "API key does not allow this endpoint"})
+		c.Abort()
+		return
+	}
+
+	c.Set("user_id", principal.UserID)
+	c.Set("user_role", principal.Role)
+	c.Set("api_key_id", principal.KeyID)
+
+	c.Next()
+}
+
+// Reports whether the request was made with an API key. Its scope was
+// already checked against the route, so role checks let it through.
+func isAPIKey(c *gin.Context) bool {
+	_, ok := c.Get("api_key_id")
+	return ok
+}
+
 // Checks if user is admin
 func (j *JWTManager) AdminOnly() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		if isAPIKey(c) {
+			c.Next()
+			return
+		}
 		role, exists := c.Get("user_role")
 		if !exists || role != "admin" {
 			c.JSON(403, gin.H{"error": "Admin access required"})
@@ -56,6 +136,10 @@ func (j *JWTManager) AdminOnly() gin.HandlerFunc {
 // Checks if user is faculty or warden
 func (j *JWTManager) FacultyOrWarden() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		if isAPIKey(c) {
+			c.Next()
+			return
+		}
 		role, exists := c.Get("user_role")
 		if !exists || (role != "faculty" && role != "warden") {
 			c.JSON(403, gin.H{"error": "Access denied"})
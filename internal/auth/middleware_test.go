@@ -0,0 +1,200 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"postman-task/pkg/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+const testSecret = "fuzz-secret"
+
+func testManager() *JWTManager {
+	return NewJWTManager(config.JWTConfig{
+		SecretKey: testSecret,
+		Algorithm: "HS256",
+		Issuer:    "campus-api",
+		Audience:  "campus-api",
+		TokenTTL:  time.Hour,
+		Leeway:    30 * time.Second,
+	})
+}
+
+// Runs the middleware on a request with the given Authorization header
+func serve(j *JWTManager, header string) (int, bool) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	reached := false
+	r.GET("/", j.AuthMiddleware(), func(c *gin.Context) {
+		id, _ := c.Get("user_id")
+		reached = id.(uint) != 0
+		c.Status(200)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", header)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w.Code, reached
+}
+
+// Signs an arbitrary payload with the test secret, so the fuzzer can
+// reach the claims parsing past the signature check
+func signRaw(header, payload string) string {
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString([]byte(header)) + "." + enc.EncodeToString([]byte(payload))
+	mac := hmac.New(sha256.New, []byte(testSecret))
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + enc.EncodeToString(mac.Sum(nil))
+}
+
+func checkResult(t *testing.T, code int, reached bool) {
+	t.Helper()
+	if code != 200 && code != 401 {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if code == 200 && !reached {
+		t.Fatalf("request passed without a user id")
+	}
+}
+
+func FuzzAuthMiddlewareHeader(f *testing.F) {
+	j := testManager()
+	valid, err := j.GenerateToken(1, "a@b.c", "student", 0)
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	f.Add("Bearer " + valid)
+	f.Add("")
+	f.Add("Bearer")
+	f.Add("Bearer a.b.c")
+	f.Add("Bearer " + valid + " extra")
+	f.Add("Basic dXNlcjpwYXNz")
+	f.Add("Bearer eyJhbGciOiJub25lIn0.eyJ1c2VyX2lkIjoxfQ.")
+
+	f.Fuzz(func(t *testing.T, header string) {
+		code, reached := serve(j, header)
+		checkResult(t, code, reached)
+	})
+}
+
+func FuzzAuthMiddlewareClaims(f *testing.F) {
+	j := testManager()
+	exp := time.Now().Add(time.Hour).Unix()
+	now := time.Now().Unix()
+
+	f.Add(`{"alg":"HS256","typ":"JWT"}`, `{"user_id":1,"role":"student","iss":"campus-api","aud":"campus-api","exp":`+itoa(exp)+`}`)
+	f.Add(`{"alg":"HS256"}`, `{"user_id":"1","role":"student"}`)
+	f.Add(`{"alg":"HS256"}`, `{"user_id":-1,"role":7,"exp":"soon"}`)
+	f.Add(`{"alg":"HS256"}`, `{"user_id":1e300,"email":null,"ver":"x"}`)
+	f.Add(`{"alg":"HS256"}`, `{"aud":[1,2],"iss":{},"nbf":`+itoa(now)+`}`)
+	f.Add(`{"alg":"none"}`, `{"user_id":1,"role":"admin"}`)
+	f.Add(`{"alg":"HS256"}`, `[]`)
+	f.Add(`not json`, `null`)
+
+	f.Fuzz(func(t *testing.T, header, payload string) {
+		code, reached := serve(j, "Bearer "+signRaw(header, payload))
+		checkResult(t, code, reached)
+	})
+}
+
+func TestValidateTokenRegisteredClaims(t *testing.T) {
+	j := testManager()
+	valid, err := j.GenerateToken(1, "a@b.c", "student", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := serve(j, "Bearer "+valid); code != 200 {
+		t.Fatalf("valid token rejected with %d", code)
+	}
+
+	exp := itoa(time.Now().Add(time.Hour).Unix())
+	cases := map[string]string{
+		"wrong issuer":   `{"user_id":1,"role":"student","iss":"other","aud":"campus-api","exp":` + exp + `}`,
+		"wrong audience": `{"user_id":1,"role":"student","iss":"campus-api","aud":"other","exp":` + exp + `}`,
+		"no expiry":      `{"user_id":1,"role":"student","iss":"campus-api","aud":"campus-api"}`,
+		"expired":        `{"user_id":1,"role":"student","iss":"campus-api","aud":"campus-api","exp":` + itoa(time.Now().Add(-time.Minute).Unix()) + `}`,
+		"not yet valid":  `{"user_id":1,"role":"student","iss":"campus-api","aud":"campus-api","exp":` + exp + `,"nbf":` + itoa(time.Now().Add(time.Minute).Unix()) + `}`,
+		"no user":        `{"role":"student","iss":"campus-api","aud":"campus-api","exp":` + exp + `}`,
+	}
+	for name, payload := range cases {
+		token := signRaw(`{"alg":"HS256","typ":"JWT"}`, payload)
+		if code, _ := serve(j, "Bearer "+token); code != 401 {
+			t.Errorf("%s: got %d, want 401", name, code)
+		}
+	}
+
+	// Within the leeway
+	skewed := `{"user_id":1,"role":"student","iss":"campus-api","aud":"campus-api","exp":` +
+		itoa(time.Now().Add(-10*time.Second).Unix()) + `}`
+	if code, _ := serve(j, "Bearer "+signRaw(`{"alg":"HS256"}`, skewed)); code != 200 {
+		t.Errorf("token expired within leeway rejected with %d", code)
+	}
+}
+
+func itoa(n int64) string {
+	return strconv.FormatInt(n, 10)
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	j := testManager()
+	j.SetAPIKeyCheck(func(ctx context.Context, key, ip string) (*APIKeyPrincipal, error) {
+		if key != "good" {
+			return nil, errMalformedKey
+		}
+		return &APIKeyPrincipal{KeyID: 1, UserID: 9, Role: "service", Scopes: []string{"leaves:read"}}, nil
+	})
+
+	r := gin.New()
+	api := r.Group("/api/v1", j.AuthMiddleware())
+	api.GET("/leaves", j.FacultyOrWarden(), func(c *gin.Context) { c.Status(200) })
+	api.GET("/users", j.AdminOnly(), func(c *gin.Context) { c.Status(200) })
+
+	cases := []struct {
+		path, key string
+		want      int
+	}{
+		{"/api/v1/leaves", "good", 200},
+		{"/api/v1/users", "good", 403},
+		{"/api/v1/leaves", "bad", 401},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		req.Header.Set(APIKeyHeader, tc.key)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tc.want {
+			t.Errorf("%s with %q: got %d, want %d", tc.path, tc.key, w.Code, tc.want)
+		}
+	}
+}
+
+func TestAPIKeyFormat(t *testing.T) {
+	key, prefix, hash, err := NewAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := APIKeyPrefix(key)
+	if err != nil || got != prefix {
+		t.Fatalf("prefix of %q: got %q, %v, want %q", key, got, err, prefix)
+	}
+	if HashOpaqueToken(key) != hash {
+		t.Fatal("hash does not match key")
+	}
+	for _, bad := range []string{"", "ck_", "ck_1234_", "xx_12345678_secret", "ck_123_secret"} {
+		if _, err := APIKeyPrefix(bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"unicode"
+
+	"postman-task/pkg/config"
+)
+
+// bcrypt ignores anything past 72 bytes
+const maxPasswordLength = 72
+
+// Checks a new password against the configured strength rules
+func ValidatePassword(rules config.PasswordConfig, password string) error {
+	if len(password) < rules.MinLength {
+		return fmt.Errorf("password must be at least %d characters", rules.MinLength)
+	}
+	if len(password) > maxPasswordLength {
+		return fmt.Errorf("password must be at most %d bytes", maxPasswordLength)
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r):
+			symbol = true
+		}
+	}
+
+	if rules.RequireUpper && !upper {
+		return errors.New("password must contain an uppercase letter")
+	}
+	if rules.RequireLower && !lower {
+		return errors.New("password must contain a lowercase letter")
+	}
+	if rules.RequireDigit && !digit {
+		return errors.New("password must contain a digit")
+	}
+	if rules.RequireSymbol && !symbol {
+		return errors.New("password must contain a symbol")
+	}
+	return nil
+}
@@ -14,39 +14,233 @@ type User struct {
 	Password  string         `json:"-" gorm:"not null"` // "-" means hide from json
 	Role      string         `json:"role" gorm:"not null"`
 	Dept      string         `json:"dept" gorm:"not null"`
+	Course    string         `json:"course,omitempty" gorm:"not null;default:'';index"` // programme of study, e.g. "B.Tech"
 	Leaves    []LeaveRequest `json:"leaves,omitempty" gorm:"foreignKey:StudentID"`
 	CreatedAt time.Time      `json:"created_at"`
 	UpdatedAt time.Time      `json:"updated_at"`
 	DeletedAt gorm.DeletedAt `json:"-" gorm:"index"`
+	Version   int            `json:"version" gorm:"not null;default:1"` // bumped on every edit, sent as the ETag
+
+	// Brute-force protection
+	FailedLogins int        `json:"-" gorm:"not null;default:0"`
+	LockedUntil  *time.Time `json:"locked_until,omitempty"`
+
+	EmailVerifiedAt *time.Time `json:"email_verified_at,omitempty"`
+
+	// Deactivated users can't log in or use existing tokens
+	DeactivatedAt *time.Time `json:"deactivated_at,omitempty"`
+	// Bumped to invalidate every token issued before
+	TokenVersion int `json:"-" gorm:"not null;default:0"`
+
+	// Faculty member who approves the student's leave requests
+	AdvisorID *uint `json:"advisor_id,omitempty" gorm:"index"`
+
+	// Two-factor authentication, the secret is pending until enabled
+	TOTPSecret         string     `json:"-"`
+	TOTPLastStep       int64      `json:"-" gorm:"not null;default:0"`
+	TwoFactorEnabledAt *time.Time `json:"two_factor_enabled_at,omitempty"`
+}
+
+// Represents a one-time code for logging in without the authenticator app
+type RecoveryCode struct {
+	ID        uint       `json:"id" gorm:"primaryKey"`
+	UserID    uint       `json:"user_id" gorm:"not null;index"`
+	CodeHash  string     `json:"-" gorm:"not null"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// Represents a login waiting for its second factor
+type TwoFactorChallenge struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	UserID    uint      `json:"user_id" gorm:"not null;index"`
+	TokenHash string    `json:"-" gorm:"not null;uniqueIndex"`
+	Attempts  int       `json:"attempts" gorm:"not null;default:0"`
+	ExpiresAt time.Time `json:"expires_at" gorm:"not null"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Represents a role that must use two-factor authentication
+type TwoFactorPolicy struct {
+	Role      string    `json:"role" gorm:"primaryKey"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Represents a key a service account sends in the X-API-Key header.
+// Only the sha256 hash is stored; the prefix identifies the key.
+type APIKey struct {
+	ID         uint       `json:"id" gorm:"primaryKey"`
+	UserID     uint       `json:"service_account_id" gorm:"not null;index"`
+	User       User       `json:"-" gorm:"foreignKey:UserID"`
+	Name       string     `json:"name" gorm:"not null"`
+	Prefix     string     `json:"prefix" gorm:"not null;uniqueIndex"`
+	KeyHash    string     `json:"-" gorm:"not null"`
+	Scopes     []string   `json:"scopes" gorm:"serializer:json;not null"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	LastUsedIP string     `json:"last_used_ip,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// Records an admin acting as another user, for support
+type ImpersonationSession struct {
+	ID        uint       `json:"id" gorm:"primaryKey"`
+	ActorID   uint       `json:"actor_id" gorm:"not null;index"`
+	Actor     User       `json:"-" gorm:"foreignKey:ActorID"`
+	UserID    uint       `json:"user_id" gorm:"not null;index"`
+	User      User       `json:"-" gorm:"foreignKey:UserID"`
+	Reason    string     `json:"reason" gorm:"not null"`
+	ExpiresAt time.Time  `json:"expires_at" gorm:"not null"`
+	EndedAt   *time.Time `json:"ended_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// Links a user to their account at an external identity provider
+type ExternalIdentity struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	UserID    uint      `json:"user_id" gorm:"not null;index"`
+	User      User      `json:"-" gorm:"foreignKey:UserID"`
+	Provider  string    `json:"provider" gorm:"not null;uniqueIndex:idx_external_identity"`
+	Subject   string    `json:"subject" gorm:"not null;uniqueIndex:idx_external_identity"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Represents a single-use token sent to a user by email.
+// Only the sha256 hash of the token is stored.
+type UserToken struct {
+	ID        uint       `json:"id" gorm:"primaryKey"`
+	UserID    uint       `json:"user_id" gorm:"not null;index"`
+	User      User       `json:"-" gorm:"foreignKey:UserID"`
+	Purpose   string     `json:"purpose" gorm:"not null;check:purpose IN ('verify_email','reset_password')"`
+	TokenHash string     `json:"-" gorm:"not null;uniqueIndex"`
+	ExpiresAt time.Time  `json:"expires_at" gorm:"not null"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
 }
 
 // Represents a leave application
 type LeaveRequest struct {
+	ID          uint           `json:"id" gorm:"primaryKey"`
+	StudentID   uint           `json:"student_id" gorm:"not null;index"`
+	Student     User           `json:"student,omitempty" gorm:"foreignKey:StudentID"`
+	LeaveType   string         `json:"leave_type" gorm:"not null;check:leave_type IN ('Medical','Personal','Academic','Emergency')"`
+	Reason      string         `json:"reason" gorm:"not null"`
+	StartDate   time.Time      `json:"start_date" gorm:"not null"`
+	EndDate     time.Time      `json:"end_date" gorm:"not null"`
+	Portion     string         `json:"portion" gorm:"not null;default:'full';check:portion IN ('full','first_half','second_half','hours')"`
+	StartsAt    time.Time      `json:"starts_at"` // exact span, end exclusive
+	EndsAt      time.Time      `json:"ends_at"`
+	Hours       float64        `json:"duration_hours" gorm:"not null;default:0"` // working hours taken from the balance
+	Status      string         `json:"status" gorm:"not null;default:'pending';check:status IN ('pending','approved','rejected')"`
+	ApprovedBy  *uint          `json:"approved_by,omitempty" gorm:"index"`
+	Approver    *User          `json:"approver,omitempty" gorm:"foreignKey:ApprovedBy"`
+	AssignedTo  *uint          `json:"assigned_to,omitempty" gorm:"index"` // who should decide it
+	OnBehalfOf  *uint          `json:"on_behalf_of,omitempty"`             // delegator, when a delegate decided it
+	ActedBy     *uint          `json:"acted_by,omitempty" gorm:"index"`    // admin who decided it while impersonating the approver
+	DecisionKey *string        `json:"-"`                                  // Idempotency-Key of the request that decided it
+	Remarks     *string        `json:"remarks,omitempty"`
+	DecidedAt   *time.Time     `json:"decided_at,omitempty" gorm:"index"`
+	Version     int            `json:"version" gorm:"not null;default:1"` // bumped on every edit, sent as the ETag
+	CreatedAt   time.Time      `json:"created_at"`
+	UpdatedAt   time.Time      `json:"updated_at"`
+	DeletedAt   gorm.DeletedAt `json:"-" gorm:"index"`
+}
+
+// Represents a supporting document, e.g. a medical certificate
+type LeaveAttachment struct {
+	ID          uint          `json:"id" gorm:"primaryKey"`
+	LeaveID     uint          `json:"leave_id" gorm:"not null;index"`
+	Leave       *LeaveRequest `json:"-" gorm:"foreignKey:LeaveID"`
+	UploadedBy  uint          `json:"uploaded_by" gorm:"not null"`
+	FileName    string        `json:"file_name" gorm:"not null"`
+	ContentType string        `json:"content_type" gorm:"not null"`
+	Size        int64         `json:"size" gorm:"not null"`
+	SHA256      string        `json:"sha256" gorm:"not null"`
+	StorageKey  string        `json:"-" gorm:"not null;uniqueIndex"`
+	CreatedAt   time.Time     `json:"created_at"`
+}
+
+// Represents approval rights handed to a colleague for a date range
+type Delegation struct {
+	ID          uint       `json:"id" gorm:"primaryKey"`
+	DelegatorID uint       `json:"delegator_id" gorm:"not null;index"`
+	Delegator   User       `json:"-" gorm:"foreignKey:DelegatorID"`
+	DelegateID  uint       `json:"delegate_id" gorm:"not null;index"`
+	Delegate    User       `json:"-" gorm:"foreignKey:DelegateID"`
+	StartDate   time.Time  `json:"start_date" gorm:"not null"`
+	EndDate     time.Time  `json:"end_date" gorm:"not null"`
+	Reason      string     `json:"reason"`
+	RevokedAt   *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// Represents an entry in the academic calendar, e.g. an exam period.
+// An empty Dept applies to every department.
+type CalendarEvent struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	Title     string    `json:"title" gorm:"not null"`
+	Kind      string    `json:"kind" gorm:"not null;index;check:kind IN ('exam','holiday','term')"`
+	Dept      string    `json:"dept" gorm:"not null;default:''"`
+	StartDate time.Time `json:"start_date" gorm:"not null"`
+	EndDate   time.Time `json:"end_date" gorm:"not null"`
+	CreatedBy uint      `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Represents a report generated on a schedule and emailed to its
+// recipients. An empty Dept covers every department.
+type ReportDefinition struct {
 	ID         uint           `json:"id" gorm:"primaryKey"`
-	StudentID  uint           `json:"student_id" gorm:"not null;index"`
-	Student    User           `json:"student,omitempty" gorm:"foreignKey:StudentID"`
-	LeaveType  string         `json:"leave_type" gorm:"not null;check:leave_type IN ('Medical','Personal','Academic','Emergency')"`
-	Reason     string         `json:"reason" gorm:"not null"`
-	StartDate  time.Time      `json:"start_date" gorm:"not null"`
-	EndDate    time.Time      `json:"end_date" gorm:"not null"`
-	Status     string         `json:"status" gorm:"not null;default:'pending';check:status IN ('pending','approved','rejected')"`
-	ApprovedBy *uint          `json:"approved_by,omitempty" gorm:"index"`
-	Approver   *User          `json:"approver,omitempty" gorm:"foreignKey:ApprovedBy"`
-	Remarks    *string        `json:"remarks,omitempty"`
+	Name       string         `json:"name" gorm:"not null"`
+	Kind       string         `json:"kind" gorm:"not null;check:kind IN ('attendance','leaves','absentees')"`
+	Format     string         `json:"format" gorm:"not null;default:'pdf';check:format IN ('pdf','csv')"`
+	Dept       string         `json:"dept" gorm:"not null;default:''"`
+	Schedule   string         `json:"schedule" gorm:"not null;check:schedule IN ('daily','weekly','monthly')"`
+	Hour       int            `json:"hour" gorm:"not null;default:6"` // UTC hour it is sent at
+	Recipients []string       `json:"recipients" gorm:"serializer:json;not null"`
+	NextRunAt  time.Time      `json:"next_run_at" gorm:"not null;index"`
+	LastRunAt  *time.Time     `json:"last_run_at,omitempty"`
+	CreatedBy  uint           `json:"created_by" gorm:"not null"`
 	CreatedAt  time.Time      `json:"created_at"`
 	UpdatedAt  time.Time      `json:"updated_at"`
 	DeletedAt  gorm.DeletedAt `json:"-" gorm:"index"`
 }
 
+// Represents a generated report file kept in the archive
+type Report struct {
+	ID           uint      `json:"id" gorm:"primaryKey"`
+	DefinitionID uint      `json:"definition_id" gorm:"not null;index"`
+	Name         string    `json:"name" gorm:"not null"`
+	Kind         string    `json:"kind" gorm:"not null"`
+	Format       string    `json:"format" gorm:"not null"`
+	Dept         string    `json:"dept" gorm:"not null;default:''"`
+	PeriodStart  time.Time `json:"period_start" gorm:"not null"`
+	PeriodEnd    time.Time `json:"period_end" gorm:"not null"`
+	FileName     string    `json:"file_name" gorm:"not null"`
+	ContentType  string    `json:"content_type" gorm:"not null"`
+	Size         int64     `json:"size" gorm:"not null"`
+	StorageKey   string    `json:"-" gorm:"not null;uniqueIndex"`
+	SentTo       int       `json:"sent_to"`              // recipients it was emailed to
+	Error        string    `json:"error,omitempty"`      // delivery failures
+	CreatedBy    *uint     `json:"created_by,omitempty"` // who ran it by hand, nil for the schedule
+	CreatedAt    time.Time `json:"created_at" gorm:"index"`
+}
+
 // Represents daily attendance records
 type Attendance struct {
 	ID        uint           `json:"id" gorm:"primaryKey"`
 	StudentID uint           `json:"student_id" gorm:"not null;index"`
 	Student   User           `json:"student,omitempty" gorm:"foreignKey:StudentID"`
 	Date      time.Time      `json:"date" gorm:"not null;index"`
-	Present   bool           `json:"present" gorm:"not null;default:false"`
+	Session   string         `json:"session" gorm:"not null;default:'full';check:session IN ('full','first_half','second_half')"`
+	Status    string         `json:"status" gorm:"not null;default:'absent';index;check:status IN ('present','absent','on_leave','medical','excused','late')"`
+	Present   bool           `json:"present" gorm:"not null;default:false"` // true for present and late, kept for older clients
+	LeaveID   *uint          `json:"leave_id,omitempty" gorm:"index"`       // approved leave the entry comes from
+	FromLeave bool           `json:"-" gorm:"not null;default:false"`       // inserted for the leave on an unmarked day, deleted if it is revoked
 	MarkedBy  uint           `json:"marked_by" gorm:"not null"`
 	Marker    User           `json:"marker,omitempty" gorm:"foreignKey:MarkedBy"`
+	Version   int            `json:"version" gorm:"not null;default:1"` // bumped on every edit, sent as the ETag
 	CreatedAt time.Time      `json:"created_at"`
 	UpdatedAt time.Time      `json:"updated_at"`
 	DeletedAt gorm.DeletedAt `json:"-" gorm:"index"`
@@ -55,9 +249,34 @@ type Attendance struct {
 // Represents attendance statistics for a student
 type AttendanceStats struct {
 	StudentID            uint    `json:"student_id"`
-	PresentDays          int     `json:"present_days"`
-	TotalDays            int     `json:"total_days"`
+	PresentDays          float64 `json:"present_days"` // half days count 0.5
+	TotalDays            float64 `json:"total_days"`   // school days less excluded days
 	AttendancePercentage float64 `json:"attendance_percentage"`
+
+	From         string             `json:"from"`
+	To           string             `json:"to"`
+	SchoolDays   int                `json:"school_days"`
+	ExcludedDays float64            `json:"excluded_days"` // e.g. approved leave, not counted against the student
+	ByStatus     map[string]float64 `json:"by_status"`
+	Weekly       []AttendancePeriod `json:"weekly"`
+	Monthly      []AttendancePeriod `json:"monthly"`
+
+	CurrentStreak        int `json:"current_streak"`         // school days attended in a row up to the end
+	LongestStreak        int `json:"longest_streak"`         // most school days attended in a row
+	LongestAbsenceStreak int `json:"longest_absence_streak"` // most school days missed in a row
+
+	Dept           string  `json:"dept"`
+	DeptPercentage float64 `json:"dept_percentage"` // average over the department's students
+	DeptDifference float64 `json:"dept_difference"` // percentage points above (or below) the average
+}
+
+// Represents attendance over a week or month within the stats period
+type AttendancePeriod struct {
+	Start       string  `json:"start"`
+	End         string  `json:"end"`
+	PresentDays float64 `json:"present_days"`
+	TotalDays   float64 `json:"total_days"`
+	Percentage  float64 `json:"percentage"`
 }
 
 // Holds pagination details
@@ -88,13 +307,114 @@ type LoginRequest struct {
 	Password string `json:"password" binding:"required,min=6"`
 }
 
+// Impersonation request body
+type ImpersonateRequest struct {
+	Reason string `json:"reason" binding:"required,min=5"`
+}
+
+// Service account creation request body
+type ServiceAccountRequest struct {
+	Name string `json:"name" binding:"required,min=2,max=50"`
+	Dept string `json:"dept" binding:"omitempty,min=2"`
+}
+
+// API key creation request body
+type APIKeyRequest struct {
+	Name          string   `json:"name" binding:"required,min=2"`
+	Scopes        []string `json:"scopes" binding:"required,min=1"`
+	ExpiresInDays int      `json:"expires_in_days" binding:"omitempty,min=1,max=730"`
+}
+
 // Registration request body
 type RegisterRequest struct {
 	Name     string `json:"name" binding:"required,min=2"`
 	Email    string `json:"email" binding:"required,email"`
-	Password string `json:"password" binding:"required,min=6"`
-	Role     string `json:"role" binding:"required"`
+	Password string `json:"password" binding:"required"`
+	Role     string `json:"role" binding:"required,oneof=student faculty warden admin"`
 	Dept     string `json:"dept" binding:"required,min=2"`
+	Course   string `json:"course"`
+}
+
+// Profile update request body, only set fields are changed
+type UpdateProfileRequest struct {
+	Name            *string `json:"name" binding:"omitempty,min=2"`
+	Email           *string `json:"email" binding:"omitempty,email"`
+	CurrentPassword string  `json:"current_password"` // needed to change the email
+}
+
+// Admin user update request body, only set fields are changed
+type UpdateUserRequest struct {
+	Role      *string `json:"role" binding:"omitempty,oneof=student faculty warden admin"`
+	Dept      *string `json:"dept" binding:"omitempty,min=2"`
+	Course    *string `json:"course"`
+	AdvisorID *uint   `json:"advisor_id"` // 0 clears it
+}
+
+// Delegation request body, dates are YYYY-MM-DD
+type DelegationRequest struct {
+	DelegateID uint   `json:"delegate_id" binding:"required"`
+	StartDate  string `json:"start_date" binding:"required"`
+	EndDate    string `json:"end_date" binding:"required"`
+	Reason     string `json:"reason"`
+}
+
+// Calendar event request body
+type CalendarEventRequest struct {
+	Title     string `json:"title" binding:"required"`
+	Kind      string `json:"kind" binding:"required,oneof=exam holiday term"`
+	Dept      string `json:"dept"`
+	StartDate string `json:"start_date" binding:"required"`
+	EndDate   string `json:"end_date" binding:"required"`
+}
+
+// Report definition request body
+type ReportDefinitionRequest struct {
+	Name       string   `json:"name" binding:"required"`
+	Kind       string   `json:"kind" binding:"required,oneof=attendance leaves absentees"`
+	Format     string   `json:"format" binding:"omitempty,oneof=pdf csv"`
+	Dept       string   `json:"dept"`
+	Schedule   string   `json:"schedule" binding:"required,oneof=daily weekly monthly"`
+	Hour       *int     `json:"hour" binding:"omitempty,min=0,max=23"`
+	Recipients []string `json:"recipients" binding:"required,min=1,dive,email"`
+}
+
+// Email verification request body
+type VerifyEmailRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+// Forgot password and resend verification request body
+type EmailRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+// Reset password request body
+type ResetPasswordRequest struct {
+	Token       string `json:"token" binding:"required"`
+	NewPassword string `json:"new_password" binding:"required"`
+}
+
+// Change password request body
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required"`
+}
+
+// Request body carrying an authenticator code
+type TwoFactorCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// Second login step, either code or recovery_code is required
+type TwoFactorLoginRequest struct {
+	ChallengeToken string `json:"challenge_token" binding:"required"`
+	Code           string `json:"code"`
+	RecoveryCode   string `json:"recovery_code"`
+}
+
+// Two-factor policy request body
+type TwoFactorPolicyRequest struct {
+	Roles []string `json:"roles" binding:"dive,oneof=student faculty warden admin"`
 }
 
 // Leave application request body
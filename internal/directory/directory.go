@@ -0,0 +1,184 @@
+package directory
+
+import (
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"postman-task/pkg/config"
+
+	"github.com/go-ldap/ldap/v3"
+	"gorm.io/gorm"
+)
+
+var ErrInvalidCredentials = errors.New("invalid directory credentials")
+
+// A person found in the directory
+type Entry struct {
+	DN     string
+	UID    string
+	Email  string
+	Name   string
+	Dept   string
+	Groups []string
+}
+
+// Authenticates users against LDAP and syncs them into the users table
+type Directory struct {
+	db  *gorm.DB
+	cfg config.LDAPConfig
+}
+
+// Creates a directory, nil when LDAP is turned off
+func New(db *gorm.DB, cfg config.LDAPConfig) *Directory {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &Directory{db: db, cfg: cfg}
+}
+
+// Opens a connection bound as the service account
+func (d *Directory) connect() (*ldap.Conn, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: d.cfg.InsecureSkipVerify}
+
+	conn, err := ldap.DialURL(d.cfg.URL, ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+
+	if d.cfg.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if err := conn.Bind(d.cfg.BindDN, d.cfg.BindPassword); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("service bind failed: %w", err)
+	}
+	return conn, nil
+}
+
+func (d *Directory) attributes() []string {
+	return []string{"dn", d.cfg.UIDAttr, d.cfg.EmailAttr, d.cfg.NameAttr, d.cfg.DeptAttr, d.cfg.GroupAttr}
+}
+
+// Checks email and password by binding as the matching user
+func (d *Directory) Authenticate(email, password string) (*Entry, error) {
+	// An empty password is an anonymous bind, which always succeeds
+	if password == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	conn, err := d.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	filter := fmt.Sprintf(d.cfg.UserFilter, ldap.EscapeFilter(email))
+	req := ldap.NewSearchRequest(d.cfg.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, 0, false, filter, d.attributes(), nil)
+	result, err := conn.Search(req)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Entries) != 1 {
+		return nil, ErrInvalidCredentials
+	}
+
+	entry := d.toEntry(result.Entries[0])
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// Lists every user matched by the sync filter
+func (d *Directory) Search() ([]Entry, error) {
+	conn, err := d.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	req := ldap.NewSearchRequest(d.cfg.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		0, 0, false, d.cfg.SyncFilter, d.attributes(), nil)
+	result, err := conn.SearchWithPaging(req, 500)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]Entry, 0, len(result.Entries))
+	for _, e := range result.Entries {
+		entry := d.toEntry(e)
+		// Without these we can't match the entry to a user
+		if entry.UID == "" || entry.Email == "" {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (d *Directory) toEntry(e *ldap.Entry) Entry {
+	uid := e.GetAttributeValue(d.cfg.UIDAttr)
+	// objectGUID is binary in Active Directory
+	if strings.EqualFold(d.cfg.UIDAttr, "objectGUID") {
+		uid = hex.EncodeToString(e.GetRawAttributeValue(d.cfg.UIDAttr))
+	}
+
+	return Entry{
+		DN:     e.DN,
+		UID:    uid,
+		Email:  strings.ToLower(e.GetAttributeValue(d.cfg.EmailAttr)),
+		Name:   e.GetAttributeValue(d.cfg.NameAttr),
+		Dept:   e.GetAttributeValue(d.cfg.DeptAttr),
+		Groups: e.GetAttributeValues(d.cfg.GroupAttr),
+	}
+}
+
+// Works out role and department from group rules, the entry and defaults
+func (d *Directory) roleAndDept(e Entry) (string, string) {
+	role, dept := d.cfg.DefaultRole, e.Dept
+
+	for _, rule := range d.cfg.GroupRules {
+		if memberOf(e.Groups, rule.Group) {
+			role = rule.Role
+			if rule.Dept != "" {
+				dept = rule.Dept
+			}
+			break
+		}
+	}
+
+	if dept == "" {
+		dept = d.cfg.DefaultDept
+	}
+	return role, dept
+}
+
+// Matches a group by full DN or by CN
+func memberOf(groups []string, group string) bool {
+	for _, g := range groups {
+		if strings.EqualFold(g, group) {
+			return true
+		}
+		dn, err := ldap.ParseDN(g)
+		if err != nil || len(dn.RDNs) == 0 {
+			continue
+		}
+		for _, attr := range dn.RDNs[0].Attributes {
+			if strings.EqualFold(attr.Type, "cn") && strings.EqualFold(attr.Value, group) {
+				return true
+			}
+		}
+	}
+	return false
+}
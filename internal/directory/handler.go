@@ -0,0 +1,42 @@
+package directory
+
+import (
+	"log"
+	"time"
+
+	"postman-task/internal/metrics"
+
+	"github.com/gin-gonic/gin"
+)
+
+type Handler struct {
+	dir *Directory
+}
+
+// Creates new handler, dir is nil when LDAP is off
+func NewHandler(dir *Directory) *Handler {
+	return &Handler{dir: dir}
+}
+
+// Runs a directory sync now, admin only. ?dry_run=true only reports changes.
+func (h *Handler) Sync(c *gin.Context) {
+	if h.dir == nil {
+		c.JSON(404, gin.H{"error": "LDAP is not enabled"})
+		return
+	}
+
+	dryRun := c.Query("dry_run") == "true"
+
+	start := time.Now()
+	report, err := h.dir.Sync(c.Request.Context(), dryRun)
+	if !dryRun {
+		metrics.JobRun("ldap_sync", start, err)
+	}
+	if err != nil {
+		log.Printf("LDAP sync failed: %v", err)
+		c.JSON(502, gin.H{"error": "Directory sync failed"})
+		return
+	}
+
+	c.JSON(200, report)
+}
@@ -0,0 +1,352 @@
+package directory
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"postman-task/internal/core"
+	"postman-task/internal/metrics"
+	"postman-task/internal/tracing"
+
+	"gorm.io/gorm"
+)
+
+const provider = "ldap"
+
+var ErrPrivileged = errors.New("admin and service accounts can't be linked to the directory")
+
+// Admin and service accounts are managed locally, a directory entry with
+// the same email must never take them over
+func privileged(user *core.User) bool {
+	return user.Role == "admin" || user.Role == "service"
+}
+
+// One change made, or that would be made, by a sync
+type Change struct {
+	Action string            `json:"action"` // create, update, reactivate or deactivate
+	Email  string            `json:"email"`
+	UserID uint              `json:"user_id,omitempty"`
+	Fields map[string]string `json:"fields,omitempty"` // new values
+
+	entry *Entry
+	user  *core.User
+	link  bool // entry isn't linked to the user yet
+}
+
+// Summary of a sync run
+type Report struct {
+	DryRun      bool      `json:"dry_run"`
+	StartedAt   time.Time `json:"started_at"`
+	FinishedAt  time.Time `json:"finished_at"`
+	Seen        int       `json:"seen"`
+	Created     int       `json:"created"`
+	Updated     int       `json:"updated"`
+	Reactivated int       `json:"reactivated"`
+	Deactivated int       `json:"deactivated"`
+	Changes     []Change  `json:"changes"`
+}
+
+// Works out what has to change for user to match the entry.
+// user is nil when no user exists yet. Returns nil if nothing changes.
+func (d *Directory) plan(e Entry, user *core.User, linked bool) *Change {
+	role, dept := d.roleAndDept(e)
+	name := e.Name
+	if name == "" {
+		name = e.Email
+	}
+
+	if user != nil && !linked && privileged(user) {
+		return nil
+	}
+
+	if user == nil {
+		return &Change{
+			Action: "create",
+			Email:  e.Email,
+			Fields: map[string]string{"name": name, "role": role, "dept": dept},
+			entry:  &e,
+			link:   true,
+		}
+	}
+
+	fields := map[string]string{}
+	if user.Name != name {
+		fields["name"] = name
+	}
+	if user.Dept != dept {
+		fields["dept"] = dept
+	}
+	// Admins are managed locally, never demote them from the directory
+	if user.Role != role && user.Role != "admin" {
+		fields["role"] = role
+	}
+	if len(fields) == 0 && linked {
+		return nil
+	}
+
+	return &Change{
+		Action: "update",
+		Email:  e.Email,
+		UserID: user.ID,
+		Fields: fields,
+		entry:  &e,
+		user:   user,
+		link:   !linked,
+	}
+}
+
+// Writes a planned change and returns the resulting user
+func apply(tx *gorm.DB, ch *Change) (*core.User, error) {
+	switch ch.Action {
+	case "create":
+		now := time.Now()
+		user := core.User{
+			Name:            ch.Fields["name"],
+			Email:           ch.Email,
+			Password:        "", // directory users log in through LDAP only
+			Role:            ch.Fields["role"],
+			Dept:            ch.Fields["dept"],
+			EmailVerifiedAt: &now,
+		}
+		if err := tx.Create(&user).Error; err != nil {
+			return nil, err
+		}
+		ch.UserID = user.ID
+		ch.user = &user
+
+	case "update", "reactivate":
+		updates := map[string]interface{}{}
+		for k, v := range ch.Fields {
+			updates[k] = v
+		}
+		// The role is in the token, so revoke older ones
+		if _, ok := ch.Fields["role"]; ok {
+			updates["token_version"] = gorm.Expr("token_version + 1")
+		}
+		if ch.Action == "reactivate" {
+			updates["deactivated_at"] = nil
+		}
+		if len(updates) > 0 {
+			updates["version"] = gorm.Expr("version + 1")
+			if err := tx.Model(ch.user).Updates(updates).Error; err != nil {
+				return nil, err
+			}
+		}
+
+	case "deactivate":
+		err := tx.Model(ch.user).Updates(map[string]interface{}{
+			"deactivated_at": time.Now(),
+			"token_version":  gorm.Expr("token_version + 1"),
+			"version":        gorm.Expr("version + 1"),
+		}).Error
+		if err != nil {
+			return nil, err
+		}
+		return ch.user, nil
+	}
+
+	if ch.link {
+		err := tx.Create(&core.ExternalIdentity{
+			UserID:   ch.UserID,
+			Provider: provider,
+			Subject:  ch.entry.UID,
+		}).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var user core.User
+	if err := tx.First(&user, ch.UserID).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// Finds the user for an entry, first by link then by email
+func findUser(tx *gorm.DB, e Entry) (*core.User, bool, error) {
+	var user core.User
+
+	var link core.ExternalIdentity
+	err := tx.Where("provider = ? AND subject = ?", provider, e.UID).First(&link).Error
+	if err == nil {
+		err = tx.First(&user, link.UserID).Error
+		if err == nil {
+			return &user, true, nil
+		}
+	}
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, false, err
+	}
+
+	err = tx.Where("lower(email) = lower(?)", e.Email).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return &user, false, nil
+}
+
+// Creates or updates the user behind an entry after a successful bind
+func (d *Directory) UpsertUser(ctx context.Context, e Entry) (*core.User, error) {
+	var user *core.User
+	err := d.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		existing, linked, err := findUser(tx, e)
+		if err != nil {
+			return err
+		}
+		if existing != nil && !linked && privileged(existing) {
+			return ErrPrivileged
+		}
+
+		ch := d.plan(e, existing, linked)
+		if ch == nil {
+			user = existing
+			return nil
+		}
+		user, err = apply(tx, ch)
+		return err
+	})
+	return user, err
+}
+
+// Brings users in line with the directory. Directory users that are gone
+// are deactivated, and reactivated if they come back. With dryRun nothing
+// is written, only reported.
+func (d *Directory) Sync(ctx context.Context, dryRun bool) (*Report, error) {
+	ctx, span := tracing.Start(ctx, "directory.sync")
+	defer span.End()
+
+	report := &Report{DryRun: dryRun, StartedAt: time.Now(), Changes: []Change{}}
+
+	entries, err := d.Search()
+	if err != nil {
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+	report.Seen = len(entries)
+
+	db := d.db.WithContext(ctx)
+
+	// Load everything up front instead of querying per entry
+	var users []core.User
+	if err := db.Find(&users).Error; err != nil {
+		return nil, err
+	}
+	byID := make(map[uint]*core.User, len(users))
+	byEmail := make(map[string]*core.User, len(users))
+	for i := range users {
+		byID[users[i].ID] = &users[i]
+		byEmail[strings.ToLower(users[i].Email)] = &users[i]
+	}
+
+	var links []core.ExternalIdentity
+	if err := db.Where("provider = ?", provider).Find(&links).Error; err != nil {
+		return nil, err
+	}
+	linkedUser := make(map[string]uint, len(links))
+	for _, l := range links {
+		linkedUser[l.Subject] = l.UserID
+	}
+
+	// Plan creates and updates for everyone in the directory
+	var changes []*Change
+	seen := make(map[uint]bool)
+	for _, e := range entries {
+		user, linked := byID[linkedUser[e.UID]], true
+		if user == nil {
+			user, linked = byEmail[strings.ToLower(e.Email)], false
+		}
+		if user != nil && !linked && privileged(user) {
+			log.Printf("LDAP sync: not linking %s, it is a local %s account", e.Email, user.Role)
+			continue
+		}
+		if user != nil {
+			seen[user.ID] = true
+		}
+		ch := d.plan(e, user, linked)
+		// Directory users who left and came back are let in again
+		if user != nil && linked && user.DeactivatedAt != nil {
+			if ch == nil {
+				ch = &Change{Email: e.Email, UserID: user.ID, entry: &e, user: user}
+			}
+			ch.Action = "reactivate"
+		}
+		if ch != nil {
+			changes = append(changes, ch)
+		}
+	}
+
+	// Plan deactivation of linked users no longer in the directory
+	for _, l := range links {
+		user := byID[l.UserID]
+		if user == nil || seen[user.ID] || user.DeactivatedAt != nil || user.Role == "admin" {
+			continue
+		}
+		changes = append(changes, &Change{
+			Action: "deactivate",
+			Email:  user.Email,
+			UserID: user.ID,
+			user:   user,
+		})
+	}
+
+	if !dryRun {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			for _, ch := range changes {
+				if _, err := apply(tx, ch); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			tracing.RecordError(span, err)
+			return nil, err
+		}
+	}
+
+	for _, ch := range changes {
+		switch ch.Action {
+		case "create":
+			report.Created++
+		case "update":
+			report.Updated++
+		case "reactivate":
+			report.Reactivated++
+		case "deactivate":
+			report.Deactivated++
+		}
+		report.Changes = append(report.Changes, *ch)
+	}
+	report.FinishedAt = time.Now()
+	return report, nil
+}
+
+// Runs the sync every interval until ctx is cancelled
+func (d *Directory) RunSync(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			start := time.Now()
+			report, err := d.Sync(ctx, false)
+			metrics.JobRun("ldap_sync", start, err)
+			if err != nil {
+				log.Printf("LDAP sync failed: %v", err)
+				continue
+			}
+			log.Printf("LDAP sync: %d seen, %d created, %d updated, %d reactivated, %d deactivated",
+				report.Seen, report.Created, report.Updated, report.Reactivated, report.Deactivated)
+		}
+	}
+}
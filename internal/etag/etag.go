@@ -0,0 +1,68 @@
+// Package etag implements optimistic concurrency for versioned records.
+// GET responses carry the record's version as an ETag, and updates must
+// send it back in If-Match so stale writes fail instead of overwriting.
+package etag
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Formats a version as an ETag
+func Of(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// Sets the ETag header for a record at version
+func Set(c *gin.Context, version int) {
+	c.Header("ETag", Of(version))
+}
+
+// Checks If-Match against the record's current version. Responds with
+// 428 when the header is missing and 412 when it is stale.
+func Match(c *gin.Context, version int) bool {
+	header := c.GetHeader("If-Match")
+	if header == "" {
+		c.JSON(428, gin.H{"error": "If-Match header is required, send the ETag from the last GET"})
+		return false
+	}
+
+	if Matches(header, version) {
+		return true
+	}
+
+	Set(c, version)
+	Stale(c)
+	return false
+}
+
+// Reports whether an If-Match header lists version's ETag, or is "*"
+func Matches(header string, version int) bool {
+	current := Of(version)
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == current {
+			return true
+		}
+	}
+	return false
+}
+
+// Applies updates to model only if it is still at version, and bumps the
+// version. Returns false when another write got there first.
+func Update(db *gorm.DB, model interface{}, version int, updates map[string]interface{}) (bool, error) {
+	updates["version"] = gorm.Expr("version + 1")
+	result := db.Model(model).Where("version = ?", version).Updates(updates)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// Responds to a write that lost the race after passing Match
+func Stale(c *gin.Context) {
+	c.JSON(412, gin.H{"error": "The record was changed by someone else, reload it and try again"})
+}
@@ -0,0 +1,96 @@
+package etag
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMatches(t *testing.T) {
+	tests := []struct {
+		header  string
+		version int
+		want    bool
+	}{
+		{`"3"`, 3, true},
+		{`"2"`, 3, false},
+		{`*`, 3, true},
+		{`"1", "3"`, 3, true},
+		{`"1","3"`, 3, true},
+		{` "3" `, 3, true},
+		{`"1", "2"`, 3, false},
+		{`3`, 3, false},        // unquoted
+		{`W/"3"`, 3, false},    // If-Match only takes strong tags
+		{`"33"`, 3, false},     // no prefix matching
+		{`"3", *`, 3, true},    // wildcard anywhere in the list
+		{``, 3, false},         // Match handles the missing header
+		{`"0"`, 0, true},       // unversioned records
+		{`"3"`, 30, false},     // no suffix matching
+		{`"3",,"4"`, 4, true},  // empty entries are ignored
+		{`"3" "4"`, 4, false},  // entries need a comma
+		{`"3"; q=1`, 3, false}, // no parameters
+	}
+	for _, tt := range tests {
+		if got := Matches(tt.header, tt.version); got != tt.want {
+			t.Errorf("Matches(%q, %d) = %v, want %v", tt.header, tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   string // empty means not sent
+		version  int
+		want     bool
+		wantCode int    // 0 when Match writes nothing
+		wantETag string // ETag sent back on a stale write
+	}{
+		{"current version", `"4"`, 4, true, 0, ""},
+		{"wildcard", `*`, 4, true, 0, ""},
+		{"missing header", "", 4, false, 428, ""},
+		{"stale version", `"3"`, 4, false, 412, `"4"`},
+		{"garbage", `nope`, 4, false, 412, `"4"`},
+	}
+	gin.SetMode(gin.TestMode)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodPatch, "/users/me", nil)
+			if tt.header != "" {
+				c.Request.Header.Set("If-Match", tt.header)
+			}
+
+			if got := Match(c, tt.version); got != tt.want {
+				t.Fatalf("Match = %v, want %v", got, tt.want)
+			}
+			if tt.wantCode == 0 {
+				if c.Writer.Written() {
+					t.Fatalf("wrote a %d response on a match", w.Code)
+				}
+				return
+			}
+			if w.Code != tt.wantCode {
+				t.Fatalf("status %d, want %d", w.Code, tt.wantCode)
+			}
+			if got := w.Header().Get("ETag"); got != tt.wantETag {
+				t.Fatalf("ETag %q, want %q", got, tt.wantETag)
+			}
+		})
+	}
+}
+
+func TestOf(t *testing.T) {
+	if got := Of(12); got != `"12"` {
+		t.Fatalf("Of(12) = %s", got)
+	}
+	// What Set sends must be accepted back by Matches
+	for _, v := range []int{0, 1, 99} {
+		if !Matches(Of(v), v) {
+			t.Fatalf("Matches(Of(%d), %d) = false", v, v)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+// Package idempotency makes POST requests safe to retry. Clients send an
+// Idempotency-Key header, and a retry with the same key gets the stored
+// response instead of running the request again.
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const Header = "Idempotency-Key"
+
+// How long a key stays locked while its first request runs, so a crashed
+// request doesn't block the key for the whole window
+const runningTTL = time.Minute
+
+// Larger responses are not stored, their requests run again on retry
+const maxStoredBody = 1 << 20
+
+type Keeper struct {
+	store  Store
+	window time.Duration
+}
+
+// Creates a keeper replaying responses for window
+func NewKeeper(store Store, window time.Duration) *Keeper {
+	return &Keeper{store: store, window: window}
+}
+
+// Captures the response while passing it on
+type recorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	if r.body.Len() <= maxStoredBody {
+		r.body.Write(b)
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *recorder) WriteString(s string) (int, error) {
+	if r.body.Len() <= maxStoredBody {
+		r.body.WriteString(s)
+	}
+	return r.ResponseWriter.WriteString(s)
+}
+
+// Handles Idempotency-Key on POST requests. Keys are kept per caller: the
+// user when it runs after AuthMiddleware, otherwise the client IP.
+func (k *Keeper) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(Header)
+		if c.Request.Method != http.MethodPost || key == "" {
+			c.Next()
+			return
+		}
+		if len(key) > 255 {
+			c.AbortWithStatusJSON(400, gin.H{"error": "Idempotency-Key is too long"})
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatusJSON(400, gin.H{"error": "Could not read request body"})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		hash := sha256.New()
+		fmt.Fprintf(hash, "%s %s?%s\n", c.Request.Method, c.Request.URL.Path, c.Request.URL.RawQuery)
+		hash.Write(body)
+
+		scope := "ip:" + c.ClientIP()
+		if userID, ok := c.Get("user_id"); ok {
+			scope = fmt.Sprint(userID)
+		}
+
+		ctx := c.Request.Context()
+		rec := &Record{
+			Key:         scope + ":" + key,
+			RequestHash: hex.EncodeToString(hash.Sum(nil)),
+			ExpiresAt:   time.Now().Add(runningTTL),
+		}
+		existing, err := k.store.Claim(ctx, rec)
+		if err != nil {
+			// Better to risk a duplicate than to fail the request
+			log.Printf("Idempotency store error: %v", err)
+			c.Next()
+			return
+		}
+
+		if existing != nil {
+			switch {
+			case existing.RequestHash != rec.RequestHash:
+				c.AbortWithStatusJSON(409, gin.H{"error": "Idempotency-Key was already used with a different request"})
+			case existing.Status == 0:
+				c.AbortWithStatusJSON(409, gin.H{"error": "A request with this Idempotency-Key is still in progress"})
+			default:
+				c.Header("Idempotent-Replayed", "true")
+				c.Data(existing.Status, existing.ContentType, existing.Body)
+				c.Abort()
+			}
+			return
+		}
+
+		w := &recorder{ResponseWriter: c.Writer}
+		c.Writer = w
+		c.Next()
+
+		// Record the outcome even if the client went away
+		ctx = context.WithoutCancel(ctx)
+
+		// Server errors and oversized responses may be retried for real
+		if w.Status() >= 500 || w.body.Len() > maxStoredBody {
+			if err := k.store.Release(ctx, rec.Key); err != nil {
+				log.Printf("Idempotency store error: %v", err)
+			}
+			return
+		}
+
+		rec.Status = w.Status()
+		rec.ContentType = w.Header().Get("Content-Type")
+		rec.Body = w.body.Bytes()
+		rec.ExpiresAt = time.Now().Add(k.window)
+		if err := k.store.Save(ctx, rec); err != nil {
+			log.Printf("Idempotency store error: %v", err)
+		}
+	}
+}
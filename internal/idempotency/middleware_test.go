@@ -0,0 +1,177 @@
+package idempotency
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A router with the middleware in front of a handler that counts its runs.
+// userID 0 leaves the request anonymous.
+func testRouter(k *Keeper, userID uint, handler gin.HandlerFunc) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/leaves", func(c *gin.Context) {
+		if userID != 0 {
+			c.Set("user_id", userID)
+		}
+		c.Next()
+	}, k.Middleware(), handler)
+	return r
+}
+
+func post(r http.Handler, url, key, body, ip string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set(Header, key)
+	}
+	if ip != "" {
+		req.RemoteAddr = ip + ":1234"
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func counting(runs *int32, status int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		n := atomic.AddInt32(runs, 1)
+		c.JSON(status, gin.H{"run": n})
+	}
+}
+
+func TestReplaysStoredResponse(t *testing.T) {
+	var runs int32
+	r := testRouter(NewKeeper(NewMemoryStore(), time.Hour), 7, counting(&runs, 201))
+
+	first := post(r, "/leaves", "k1", `{"a":1}`, "")
+	second := post(r, "/leaves", "k1", `{"a":1}`, "")
+
+	if runs != 1 {
+		t.Fatalf("handler ran %d times, want 1", runs)
+	}
+	if second.Code != 201 || second.Body.String() != first.Body.String() {
+		t.Fatalf("replay got %d %q, want %d %q", second.Code, second.Body, first.Code, first.Body)
+	}
+	if second.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatal("replay is missing Idempotent-Replayed")
+	}
+	if first.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatal("first response marked as replayed")
+	}
+}
+
+func TestRejectsReuseForDifferentRequest(t *testing.T) {
+	tests := []struct {
+		name string
+		url  string
+		body string
+	}{
+		{"different body", "/leaves", `{"a":2}`},
+		{"different query", "/leaves?dry_run=true", `{"a":1}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var runs int32
+			r := testRouter(NewKeeper(NewMemoryStore(), time.Hour), 7, counting(&runs, 200))
+
+			post(r, "/leaves", "k1", `{"a":1}`, "")
+			w := post(r, tt.url, "k1", tt.body, "")
+			if w.Code != 409 {
+				t.Fatalf("got %d, want 409", w.Code)
+			}
+			if runs != 1 {
+				t.Fatalf("handler ran %d times, want 1", runs)
+			}
+		})
+	}
+}
+
+func TestRejectsRetryWhileRunning(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	r := testRouter(NewKeeper(NewMemoryStore(), time.Hour), 7, func(c *gin.Context) {
+		close(started)
+		<-release
+		c.JSON(200, gin.H{})
+	})
+
+	done := make(chan int)
+	go func() { done <- post(r, "/leaves", "k1", `{}`, "").Code }()
+	<-started
+
+	if w := post(r, "/leaves", "k1", `{}`, ""); w.Code != 409 {
+		t.Fatalf("retry while running got %d, want 409", w.Code)
+	}
+	close(release)
+	if code := <-done; code != 200 {
+		t.Fatalf("first request got %d, want 200", code)
+	}
+}
+
+func TestServerErrorsCanBeRetried(t *testing.T) {
+	var runs int32
+	r := testRouter(NewKeeper(NewMemoryStore(), time.Hour), 7, counting(&runs, 500))
+
+	post(r, "/leaves", "k1", `{}`, "")
+	post(r, "/leaves", "k1", `{}`, "")
+	if runs != 2 {
+		t.Fatalf("handler ran %d times, want 2", runs)
+	}
+}
+
+func TestKeysAreScopedToCaller(t *testing.T) {
+	store := NewMemoryStore()
+	k := NewKeeper(store, time.Hour)
+
+	tests := []struct {
+		name  string
+		other func(*int32) *httptest.ResponseRecorder
+	}{
+		{"another user", func(runs *int32) *httptest.ResponseRecorder {
+			return post(testRouter(k, 8, counting(runs, 200)), "/leaves", "shared", `{}`, "")
+		}},
+		{"anonymous, another IP", func(runs *int32) *httptest.ResponseRecorder {
+			return post(testRouter(k, 0, counting(runs, 200)), "/leaves", "shared", `{}`, "10.0.0.2")
+		}},
+	}
+
+	// The key is first used anonymously from 10.0.0.1 and by user 7
+	var seeded int32
+	post(testRouter(k, 0, counting(&seeded, 200)), "/leaves", "shared", `{}`, "10.0.0.1")
+	post(testRouter(k, 7, counting(&seeded, 200)), "/leaves", "shared", `{}`, "")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var runs int32
+			if w := tt.other(&runs); w.Code != 200 || w.Header().Get("Idempotent-Replayed") != "" {
+				t.Fatalf("got %d replayed=%q, want a fresh 200", w.Code, w.Header().Get("Idempotent-Replayed"))
+			}
+			if runs != 1 {
+				t.Fatalf("handler ran %d times, want 1", runs)
+			}
+		})
+	}
+
+	// The same anonymous client does get its replay
+	var again int32
+	w := post(testRouter(k, 0, counting(&again, 200)), "/leaves", "shared", `{}`, "10.0.0.1")
+	if again != 0 || w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("same IP ran the handler %d times, want a replay", again)
+	}
+}
+
+func TestWithoutKeyAlwaysRuns(t *testing.T) {
+	var runs int32
+	r := testRouter(NewKeeper(NewMemoryStore(), time.Hour), 7, counting(&runs, 200))
+
+	post(r, "/leaves", "", `{}`, "")
+	post(r, "/leaves", "", `{}`, "")
+	if runs != 2 {
+		t.Fatalf("handler ran %d times, want 2", runs)
+	}
+}
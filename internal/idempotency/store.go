@@ -0,0 +1,167 @@
+package idempotency
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Represents a request made with an Idempotency-Key and, once it has
+// finished, its response
+type Record struct {
+	Key         string    `gorm:"primaryKey"`
+	RequestHash string    `gorm:"not null"`
+	Status      int       `gorm:"not null;default:0"` // 0 while the first request is running
+	ContentType string    `gorm:"not null;default:''"`
+	Body        []byte    `gorm:"type:bytea"`
+	ExpiresAt   time.Time `gorm:"not null;index"`
+}
+
+func (Record) TableName() string {
+	return "idempotency_keys"
+}
+
+// Keeps records by key until they expire
+type Store interface {
+	// Stores rec if its key is free or expired. Otherwise returns the
+	// record already stored under the key.
+	Claim(ctx context.Context, rec *Record) (*Record, error)
+	// Stores the response of a claimed record
+	Save(ctx context.Context, rec *Record) error
+	// Frees a claimed key so the request can be tried again
+	Release(ctx context.Context, key string) error
+}
+
+// Creates a store by name, "memory" or "postgres"
+func NewStore(db *gorm.DB, kind string) (Store, error) {
+	switch kind {
+	case "", "memory":
+		return NewMemoryStore(), nil
+	case "postgres":
+		return NewPostgresStore(db)
+	default:
+		return nil, fmt.Errorf("unknown idempotency store %q", kind)
+	}
+}
+
+// Keeps records in process memory, only good for a single instance
+type MemoryStore struct {
+	mu        sync.Mutex
+	records   map[string]Record
+	lastSweep time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{records: make(map[string]Record)}
+}
+
+func (s *MemoryStore) Claim(ctx context.Context, rec *Record) (*Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.sweep(now)
+
+	if existing, ok := s.records[rec.Key]; ok && now.Before(existing.ExpiresAt) {
+		return &existing, nil
+	}
+	s.records[rec.Key] = *rec
+	return nil, nil
+}
+
+func (s *MemoryStore) Save(ctx context.Context, rec *Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.records[rec.Key] = *rec
+	return nil
+}
+
+func (s *MemoryStore) Release(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.records, key)
+	return nil
+}
+
+// Drops expired records at most once a minute
+func (s *MemoryStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	for k, r := range s.records {
+		if !now.Before(r.ExpiresAt) {
+			delete(s.records, k)
+		}
+	}
+	s.lastSweep = now
+}
+
+// Keeps records in postgres so retries can land on any instance
+type PostgresStore struct {
+	db *gorm.DB
+
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+func NewPostgresStore(db *gorm.DB) (*PostgresStore, error) {
+	if err := db.AutoMigrate(&Record{}); err != nil {
+		return nil, err
+	}
+	return &PostgresStore{db: db}, nil
+}
+
+func (s *PostgresStore) Claim(ctx context.Context, rec *Record) (*Record, error) {
+	now := time.Now()
+	s.sweep(ctx, now)
+
+	// Take the key if it is free or its record expired
+	var claimed []string
+	err := s.db.WithContext(ctx).Raw(`
+		INSERT INTO idempotency_keys (key, request_hash, status, content_type, body, expires_at)
+		VALUES (?, ?, 0, '', NULL, ?)
+		ON CONFLICT (key) DO UPDATE SET
+			request_hash = EXCLUDED.request_hash, status = 0, content_type = '', body = NULL,
+			expires_at = EXCLUDED.expires_at
+		WHERE idempotency_keys.expires_at <= ?
+		RETURNING key`,
+		rec.Key, rec.RequestHash, rec.ExpiresAt, now).Scan(&claimed).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(claimed) > 0 {
+		return nil, nil
+	}
+
+	var existing Record
+	if err := s.db.WithContext(ctx).First(&existing, "key = ?", rec.Key).Error; err != nil {
+		return nil, err
+	}
+	return &existing, nil
+}
+
+func (s *PostgresStore) Save(ctx context.Context, rec *Record) error {
+	return s.db.WithContext(ctx).Save(rec).Error
+}
+
+func (s *PostgresStore) Release(ctx context.Context, key string) error {
+	return s.db.WithContext(ctx).Delete(&Record{Key: key}).Error
+}
+
+// Deletes expired records at most once a minute
+func (s *PostgresStore) sweep(ctx context.Context, now time.Time) {
+	s.mu.Lock()
+	if now.Sub(s.lastSweep) < time.Minute {
+		s.mu.Unlock()
+		return
+	}
+	s.lastSweep = now
+	s.mu.Unlock()
+
+	s.db.WithContext(ctx).Where("expires_at <= ?", now).Delete(&Record{})
+}
@@ -0,0 +1,304 @@
+package leaves
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+
+	"postman-task/internal/auth"
+	"postman-task/internal/core"
+	"postman-task/internal/storage"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Reports whether leave can only be approved with a supporting document
+func (h *LeaveHandler) requiresAttachment(leave *core.LeaveRequest) bool {
+	if slices.Contains(h.attachments.RequiredTypes, leave.LeaveType) {
+		return true
+	}
+	days := int(leave.EndDate.Sub(leave.StartDate).Hours()/24) + 1
+	return h.attachments.RequiredAfterDays > 0 && days > h.attachments.RequiredAfterDays
+}
+
+// Finds the leave in the :id param if the user may see it: its student,
+// or staff
+func (h *LeaveHandler) findVisibleLeave(c *gin.Context, db *gorm.DB) (*core.LeaveRequest, bool) {
+	var leave core.LeaveRequest
+	if err := db.First(&leave, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Leave not found"})
+		return nil, false
+	}
+
+	role := c.GetString("user_role")
+	if leave.StudentID != c.MustGet("user_id").(uint) && role != "faculty" && role != "warden" && role != "admin" {
+		c.JSON(404, gin.H{"error": "Leave not found"})
+		return nil, false
+	}
+	return &leave, true
+}
+
+// Reports whether the user may open leave's documents: its student, the
+// approver it is assigned to or their delegate today, whoever decided it,
+// wardens and admins
+func canSeeDocuments(db *gorm.DB, leave *core.LeaveRequest, userID uint, role string) (bool, error) {
+	if leave.StudentID == userID || role == "warden" || role == "admin" {
+		return true, nil
+	}
+	if role != "faculty" {
+		return false, nil
+	}
+	if leave.ApprovedBy != nil && *leave.ApprovedBy == userID {
+		return true, nil
+	}
+	allowed, _, err := canDecide(db, leave, userID, role)
+	return allowed, err
+}
+
+// Finds the leave in the :id param if the user may see its documents.
+// Medical certificates and the like are not for every member of staff.
+func (h *LeaveHandler) findLeaveWithDocuments(c *gin.Context, db *gorm.DB) (*core.LeaveRequest, bool) {
+	leave, ok := h.findVisibleLeave(c, db)
+	if !ok {
+		return nil, false
+	}
+
+	allowed, err := canSeeDocuments(db, leave, c.MustGet("user_id").(uint), c.GetString("user_role"))
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch leave"})
+		return nil, false
+	}
+	if !allowed {
+		c.JSON(403, gin.H{"error": "Only the student, their approver and wardens can see this leave's documents"})
+		return nil, false
+	}
+	return leave, true
+}
+
+// Uploads a supporting document to a pending leave, by its student.
+// Expects multipart form data with a "file" field.
+func (h *LeaveHandler) UploadAttachment(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+	ctx := c.Request.Context()
+
+	userID := c.MustGet("user_id").(uint)
+
+	var leave core.LeaveRequest
+	if err := db.First(&leave, c.Param("id")).Error; err != nil || leave.StudentID != userID {
+		c.JSON(404, gin.H{"error": "Leave not found"})
+		return
+	}
+	if leave.Status != "pending" {
+		c.JSON(400, gin.H{"error": "Documents can only be added to pending requests"})
+		return
+	}
+
+	// Fail early before reading the upload, checked again when saving
+	var count int64
+	db.Model(&core.LeaveAttachment{}).Where("leave_id = ?", leave.ID).Count(&count)
+	if int(count) >= h.attachments.MaxPerLeave {
+		c.JSON(400, gin.H{"error": "Too many documents on this request"})
+		return
+	}
+
+	// Leave room for the multipart headers
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, h.attachments.MaxSize+64<<10)
+	header, err := c.FormFile("file")
+	if err != nil {
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			c.JSON(413, gin.H{"error": "File is too large"})
+			return
+		}
+		c.JSON(400, gin.H{"error": "Missing file"})
+		return
+	}
+	if header.Size > h.attachments.MaxSize {
+		c.JSON(413, gin.H{"error": "File is too large"})
+		return
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Could not read file"})
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, h.attachments.MaxSize+1))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Could not read file"})
+		return
+	}
+	if int64(len(data)) > h.attachments.MaxSize {
+		c.JSON(413, gin.H{"error": "File is too large"})
+		return
+	}
+
+	// Trust the content, not the name or the client's content type
+	contentType := http.DetectContentType(data)
+	if !slices.Contains(h.attachments.AllowedTypes, contentType) {
+		c.JSON(415, gin.H{"error": "File type " + contentType + " is not allowed"})
+		return
+	}
+
+	if err := h.scanner.Scan(ctx, bytes.NewReader(data)); err != nil {
+		if errors.Is(err, storage.ErrInfected) {
+			log.Printf("Rejected upload for leave %d by user %d: %v", leave.ID, userID, err)
+			c.JSON(422, gin.H{"error": "File failed the virus scan"})
+			return
+		}
+		log.Printf("Virus scan failed: %v", err)
+		c.JSON(503, gin.H{"error": "Could not scan file, try again later"})
+		return
+	}
+
+	// Random keys, the user's file name is only kept in the database
+	_, random, err := auth.NewOpaqueToken()
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Server error"})
+		return
+	}
+	key := "leaves/" + strconv.FormatUint(uint64(leave.ID), 10) + "/" + random[:32]
+	if err := h.store.Put(ctx, key, bytes.NewReader(data), int64(len(data)), contentType); err != nil {
+		log.Printf("Failed to store attachment: %v", err)
+		c.JSON(500, gin.H{"error": "Could not save file"})
+		return
+	}
+
+	sum := sha256.Sum256(data)
+	attachment := core.LeaveAttachment{
+		LeaveID:     leave.ID,
+		UploadedBy:  userID,
+		FileName:    filepath.Base(header.Filename),
+		ContentType: contentType,
+		Size:        int64(len(data)),
+		SHA256:      hex.EncodeToString(sum[:]),
+		StorageKey:  key,
+	}
+
+	// Count under the leave's row lock, so parallel uploads can't pass the
+	// limit and a leave decided meanwhile gets nothing new
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&leave, leave.ID).Error; err != nil {
+			return err
+		}
+		if leave.Status != "pending" {
+			return &actionError{400, gin.H{"error": "Documents can only be added to pending requests"}}
+		}
+		var count int64
+		if err := tx.Model(&core.LeaveAttachment{}).Where("leave_id = ?", leave.ID).Count(&count).Error; err != nil {
+			return err
+		}
+		if int(count) >= h.attachments.MaxPerLeave {
+			return &actionError{400, gin.H{"error": "Too many documents on this request"}}
+		}
+		return tx.Create(&attachment).Error
+	})
+	if err != nil {
+		if err := h.store.Delete(ctx, key); err != nil {
+			log.Printf("Failed to delete stored attachment %s: %v", key, err)
+		}
+		var failed *actionError
+		if errors.As(err, &failed) {
+			c.JSON(failed.code, failed.body)
+			return
+		}
+		c.JSON(500, gin.H{"error": "Could not save file"})
+		return
+	}
+
+	c.JSON(200, attachment)
+}
+
+// Lists the documents of a leave
+func (h *LeaveHandler) GetAttachments(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	leave, ok := h.findLeaveWithDocuments(c, db)
+	if !ok {
+		return
+	}
+
+	var attachments []core.LeaveAttachment
+	db.Where("leave_id = ?", leave.ID).Order("created_at").Find(&attachments)
+
+	c.JSON(200, gin.H{
+		"items":    attachments,
+		"required": h.requiresAttachment(leave),
+	})
+}
+
+// Downloads a document, checking access on every request
+func (h *LeaveHandler) DownloadAttachment(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	leave, ok := h.findLeaveWithDocuments(c, db)
+	if !ok {
+		return
+	}
+
+	var attachment core.LeaveAttachment
+	err := db.Where("leave_id = ?", leave.ID).First(&attachment, c.Param("attachment_id")).Error
+	if err != nil {
+		c.JSON(404, gin.H{"error": "Attachment not found"})
+		return
+	}
+
+	file, err := h.store.Get(c.Request.Context(), attachment.StorageKey)
+	if err != nil {
+		log.Printf("Failed to open attachment %d: %v", attachment.ID, err)
+		c.JSON(404, gin.H{"error": "Attachment not found"})
+		return
+	}
+	defer file.Close()
+
+	// Always download, never render uploaded content in the browser
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.DataFromReader(200, attachment.Size, attachment.ContentType, file, map[string]string{
+		"Content-Disposition": mime.FormatMediaType("attachment", map[string]string{"filename": attachment.FileName}),
+		"Cache-Control":       "private, no-store",
+	})
+}
+
+// Removes a document from a pending leave, by its student
+func (h *LeaveHandler) DeleteAttachment(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	var leave core.LeaveRequest
+	err := db.First(&leave, c.Param("id")).Error
+	if err != nil || leave.StudentID != c.MustGet("user_id").(uint) {
+		c.JSON(404, gin.H{"error": "Leave not found"})
+		return
+	}
+	if leave.Status != "pending" {
+		c.JSON(400, gin.H{"error": "Documents can only be removed from pending requests"})
+		return
+	}
+
+	var attachment core.LeaveAttachment
+	err = db.Where("leave_id = ?", leave.ID).First(&attachment, c.Param("attachment_id")).Error
+	if err != nil {
+		c.JSON(404, gin.H{"error": "Attachment not found"})
+		return
+	}
+
+	if err := db.Delete(&attachment).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Could not delete attachment"})
+		return
+	}
+	if err := h.store.Delete(c.Request.Context(), attachment.StorageKey); err != nil {
+		log.Printf("Failed to delete stored attachment %s: %v", attachment.StorageKey, err)
+	}
+
+	c.JSON(200, gin.H{"message": "Attachment deleted"})
+}
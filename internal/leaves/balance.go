@@ -0,0 +1,105 @@
+package leaves
+
+import (
+	"math"
+	"strconv"
+	"time"
+
+	"postman-task/internal/core"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Checks the student has enough balance left for leave, counting
+// requests in the given statuses as already taken. A leave over New Year
+// takes each year's part from that year. Returns the days left before
+// this leave, in the year that runs short or else the tightest one, or -1
+// when the type has no limit.
+func (h *LeaveHandler) checkBalance(db *gorm.DB, leave *core.LeaveRequest, statuses ...string) (float64, bool, error) {
+	days, limited := h.allowance(leave.LeaveType)
+	if !limited {
+		return -1, true, nil
+	}
+
+	first, last := leave.StartDate.UTC().Year(), leave.EndDate.UTC().Year()
+	var dept string
+	if first != last {
+		err := db.Model(&core.User{}).Select("dept").Where("id = ?", leave.StudentID).Scan(&dept).Error
+		if err != nil {
+			return 0, false, err
+		}
+	}
+
+	tightest := days
+	for year := first; year <= last; year++ {
+		used, err := h.usedHours(db, leave.StudentID, leave.LeaveType, year, statuses...)
+		if err != nil {
+			return 0, false, err
+		}
+		part := leave.Hours
+		if first != last {
+			from, to := yearBounds(year)
+			if part, err = h.workingHoursBetween(db, dept, leave, from, to); err != nil {
+				return 0, false, err
+			}
+		}
+		left := days - used/h.dayHours()
+		if part/h.dayHours() > left+1e-9 {
+			return left, false, nil
+		}
+		tightest = min(tightest, left)
+	}
+	return tightest, true, nil
+}
+
+// Shows the current user's leave balance by type for ?year=, this year
+// by default. Half a working day counts as 0.5 days.
+func (h *LeaveHandler) GetLeaveBalance(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	userID := c.MustGet("user_id").(uint)
+
+	year := time.Now().Year()
+	if y := c.Query("year"); y != "" {
+		n, err := strconv.Atoi(y)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "Invalid year"})
+			return
+		}
+		year = n
+	}
+
+	round := func(v float64) float64 { return math.Round(v*100) / 100 }
+
+	balances := []gin.H{}
+	for _, leaveType := range []string{"Medical", "Personal", "Academic", "Emergency"} {
+		approved, err := h.usedHours(db, userID, leaveType, year, "approved")
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Could not load balance"})
+			return
+		}
+		pending, err := h.usedHours(db, userID, leaveType, year, "pending")
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Could not load balance"})
+			return
+		}
+
+		balance := gin.H{
+			"leave_type":   leaveType,
+			"used_days":    round(approved / h.dayHours()),
+			"pending_days": round(pending / h.dayHours()),
+		}
+		if days, ok := h.allowance(leaveType); ok {
+			balance["allowance_days"] = days
+			balance["remaining_days"] = round(days - approved/h.dayHours())
+		}
+		balances = append(balances, balance)
+	}
+
+	c.JSON(200, gin.H{
+		"year":      year,
+		"day_hours": h.dayHours(),
+		"balances":  balances,
+	})
+}
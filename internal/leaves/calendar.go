@@ -0,0 +1,105 @@
+package leaves
+
+import (
+	"time"
+
+	"postman-task/internal/core"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Replaces the calendar kind check, which predates terms
+func MigrateCalendar(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("ALTER TABLE calendar_events DROP CONSTRAINT IF EXISTS chk_calendar_events_kind").Error; err != nil {
+			return err
+		}
+		return tx.Exec("ALTER TABLE calendar_events ADD CONSTRAINT chk_calendar_events_kind CHECK (kind IN ('exam','holiday','term'))").Error
+	})
+}
+
+// Adds an exam period or holiday to the academic calendar
+func (h *LeaveHandler) CreateCalendarEvent(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	var data core.CalendarEventRequest
+	if err := c.ShouldBindJSON(&data); err != nil {
+		c.JSON(400, gin.H{"error": "Bad request"})
+		return
+	}
+
+	start, err1 := time.Parse("2006-01-02", data.StartDate)
+	end, err2 := time.Parse("2006-01-02", data.EndDate)
+	if err1 != nil || err2 != nil {
+		c.JSON(400, gin.H{"error": "Invalid date format. Use YYYY-MM-DD"})
+		return
+	}
+	if end.Before(start) {
+		c.JSON(400, gin.H{"error": "End date must not be before start date"})
+		return
+	}
+
+	event := core.CalendarEvent{
+		Title:     data.Title,
+		Kind:      data.Kind,
+		Dept:      data.Dept,
+		StartDate: start,
+		EndDate:   end,
+		CreatedBy: c.MustGet("user_id").(uint),
+	}
+	if err := db.Create(&event).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Could not save calendar event"})
+		return
+	}
+
+	c.JSON(200, event)
+}
+
+// Lists calendar events, optionally filtered with ?from=, ?to= and ?dept=
+func (h *LeaveHandler) GetCalendar(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	query := db.Model(&core.CalendarEvent{})
+	if from := c.Query("from"); from != "" {
+		day, err := time.Parse("2006-01-02", from)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "Invalid date format. Use YYYY-MM-DD"})
+			return
+		}
+		query = query.Where("end_date >= ?", day)
+	}
+	if to := c.Query("to"); to != "" {
+		day, err := time.Parse("2006-01-02", to)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "Invalid date format. Use YYYY-MM-DD"})
+			return
+		}
+		query = query.Where("start_date <= ?", day)
+	}
+	if dept := c.Query("dept"); dept != "" {
+		query = query.Where("dept = '' OR dept = ?", dept)
+	}
+
+	var events []core.CalendarEvent
+	query.Order("start_date").Find(&events)
+
+	c.JSON(200, events)
+}
+
+// Removes an event from the calendar
+func (h *LeaveHandler) DeleteCalendarEvent(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	result := db.Delete(&core.CalendarEvent{}, c.Param("id"))
+	if result.Error != nil {
+		c.JSON(500, gin.H{"error": "Could not delete calendar event"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(404, gin.H{"error": "Calendar event not found"})
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "Calendar event deleted"})
+}
@@ -0,0 +1,170 @@
+package leaves
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"postman-task/internal/core"
+	"postman-task/pkg/config"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/gorm"
+)
+
+// Name of the exclusion constraint that stops a student's pending and
+// approved leaves from overlapping in time
+const overlapConstraint = "leave_requests_no_time_overlap"
+
+// A record that clashes with a leave being applied for
+type conflict struct {
+	Kind      string    `json:"kind"` // "leave" or "exam"
+	ID        uint      `json:"id"`
+	Title     string    `json:"title"`
+	Status    string    `json:"status,omitempty"`
+	Portion   string    `json:"portion,omitempty"`
+	StartDate time.Time `json:"start_date"`
+	EndDate   time.Time `json:"end_date"`
+}
+
+// Fills in the span and working hours of older leaves
+func Migrate(db *gorm.DB, rules config.LeaveConfig) error {
+	h := &LeaveHandler{db: db, rules: rules}
+
+	err := db.Exec(`UPDATE leave_requests SET starts_at = start_date, ends_at = end_date + interval '1 day'
+		WHERE starts_at IS NULL OR starts_at < start_date`).Error
+	if err != nil {
+		return err
+	}
+
+	var old []core.LeaveRequest
+	db.Unscoped().Preload("Student").Where("hours = 0").Find(&old)
+	for _, leave := range old {
+		hours, err := h.workingHours(db, leave.Student.Dept, &leave)
+		if err != nil {
+			return err
+		}
+		db.Unscoped().Model(&leave).Update("hours", hours)
+	}
+	return nil
+}
+
+// Dates decisions made before decided_at existed by their last update, for
+// turnaround analytics
+func MigrateDecidedAt(db *gorm.DB) error {
+	return db.Exec(`UPDATE leave_requests SET decided_at = updated_at
+		WHERE decided_at IS NULL AND status <> 'pending'`).Error
+}
+
+// Pending or approved leaves of one student that overlap, left from before
+// the constraint. Postgres can't add the constraint until they're resolved.
+type OverlapError struct {
+	Pairs [][2]uint // leave IDs
+}
+
+func (e *OverlapError) Error() string {
+	pairs := make([]string, len(e.Pairs))
+	for i, p := range e.Pairs {
+		pairs[i] = fmt.Sprintf("%d and %d", p[0], p[1])
+	}
+	return fmt.Sprintf("%d pairs of leaves overlap (%s); reject or delete one of each pair", len(e.Pairs), strings.Join(pairs, ", "))
+}
+
+// Creates the overlap constraint if it is missing. Existing overlaps are
+// reported as an *OverlapError instead of a bare constraint failure.
+func MigrateOverlap(db *gorm.DB) error {
+	if err := db.Exec("CREATE EXTENSION IF NOT EXISTS btree_gist").Error; err != nil {
+		return err
+	}
+
+	// Replaced by the time based constraint
+	if err := db.Exec("ALTER TABLE leave_requests DROP CONSTRAINT IF EXISTS leave_requests_no_overlap").Error; err != nil {
+		return err
+	}
+
+	var exists int64
+	db.Raw("SELECT COUNT(*) FROM pg_constraint WHERE conname = ?", overlapConstraint).Scan(&exists)
+	if exists > 0 {
+		return nil
+	}
+
+	var pairs []struct{ A, B uint }
+	err := db.Raw(`SELECT a.id AS a, b.id AS b FROM leave_requests a
+		JOIN leave_requests b ON b.student_id = a.student_id AND b.id > a.id
+			AND tstzrange(b.starts_at, b.ends_at) && tstzrange(a.starts_at, a.ends_at)
+		WHERE a.status IN ('pending', 'approved') AND a.deleted_at IS NULL
+			AND b.status IN ('pending', 'approved') AND b.deleted_at IS NULL
+		ORDER BY a.id, b.id`).Scan(&pairs).Error
+	if err != nil {
+		return err
+	}
+	if len(pairs) > 0 {
+		overlap := &OverlapError{}
+		for _, p := range pairs {
+			overlap.Pairs = append(overlap.Pairs, [2]uint{p.A, p.B})
+		}
+		return overlap
+	}
+
+	return db.Exec(`ALTER TABLE leave_requests ADD CONSTRAINT ` + overlapConstraint + `
+		EXCLUDE USING gist (student_id WITH =, tstzrange(starts_at, ends_at) WITH &&)
+		WHERE (status IN ('pending', 'approved') AND deleted_at IS NULL)`).Error
+}
+
+// Reports whether err comes from the overlap constraint
+func isOverlapViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23P01" && pgErr.ConstraintName == overlapConstraint
+}
+
+// Finds the student's pending and approved leaves that overlap leave, and
+// the exams of their department on its days. Exams are skipped for exempt
+// types.
+func (h *LeaveHandler) findConflicts(db *gorm.DB, student *core.User, leave *core.LeaveRequest) ([]conflict, error) {
+	var leaves []core.LeaveRequest
+	err := db.Where("student_id = ? AND status IN ? AND starts_at < ? AND ends_at > ?",
+		student.ID, []string{"pending", "approved"}, leave.EndsAt, leave.StartsAt).
+		Order("start_date").
+		Find(&leaves).Error
+	if err != nil {
+		return nil, err
+	}
+
+	conflicts := []conflict{}
+	for _, l := range leaves {
+		conflicts = append(conflicts, conflict{
+			Kind:      "leave",
+			ID:        l.ID,
+			Title:     l.LeaveType + " leave",
+			Status:    l.Status,
+			Portion:   l.Portion,
+			StartDate: l.StartDate,
+			EndDate:   l.EndDate,
+		})
+	}
+
+	if slices.Contains(h.rules.ExamExemptTypes, leave.LeaveType) {
+		return conflicts, nil
+	}
+
+	var exams []core.CalendarEvent
+	err = db.Where("kind = 'exam' AND (dept = '' OR dept = ?) AND start_date <= ? AND end_date >= ?",
+		student.Dept, leave.EndDate, leave.StartDate).
+		Order("start_date").
+		Find(&exams).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range exams {
+		conflicts = append(conflicts, conflict{
+			Kind:      "exam",
+			ID:        e.ID,
+			Title:     e.Title,
+			StartDate: e.StartDate,
+			EndDate:   e.EndDate,
+		})
+	}
+	return conflicts, nil
+}
@@ -0,0 +1,213 @@
+package leaves
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"postman-task/internal/core"
+	email "postman-task/internal/notifications"
+	"postman-task/internal/tracing"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Hands pending requests that used to be assigned to the advisor's
+// delegate back to the advisor, so they don't outlive the delegation
+func MigrateDelegations(db *gorm.DB) error {
+	return db.Exec(`UPDATE leave_requests l SET assigned_to = u.advisor_id FROM users u
+		WHERE u.id = l.student_id AND l.status = 'pending' AND l.assigned_to <> u.advisor_id
+		AND EXISTS (SELECT 1 FROM delegations d WHERE d.delegator_id = u.advisor_id AND d.delegate_id = l.assigned_to)`).Error
+}
+
+// Today's date, as leave dates are stored
+func today() time.Time {
+	y, m, d := time.Now().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// Finds the delegation delegatorID has in force on day, if any
+func activeDelegation(db *gorm.DB, delegatorID uint, day time.Time) (*core.Delegation, error) {
+	var d core.Delegation
+	err := db.Where("delegator_id = ? AND revoked_at IS NULL AND start_date <= ? AND end_date >= ?",
+		delegatorID, day, day).
+		Order("created_at DESC").
+		First(&d).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// Users whose requests approverID may decide today through a delegation
+func delegatorsOf(db *gorm.DB, approverID interface{}) *gorm.DB {
+	day := today()
+	return db.Model(&core.Delegation{}).
+		Select("delegator_id").
+		Where("delegate_id = ? AND revoked_at IS NULL AND start_date <= ? AND end_date >= ?", approverID, day, day)
+}
+
+// Checks approverID may decide leave: its assignee, or whoever holds the
+// assignee's delegation today. Returns the delegator when a delegate
+// decides. Wardens and admins may decide any request, and are the only
+// ones who can decide requests of students without an advisor.
+func canDecide(db *gorm.DB, leave *core.LeaveRequest, approverID uint, role string) (bool, *uint, error) {
+	if role == "warden" || role == "admin" {
+		return true, nil, nil
+	}
+	if leave.AssignedTo == nil {
+		return false, nil, nil
+	}
+	if *leave.AssignedTo == approverID {
+		return true, nil, nil
+	}
+
+	d, err := activeDelegation(db, *leave.AssignedTo, today())
+	if err != nil {
+		return false, nil, err
+	}
+	if d != nil && d.DelegateID == approverID {
+		return true, leave.AssignedTo, nil
+	}
+	return false, nil, nil
+}
+
+// Emails the colleague covering for leave's advisor today that a request
+// is waiting for them. The request stays assigned to the advisor.
+func notifyDelegate(ctx context.Context, db *gorm.DB, leave *core.LeaveRequest, student *core.User) {
+	if leave.AssignedTo == nil {
+		return
+	}
+	d, err := activeDelegation(db, *leave.AssignedTo, today())
+	if err != nil || d == nil {
+		if err != nil {
+			log.Printf("Failed to look up delegation for leave %d: %v", leave.ID, err)
+		}
+		return
+	}
+	var delegate core.User
+	if err := db.Select("name", "email").First(&delegate, d.DelegateID).Error; err != nil {
+		log.Printf("Failed to load delegate %d for leave %d: %v", d.DelegateID, leave.ID, err)
+		return
+	}
+
+	subject := fmt.Sprintf("Leave Request #%d waiting for you", leave.ID)
+	body := "Hi " + delegate.Name + ",\n\n" +
+		student.Name + " has applied for " + leave.LeaveType + " leave. You can decide the request while you cover for their advisor, until " +
+		d.EndDate.Format("2 Jan 2006") + ".\n\n" +
+		"Regards,\nFaculty"
+
+	ctx = tracing.Detach(ctx)
+	go func() {
+		if err := email.SendContext(ctx, delegate.Email, subject, body); err != nil {
+			log.Printf("Failed to send delegate email for leave %d: %v", leave.ID, err)
+		}
+	}()
+}
+
+// Hands the current user's approval rights to a colleague for a date range
+func (h *LeaveHandler) CreateDelegation(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	userID := c.MustGet("user_id").(uint)
+
+	var data core.DelegationRequest
+	if err := c.ShouldBindJSON(&data); err != nil {
+		c.JSON(400, gin.H{"error": "Bad request"})
+		return
+	}
+
+	start, err1 := time.Parse("2006-01-02", data.StartDate)
+	end, err2 := time.Parse("2006-01-02", data.EndDate)
+	if err1 != nil || err2 != nil {
+		c.JSON(400, gin.H{"error": "Invalid date format. Use YYYY-MM-DD"})
+		return
+	}
+	if end.Before(start) || end.Before(today()) {
+		c.JSON(400, gin.H{"error": "End date must be after start date and not in the past"})
+		return
+	}
+
+	if data.DelegateID == userID {
+		c.JSON(400, gin.H{"error": "Cannot delegate to yourself"})
+		return
+	}
+	var delegate core.User
+	err := db.Where("role IN ? AND deactivated_at IS NULL", []string{"faculty", "warden"}).
+		First(&delegate, data.DelegateID).Error
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Delegate must be an active faculty member or warden"})
+		return
+	}
+
+	// One delegate at a time
+	var overlapping int64
+	db.Model(&core.Delegation{}).
+		Where("delegator_id = ? AND revoked_at IS NULL AND start_date <= ? AND end_date >= ?", userID, end, start).
+		Count(&overlapping)
+	if overlapping > 0 {
+		c.JSON(409, gin.H{"error": "You already have a delegation in this period"})
+		return
+	}
+
+	delegation := core.Delegation{
+		DelegatorID: userID,
+		DelegateID:  delegate.ID,
+		StartDate:   start,
+		EndDate:     end,
+		Reason:      data.Reason,
+	}
+	if err := db.Create(&delegation).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Could not save delegation"})
+		return
+	}
+
+	c.JSON(200, delegation)
+}
+
+// Lists delegations the current user gave or received
+func (h *LeaveHandler) GetMyDelegations(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	userID := c.MustGet("user_id")
+
+	var given, received []core.Delegation
+	db.Where("delegator_id = ?", userID).Order("start_date DESC").Find(&given)
+	db.Where("delegate_id = ?", userID).Order("start_date DESC").Find(&received)
+
+	c.JSON(200, gin.H{
+		"given":    given,
+		"received": received,
+	})
+}
+
+// Revokes a delegation, by its delegator or an admin
+func (h *LeaveHandler) RevokeDelegation(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	var delegation core.Delegation
+	if err := db.First(&delegation, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Delegation not found"})
+		return
+	}
+	if delegation.DelegatorID != c.MustGet("user_id").(uint) && c.GetString("user_role") != "admin" {
+		c.JSON(403, gin.H{"error": "Access denied"})
+		return
+	}
+	if delegation.RevokedAt != nil {
+		c.JSON(400, gin.H{"error": "Delegation already revoked"})
+		return
+	}
+
+	if err := db.Model(&delegation).Update("revoked_at", time.Now()).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Could not revoke delegation"})
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "Delegation revoked"})
+}
@@ -0,0 +1,171 @@
+package leaves
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"postman-task/internal/core"
+
+	"gorm.io/gorm"
+)
+
+// Works out the exact span of a leave. Full leaves cover whole days,
+// the other portions a part of a single day.
+func (h *LeaveHandler) leaveSpan(start, end time.Time, portion, startTime, endTime string) (time.Time, time.Time, error) {
+	if portion == "full" {
+		return start, end.AddDate(0, 0, 1), nil
+	}
+	if !end.Equal(start) {
+		return time.Time{}, time.Time{}, errors.New("Half-day and hourly leaves must start and end on the same day")
+	}
+
+	switch portion {
+	case "first_half":
+		return start.Add(h.rules.DayStart), start.Add(h.rules.Midday), nil
+	case "second_half":
+		return start.Add(h.rules.Midday), start.Add(h.rules.DayEnd), nil
+	}
+
+	from, err1 := time.Parse("15:04", startTime)
+	to, err2 := time.Parse("15:04", endTime)
+	if err1 != nil || err2 != nil {
+		return time.Time{}, time.Time{}, errors.New("Invalid time format. Use HH:MM")
+	}
+	if !to.After(from) {
+		return time.Time{}, time.Time{}, errors.New("End time must be after start time")
+	}
+	midnight := time.Date(0, 1, 1, 0, 0, 0, 0, time.UTC)
+	return start.Add(from.Sub(midnight)), start.Add(to.Sub(midnight)), nil
+}
+
+// Length of the overlap of [from, to) with the working hours of day
+func (h *LeaveHandler) workingOverlap(day, from, to time.Time) time.Duration {
+	open, close := day.Add(h.rules.DayStart), day.Add(h.rules.DayEnd)
+	if from.Before(open) {
+		from = open
+	}
+	if to.After(close) {
+		to = close
+	}
+	if !to.After(from) {
+		return 0
+	}
+	return to.Sub(from)
+}
+
+// Counts the working hours of a leave, skipping weekends and holidays in
+// the calendar for the student's department
+func (h *LeaveHandler) workingHours(db *gorm.DB, dept string, leave *core.LeaveRequest) (float64, error) {
+	return h.workingHoursBetween(db, dept, leave, leave.StartDate, leave.EndDate)
+}
+
+// Counts the working hours of a leave on the days from from to to,
+// inclusive
+func (h *LeaveHandler) workingHoursBetween(db *gorm.DB, dept string, leave *core.LeaveRequest, from, to time.Time) (float64, error) {
+	var holidays []core.CalendarEvent
+	err := db.Where("kind = 'holiday' AND (dept = '' OR dept = ?) AND start_date <= ? AND end_date >= ?",
+		dept, leave.EndDate, leave.StartDate).
+		Find(&holidays).Error
+	if err != nil {
+		return 0, err
+	}
+	return h.countWorkingHours(leave, from, to, holidays), nil
+}
+
+// Adds up the working hours of leave on the days from from to to that are
+// neither weekends nor in holidays. Days are taken in UTC, as they are
+// stored, whatever zone the database hands them back in.
+func (h *LeaveHandler) countWorkingHours(leave *core.LeaveRequest, from, to time.Time, holidays []core.CalendarEvent) float64 {
+	from, to = from.UTC(), to.UTC()
+	if from.Before(leave.StartDate) {
+		from = leave.StartDate.UTC()
+	}
+	if to.After(leave.EndDate) {
+		to = leave.EndDate.UTC()
+	}
+
+	var total time.Duration
+	for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+		if d.Weekday() == time.Saturday || d.Weekday() == time.Sunday {
+			continue
+		}
+		holiday := false
+		for _, e := range holidays {
+			if !d.Before(e.StartDate) && !d.After(e.EndDate) {
+				holiday = true
+				break
+			}
+		}
+		if !holiday {
+			total += h.workingOverlap(d, leave.StartsAt, leave.EndsAt)
+		}
+	}
+	return total.Hours()
+}
+
+// The attendance session a leave takes on day, "" if it misses the
+// working day
+func (h *LeaveHandler) sessionOn(leave *core.LeaveRequest, day time.Time) string {
+	morning := leave.StartsAt.Before(day.Add(h.rules.Midday)) && leave.EndsAt.After(day.Add(h.rules.DayStart))
+	afternoon := leave.StartsAt.Before(day.Add(h.rules.DayEnd)) && leave.EndsAt.After(day.Add(h.rules.Midday))
+	switch {
+	case morning && afternoon:
+		return "full"
+	case morning:
+		return "first_half"
+	case afternoon:
+		return "second_half"
+	}
+	return ""
+}
+
+// Working hours in a day
+func (h *LeaveHandler) dayHours() float64 {
+	return (h.rules.DayEnd - h.rules.DayStart).Hours()
+}
+
+// Days of leaveType a student may take per year, ok is false without a limit
+func (h *LeaveHandler) allowance(leaveType string) (float64, bool) {
+	days, ok := h.rules.Allowances[strings.ToLower(leaveType)]
+	return days, ok
+}
+
+// The first and last day of year
+func yearBounds(year int) (time.Time, time.Time) {
+	from := time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC)
+	return from, from.AddDate(1, 0, -1)
+}
+
+// Sums the hours of a student's leaves of one type that fall in year. A
+// leave over New Year counts only its working hours in year.
+func (h *LeaveHandler) usedHours(db *gorm.DB, studentID uint, leaveType string, year int, statuses ...string) (float64, error) {
+	from, to := yearBounds(year)
+	var hours float64
+	err := db.Model(&core.LeaveRequest{}).
+		Select("COALESCE(SUM(hours), 0)").
+		Where("student_id = ? AND leave_type = ? AND status IN ? AND start_date >= ? AND end_date <= ?",
+			studentID, leaveType, statuses, from, to).
+		Scan(&hours).Error
+	if err != nil {
+		return 0, err
+	}
+
+	var across []core.LeaveRequest
+	err = db.Preload("Student").
+		Where("student_id = ? AND leave_type = ? AND status IN ? AND start_date <= ? AND end_date >= ?",
+			studentID, leaveType, statuses, to, from).
+		Where("(start_date < ? OR end_date > ?)", from, to).
+		Find(&across).Error
+	if err != nil {
+		return 0, err
+	}
+	for _, leave := range across {
+		part, err := h.workingHoursBetween(db, leave.Student.Dept, &leave, from, to)
+		if err != nil {
+			return 0, err
+		}
+		hours += part
+	}
+	return hours, nil
+}
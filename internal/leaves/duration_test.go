@@ -0,0 +1,151 @@
+package leaves
+
+import (
+	"testing"
+	"time"
+
+	"postman-task/internal/core"
+	"postman-task/pkg/config"
+)
+
+func durationHandler() *LeaveHandler {
+	return &LeaveHandler{rules: config.LeaveConfig{DayStart: 9 * time.Hour, Midday: 13 * time.Hour, DayEnd: 17 * time.Hour}}
+}
+
+// A day in 2025 as leave dates are stored, midnight UTC. May the 5th is a
+// Monday.
+func date(month time.Month, day int) time.Time {
+	return time.Date(2025, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+// Builds a leave the way ApplyLeave does
+func testLeave(t *testing.T, h *LeaveHandler, start, end time.Time, portion, from, to string) *core.LeaveRequest {
+	t.Helper()
+	startsAt, endsAt, err := h.leaveSpan(start, end, portion, from, to)
+	if err != nil {
+		t.Fatalf("leaveSpan: %v", err)
+	}
+	return &core.LeaveRequest{StartDate: start, EndDate: end, Portion: portion, StartsAt: startsAt, EndsAt: endsAt}
+}
+
+func TestLeaveSpan(t *testing.T) {
+	monday := date(time.May, 5)
+	tests := []struct {
+		name       string
+		end        time.Time
+		portion    string
+		from, to   string
+		wantStart  time.Time
+		wantEnd    time.Time
+		wantErrMsg string
+	}{
+		{"full day", monday, "full", "", "", monday, monday.AddDate(0, 0, 1), ""},
+		{"full days", date(time.May, 7), "full", "", "", monday, date(time.May, 8), ""},
+		{"first half", monday, "first_half", "", "", monday.Add(9 * time.Hour), monday.Add(13 * time.Hour), ""},
+		{"second half", monday, "second_half", "", "", monday.Add(13 * time.Hour), monday.Add(17 * time.Hour), ""},
+		{"hours", monday, "hours", "10:00", "12:30", monday.Add(10 * time.Hour), monday.Add(12*time.Hour + 30*time.Minute), ""},
+		{"half day over two days", date(time.May, 6), "first_half", "", "", time.Time{}, time.Time{},
+			"Half-day and hourly leaves must start and end on the same day"},
+		{"bad time", monday, "hours", "10", "12:00", time.Time{}, time.Time{}, "Invalid time format. Use HH:MM"},
+		{"end before start", monday, "hours", "12:00", "10:00", time.Time{}, time.Time{}, "End time must be after start time"},
+		{"no time at all", monday, "hours", "10:00", "10:00", time.Time{}, time.Time{}, "End time must be after start time"},
+	}
+	h := durationHandler()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end, err := h.leaveSpan(monday, tt.end, tt.portion, tt.from, tt.to)
+			if tt.wantErrMsg != "" {
+				if err == nil || err.Error() != tt.wantErrMsg {
+					t.Fatalf("error %v, want %q", err, tt.wantErrMsg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !start.Equal(tt.wantStart) || !end.Equal(tt.wantEnd) {
+				t.Fatalf("span %s to %s, want %s to %s", start, end, tt.wantStart, tt.wantEnd)
+			}
+		})
+	}
+}
+
+func TestWorkingHours(t *testing.T) {
+	h := durationHandler()
+	wednesday := []core.CalendarEvent{{Kind: "holiday", StartDate: date(time.May, 7), EndDate: date(time.May, 7)}}
+	pst := time.FixedZone("PST", -8*3600)
+
+	tests := []struct {
+		name     string
+		leave    *core.LeaveRequest
+		from, to time.Time // zero for the whole leave
+		holidays []core.CalendarEvent
+		want     float64
+	}{
+		{"one day", testLeave(t, h, date(time.May, 5), date(time.May, 5), "full", "", ""), time.Time{}, time.Time{}, nil, 8},
+		{"whole week", testLeave(t, h, date(time.May, 5), date(time.May, 11), "full", "", ""), time.Time{}, time.Time{}, nil, 40},
+		{"over a weekend", testLeave(t, h, date(time.May, 9), date(time.May, 12), "full", "", ""), time.Time{}, time.Time{}, nil, 16},
+		{"weekend only", testLeave(t, h, date(time.May, 10), date(time.May, 11), "full", "", ""), time.Time{}, time.Time{}, nil, 0},
+		{"holiday", testLeave(t, h, date(time.May, 5), date(time.May, 9), "full", "", ""), time.Time{}, time.Time{}, wednesday, 32},
+		{"first half", testLeave(t, h, date(time.May, 5), date(time.May, 5), "first_half", "", ""), time.Time{}, time.Time{}, nil, 4},
+		{"hours", testLeave(t, h, date(time.May, 5), date(time.May, 5), "hours", "10:00", "11:30"), time.Time{}, time.Time{}, nil, 1.5},
+		{"hours before the day", testLeave(t, h, date(time.May, 5), date(time.May, 5), "hours", "07:00", "10:00"), time.Time{}, time.Time{}, nil, 1},
+		{"hours after the day", testLeave(t, h, date(time.May, 5), date(time.May, 5), "hours", "17:00", "19:00"), time.Time{}, time.Time{}, nil, 0},
+		{"part of a leave", testLeave(t, h, date(time.May, 5), date(time.May, 9), "full", "", ""), date(time.May, 7), date(time.May, 8), nil, 16},
+		{"old year of a leave over New Year",
+			testLeave(t, h, date(time.December, 29), date(time.December, 29).AddDate(0, 0, 4), "full", "", ""),
+			date(time.January, 1), date(time.December, 31), nil, 24},
+		{"new year of a leave over New Year",
+			testLeave(t, h, date(time.December, 29), date(time.December, 29).AddDate(0, 0, 4), "full", "", ""),
+			time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, 12, 31, 0, 0, 0, 0, time.UTC), nil, 16},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from, to := tt.from, tt.to
+			if from.IsZero() {
+				from, to = tt.leave.StartDate, tt.leave.EndDate
+			}
+			if got := h.countWorkingHours(tt.leave, from, to, tt.holidays); got != tt.want {
+				t.Fatalf("got %v hours, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Dates read back from postgres are in the local zone
+	t.Run("local zone", func(t *testing.T) {
+		leave := testLeave(t, h, date(time.May, 5), date(time.May, 9), "full", "", "")
+		leave.StartDate, leave.EndDate = leave.StartDate.In(pst), leave.EndDate.In(pst)
+		if got := h.countWorkingHours(leave, leave.StartDate, leave.EndDate, nil); got != 40 {
+			t.Fatalf("got %v hours, want 40", got)
+		}
+	})
+}
+
+func TestSessionOn(t *testing.T) {
+	h := durationHandler()
+	monday := date(time.May, 5)
+	tests := []struct {
+		name  string
+		leave *core.LeaveRequest
+		day   time.Time
+		want  string
+	}{
+		{"full day", testLeave(t, h, monday, monday, "full", "", ""), monday, "full"},
+		{"middle of a long leave", testLeave(t, h, monday, date(time.May, 9), "full", "", ""), date(time.May, 7), "full"},
+		{"first half", testLeave(t, h, monday, monday, "first_half", "", ""), monday, "first_half"},
+		{"second half", testLeave(t, h, monday, monday, "second_half", "", ""), monday, "second_half"},
+		{"morning hours", testLeave(t, h, monday, monday, "hours", "10:00", "12:00"), monday, "first_half"},
+		{"afternoon hours", testLeave(t, h, monday, monday, "hours", "14:00", "15:00"), monday, "second_half"},
+		{"hours over midday", testLeave(t, h, monday, monday, "hours", "12:00", "14:00"), monday, "full"},
+		{"hours before the day", testLeave(t, h, monday, monday, "hours", "07:00", "09:00"), monday, ""},
+		{"hours after the day", testLeave(t, h, monday, monday, "hours", "17:00", "18:00"), monday, ""},
+		{"another day", testLeave(t, h, monday, monday, "full", "", ""), date(time.May, 6), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := h.sessionOn(tt.leave, tt.day); got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
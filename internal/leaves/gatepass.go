@@ -0,0 +1,229 @@
+package leaves
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"log"
+	"mime"
+	"strconv"
+	"strings"
+	"time"
+
+	"postman-task/internal/core"
+
+	"github.com/boombuler/barcode"
+	"github.com/boombuler/barcode/qr"
+	"github.com/gin-gonic/gin"
+	"github.com/jung-kurt/gofpdf"
+	"gorm.io/gorm"
+)
+
+// Signs a pass for leave at its current version, so any later decision
+// voids passes printed before it
+func (h *LeaveHandler) gatePassToken(leave *core.LeaveRequest) string {
+	payload := strconv.FormatUint(uint64(leave.ID), 10) + "." + strconv.Itoa(leave.Version)
+	return payload + "." + h.gatePassSignature(payload)
+}
+
+func (h *LeaveHandler) gatePassSignature(payload string) string {
+	mac := hmac.New(sha256.New, []byte(h.rules.GatePass.Secret))
+	mac.Write([]byte("gate-pass:" + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Checks a pass token's signature and returns the leave ID and version
+// it was issued for
+func (h *LeaveHandler) parseGatePassToken(token string) (uint, int, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return 0, 0, false
+	}
+	payload := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(h.gatePassSignature(payload))) {
+		return 0, 0, false
+	}
+	id, err1 := strconv.ParseUint(parts[0], 10, 64)
+	version, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil {
+		return 0, 0, false
+	}
+	return uint(id), version, true
+}
+
+// Downloads the leave letter and gate pass of an approved leave as a PDF,
+// for those who may see its documents
+func (h *LeaveHandler) GetGatePass(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	leave, ok := h.findLeaveWithDocuments(c, db)
+	if !ok {
+		return
+	}
+	if leave.Status != "approved" {
+		c.JSON(409, gin.H{"error": "Gate passes are only issued for approved leaves"})
+		return
+	}
+	if err := db.Preload("Student").Preload("Approver").First(leave, leave.ID).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch leave"})
+		return
+	}
+
+	pdf, err := h.renderGatePass(leave)
+	if err != nil {
+		log.Printf("Failed to render gate pass for leave %d: %v", leave.ID, err)
+		c.JSON(500, gin.H{"error": "Could not generate gate pass"})
+		return
+	}
+
+	name := fmt.Sprintf("gate-pass-%d.pdf", leave.ID)
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	c.Header("Cache-Control", "private, no-store")
+	c.Data(200, "application/pdf", pdf)
+}
+
+// Lays out the letter: student, leave, approver and validity window, with
+// a QR code linking to the verification endpoint
+func (h *LeaveHandler) renderGatePass(leave *core.LeaveRequest) ([]byte, error) {
+	link := h.rules.GatePass.VerifyURL + "?token=" + h.gatePassToken(leave)
+	code, err := qr.Encode(link, qr.M, qr.Auto)
+	if err != nil {
+		return nil, err
+	}
+	code, err = barcode.Scale(code, 300, 300)
+	if err != nil {
+		return nil, err
+	}
+	// The codes are 16-bit gray, which gofpdf can't read
+	gray := image.NewGray(code.Bounds())
+	draw.Draw(gray, gray.Bounds(), code, code.Bounds().Min, draw.Src)
+	var qrPNG bytes.Buffer
+	if err := png.Encode(&qrPNG, gray); err != nil {
+		return nil, err
+	}
+
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+	pdf.AddPage()
+
+	pdf.SetFont("Helvetica", "B", 16)
+	pdf.CellFormat(190, 10, "Leave Letter and Gate Pass", "", 1, "C", false, 0, "")
+	pdf.SetFont("Helvetica", "", 10)
+	pdf.CellFormat(190, 6, fmt.Sprintf("Pass no. %d", leave.ID), "", 1, "C", false, 0, "")
+	pdf.Ln(6)
+
+	approver := "-"
+	if leave.Approver != nil {
+		approver = leave.Approver.Name + " (" + leave.Approver.Role + ")"
+	}
+	decided := "-"
+	if leave.DecidedAt != nil {
+		decided = leave.DecidedAt.UTC().Format("2 Jan 2006 15:04 UTC")
+	}
+	grace := h.rules.GatePass.Grace
+	rows := [][2]string{
+		{"Student", leave.Student.Name},
+		{"Email", leave.Student.Email},
+		{"Department", leave.Student.Dept},
+		{"Course", leave.Student.Course},
+		{"Leave type", leave.LeaveType},
+		{"Reason", leave.Reason},
+		{"Valid from", leave.StartsAt.Add(-grace).UTC().Format("Mon 2 Jan 2006 15:04 UTC")},
+		{"Valid until", leave.EndsAt.Add(grace).UTC().Format("Mon 2 Jan 2006 15:04 UTC")},
+		{"Approved by", approver},
+		{"Approved on", decided},
+	}
+	if leave.Remarks != nil && *leave.Remarks != "" {
+		rows = append(rows, [2]string{"Remarks", *leave.Remarks})
+	}
+	for _, row := range rows {
+		// The label spans every line of a wrapped value
+		pdf.SetFont("Helvetica", "", 11)
+		lines := len(pdf.SplitLines([]byte(tr(row[1])), 83))
+		pdf.SetFont("Helvetica", "B", 11)
+		pdf.CellFormat(40, 8*float64(max(lines, 1)), row[0], "1", 0, "L", false, 0, "")
+		pdf.SetFont("Helvetica", "", 11)
+		pdf.MultiCell(85, 8, tr(row[1]), "1", "L", false)
+	}
+
+	// QR code to the right of the details
+	opts := gofpdf.ImageOptions{ImageType: "PNG"}
+	pdf.RegisterImageOptionsReader("qr", opts, &qrPNG)
+	pdf.ImageOptions("qr", 140, 36, 60, 60, false, opts, 0, "")
+	pdf.SetXY(140, 97)
+	pdf.SetFont("Helvetica", "", 8)
+	pdf.MultiCell(60, 4, "Security: scan to check that the leave is still approved.", "", "C", false)
+
+	pdf.SetY(-30)
+	pdf.SetFont("Helvetica", "I", 8)
+	pdf.MultiCell(190, 4, tr("This pass is only valid while the leave is approved and within the dates above. "+
+		"It is void if the leave is rejected or decided again. Verify at "+h.rules.GatePass.VerifyURL), "", "C", false)
+
+	var buf bytes.Buffer
+	err = pdf.Output(&buf)
+	return buf.Bytes(), err
+}
+
+// Checks a gate pass from its QR code, no login needed. A signed pass
+// fails when its leave was rejected or decided again since, or outside the
+// leave's dates.
+func (h *LeaveHandler) VerifyGatePass(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	id, version, ok := h.parseGatePassToken(c.Query("token"))
+	if !ok {
+		c.JSON(400, gin.H{"valid": false, "reason": "invalid_signature", "error": "This is not a genuine gate pass"})
+		return
+	}
+
+	var leave core.LeaveRequest
+	err := db.Preload("Student").Preload("Approver").First(&leave, id).Error
+	if err == gorm.ErrRecordNotFound {
+		c.JSON(200, gin.H{"valid": false, "reason": "not_found", "error": "The leave no longer exists"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch leave"})
+		return
+	}
+
+	grace := h.rules.GatePass.Grace
+	validFrom, validUntil := leave.StartsAt.Add(-grace), leave.EndsAt.Add(grace)
+	pass := gin.H{
+		"leave_id":    leave.ID,
+		"student":     leave.Student.Name,
+		"dept":        leave.Student.Dept,
+		"course":      leave.Student.Course,
+		"leave_type":  leave.LeaveType,
+		"status":      leave.Status,
+		"valid_from":  validFrom,
+		"valid_until": validUntil,
+	}
+	if leave.Approver != nil {
+		pass["approved_by"] = leave.Approver.Name
+	}
+
+	now := time.Now()
+	reason, message := "", ""
+	switch {
+	case leave.Status != "approved":
+		reason, message = "not_approved", "The leave is "+leave.Status
+	case leave.Version != version:
+		reason, message = "superseded", "The leave was decided again, this pass was replaced"
+	case now.Before(validFrom):
+		reason, message = "not_yet_valid", "The leave has not started yet"
+	case now.After(validUntil):
+		reason, message = "expired", "The leave is over"
+	}
+	if reason != "" {
+		c.JSON(200, gin.H{"valid": false, "reason": reason, "error": message, "pass": pass})
+		return
+	}
+
+	c.JSON(200, gin.H{"valid": true, "pass": pass})
+}
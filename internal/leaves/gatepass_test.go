@@ -0,0 +1,69 @@
+package leaves
+
+import (
+	"strings"
+	"testing"
+
+	"postman-task/internal/core"
+	"postman-task/pkg/config"
+)
+
+func gatePassHandler(secret string) *LeaveHandler {
+	return &LeaveHandler{rules: config.LeaveConfig{GatePass: config.GatePassConfig{Secret: secret}}}
+}
+
+func TestGatePassTokenRoundTrip(t *testing.T) {
+	h := gatePassHandler("test-secret")
+	leave := &core.LeaveRequest{ID: 42, Version: 3}
+
+	id, version, ok := h.parseGatePassToken(h.gatePassToken(leave))
+	if !ok || id != 42 || version != 3 {
+		t.Fatalf("parsed %d, %d, %v, want 42, 3, true", id, version, ok)
+	}
+}
+
+func TestGatePassTokenRejectsTampering(t *testing.T) {
+	h := gatePassHandler("test-secret")
+	token := h.gatePassToken(&core.LeaveRequest{ID: 42, Version: 3})
+	parts := strings.Split(token, ".")
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"other leave", "43." + parts[1] + "." + parts[2]},
+		{"other version", parts[0] + ".4." + parts[2]},
+		{"changed signature", parts[0] + "." + parts[1] + "." + strings.Repeat("A", len(parts[2]))},
+		{"no signature", parts[0] + "." + parts[1]},
+		{"extra part", token + ".x"},
+		{"empty", ""},
+		{"other secret", gatePassHandler("another-secret").gatePassToken(&core.LeaveRequest{ID: 42, Version: 3})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, ok := h.parseGatePassToken(tt.token); ok {
+				t.Fatalf("accepted %q", tt.token)
+			}
+		})
+	}
+}
+
+func TestGatePassTokenFollowsVersion(t *testing.T) {
+	h := gatePassHandler("test-secret")
+	leave := &core.LeaveRequest{ID: 42, Version: 3}
+	old := h.gatePassToken(leave)
+
+	// Deciding the leave again bumps its version, the old pass still parses
+	// but names the version it was printed for
+	leave.Version++
+	current := h.gatePassToken(leave)
+	if current == old {
+		t.Fatal("token did not change with the version")
+	}
+	if _, version, ok := h.parseGatePassToken(old); !ok || version == leave.Version {
+		t.Fatalf("old pass parsed as version %d, %v", version, ok)
+	}
+	if _, version, ok := h.parseGatePassToken(current); !ok || version != leave.Version {
+		t.Fatalf("new pass parsed as version %d, %v", version, ok)
+	}
+}
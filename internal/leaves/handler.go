@@ -1,30 +1,59 @@
 package leaves
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"strconv"
 	"time"
 
 	"postman-task/internal/core"
+	"postman-task/internal/etag"
+	"postman-task/internal/metrics"
 	email "postman-task/internal/notifications"
+	"postman-task/internal/storage"
+	"postman-task/internal/tracing"
+	"postman-task/pkg/config"
 
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type LeaveHandler struct {
-	db *gorm.DB
+	db          *gorm.DB
+	store       storage.Store
+	scanner     storage.Scanner
+	attachments config.AttachmentConfig
+	rules       config.LeaveConfig
 }
 
-func NewLeaveHandler(db *gorm.DB) *LeaveHandler {
+func NewLeaveHandler(db *gorm.DB, store storage.Store, scanner storage.Scanner, attachments config.AttachmentConfig, rules config.LeaveConfig) *LeaveHandler {
 	return &LeaveHandler{
-		db: db,
+		db:          db,
+		store:       store,
+		scanner:     scanner,
+		attachments: attachments,
+		rules:       rules,
 	}
 }
 
+// Ends a transaction with a client error instead of a 500
+type actionError struct {
+	code int
+	body gin.H
+}
+
+func (e *actionError) Error() string {
+	return fmt.Sprint(e.body["error"])
+}
+
 // Handles leave application
 func (h *LeaveHandler) ApplyLeave(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
 	// Get user id from gin context
 	userID, exists := c.Get("user_id")
 	if !exists {
@@ -38,6 +67,9 @@ func (h *LeaveHandler) ApplyLeave(c *gin.Context) {
 		EndDate   string `json:"end_date"`
 		Reason    string `json:"reason"`
 		Type      string `json:"leave_type"`
+		Portion   string `json:"portion" binding:"omitempty,oneof=full first_half second_half hours"`
+		StartTime string `json:"start_time"` // HH:MM, for hourly leaves
+		EndTime   string `json:"end_time"`
 	}
 
 	err := c.ShouldBindJSON(&data)
@@ -45,6 +77,9 @@ func (h *LeaveHandler) ApplyLeave(c *gin.Context) {
 		c.JSON(400, gin.H{"error": "Bad request"})
 		return
 	}
+	if data.Portion == "" {
+		data.Portion = "full"
+	}
 
 	// Parse dates
 	start, err1 := time.Parse("2006-01-02", data.StartDate)
@@ -54,32 +89,133 @@ func (h *LeaveHandler) ApplyLeave(c *gin.Context) {
 		c.JSON(400, gin.H{"error": "Invalid date format. Use YYYY-MM-DD"})
 		return
 	}
+	if end.Before(start) {
+		c.JSON(400, gin.H{"error": "End date must not be before start date"})
+		return
+	}
+	if start.Before(today().AddDate(0, 0, -h.rules.BackdateDays)) {
+		c.JSON(400, gin.H{"error": "Start date is too far in the past"})
+		return
+	}
+	startsAt, endsAt, err := h.leaveSpan(start, end, data.Portion, data.StartTime, data.EndTime)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	var student core.User
+	if err := db.Select("id", "name", "dept", "advisor_id").First(&student, userID).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Could not save leave request"})
+		return
+	}
 
-	// Create leave request
 	leave := core.LeaveRequest{
 		StudentID: userID.(uint),
 		StartDate: start,
 		EndDate:   end,
+		Portion:   data.Portion,
+		StartsAt:  startsAt,
+		EndsAt:    endsAt,
 		Reason:    data.Reason,
 		LeaveType: data.Type,
 		Status:    "pending",
 	}
 
-	// Save to database
-	result := h.db.Create(&leave)
-	if result.Error != nil {
+	// Only working hours count, weekends and holidays are free
+	leave.Hours, err = h.workingHours(db, student.Dept, &leave)
+	if err != nil {
 		c.JSON(500, gin.H{"error": "Could not save leave request"})
 		return
 	}
+	if leave.Hours == 0 {
+		c.JSON(400, gin.H{"error": "Leave covers no working hours"})
+		return
+	}
+
+	// Overlapping requests and exams are rejected with the records in the way
+	conflicts, err := h.findConflicts(db, &student, &leave)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Could not save leave request"})
+		return
+	}
+	if len(conflicts) > 0 {
+		c.JSON(409, gin.H{
+			"error":     "Leave conflicts with existing requests or exams",
+			"conflicts": conflicts,
+		})
+		return
+	}
+
+	// Assign to the student's advisor. Their delegate, if any, can decide
+	// it too while the delegation lasts, and is told about it.
+	leave.AssignedTo = student.AdvisorID
+
+	// Pending requests are held against the balance too. The student's row
+	// is locked so their concurrent applications are checked one at a time.
+	err = db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").First(&core.User{}, student.ID).Error
+		if err != nil {
+			return err
+		}
+		left, ok, err := h.checkBalance(tx, &leave, "pending", "approved")
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return &actionError{400, gin.H{
+				"error":          "Not enough " + leave.LeaveType + " leave left",
+				"remaining_days": left,
+				"requested_days": leave.Hours / h.dayHours(),
+			}}
+		}
+		return tx.Create(&leave).Error
+	})
+	var failed *actionError
+	if errors.As(err, &failed) {
+		c.JSON(failed.code, failed.body)
+		return
+	}
+	if isOverlapViolation(err) {
+		// Lost a race with another request for the same time
+		conflicts, _ := h.findConflicts(db, &student, &leave)
+		c.JSON(409, gin.H{
+			"error":     "Leave conflicts with existing requests or exams",
+			"conflicts": conflicts,
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Could not save leave request"})
+		return
+	}
+	metrics.LeaveSubmitted(leave.LeaveType)
+	notifyDelegate(c.Request.Context(), db, &leave, &student)
 
 	c.JSON(200, gin.H{
-		"message": "Leave request submitted",
-		"id":      leave.ID,
+		"message":             "Leave request submitted",
+		"id":                  leave.ID,
+		"duration_hours":      leave.Hours,
+		"attachment_required": h.requiresAttachment(&leave),
 	})
 }
 
+// Gets a single leave, visible to its student and staff
+func (h *LeaveHandler) GetLeave(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	leave, ok := h.findVisibleLeave(c, db)
+	if !ok {
+		return
+	}
+
+	etag.Set(c, leave.Version)
+	c.JSON(200, leave)
+}
+
 // Gets all leaves for current user
 func (h *LeaveHandler) GetMyLeaves(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
 	// Get user id from gin context
 	userID, exists := c.Get("user_id")
 	if !exists {
@@ -100,12 +236,12 @@ func (h *LeaveHandler) GetMyLeaves(c *gin.Context) {
 
 	// Get total count
 	var total int64
-	h.db.Model(&core.LeaveRequest{}).Where("student_id = ?", userID).Count(&total)
+	db.Model(&core.LeaveRequest{}).Where("student_id = ?", userID).Count(&total)
 
 	// Get page of leaves
 	var leaves []core.LeaveRequest
 	offset := (page - 1) * pageSize
-	h.db.Where("student_id = ?", userID).
+	db.Where("student_id = ?", userID).
 		Offset(offset).
 		Limit(pageSize).
 		Order("created_at DESC").
@@ -124,10 +260,11 @@ func (h *LeaveHandler) GetMyLeaves(c *gin.Context) {
 
 // Handles both approval and rejection of leave requests
 func (h *LeaveHandler) HandleLeaveAction(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
 	// Get leave id and action from url
 	leaveID := c.Param("id")
 	action := c.Param("action")
-	fmt.Println(action)
 
 	// Check action
 	if action != "approve" && action != "reject" {
@@ -152,64 +289,146 @@ func (h *LeaveHandler) HandleLeaveAction(c *gin.Context) {
 		return
 	}
 
-	// Find leave request
-	var leave core.LeaveRequest
-	err = h.db.First(&leave, leaveID).Error
-	if err != nil {
-		c.JSON(404, gin.H{"error": "Leave not found"})
-		return
-	}
-
-	// Update leave status
-	actionText := action + "d" // "approved" or "rejected"
-	// Ensure the status is set correctly (handle both "approve" and "reject" actions)
-	if action == "approve" {
-		leave.Status = "approved"
-	} else if action == "reject" {
-		leave.Status = "rejected"
-	}
-	if data.Remarks != nil {
-		leave.Remarks = data.Remarks
-	}
 	approverIDUint := approverID.(uint)
-	leave.ApprovedBy = &approverIDUint
+	key := c.GetHeader("Idempotency-Key")
+	actionText := action + "d" // "approved" or "rejected"
 
-	// Save changes
-	err = h.db.Save(&leave).Error
-	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to update leave request"})
-		return
-	}
+	// Decide under a row lock, so concurrent or retried requests wait for
+	// each other, and attendance is written with the status or not at all
+	var leave core.LeaveRequest
+	replayed := false
+	marked := 0
+	err = db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&leave, leaveID).Error
+		if err != nil {
+			return &actionError{404, gin.H{"error": "Leave not found"}}
+		}
 
-	// If approved, mark the student absent for every day within the leave period
-	if action == "approve" {
-		for d := leave.StartDate; !d.After(leave.EndDate); d = d.AddDate(0, 0, 1) {
-			var count int64
-			if err := h.db.Model(&core.Attendance{}).
-				Where("student_id = ? AND date = ?", leave.StudentID, d).
-				Count(&count).Error; err != nil {
-				c.JSON(500, gin.H{"error": "Database error"})
-				return
+		// A retry of a decision already made, or the same decision again
+		if key != "" && leave.DecisionKey != nil && *leave.DecisionKey == key {
+			if leave.Status != actionText {
+				return &actionError{409, gin.H{"error": "Idempotency-Key was already used for a different action"}}
 			}
+			replayed = true
+			return nil
+		}
+		if leave.Status == actionText {
+			replayed = true
+			return nil
+		}
 
-			if count == 0 {
-				att := core.Attendance{
-					StudentID: leave.StudentID,
-					Date:      d,
-					Present:   false,
-					MarkedBy:  approverIDUint,
-				}
-				if err := h.db.Create(&att).Error; err != nil {
-					c.JSON(500, gin.H{"error": "Failed to create attendance"})
-					return
+		// The approver must have seen the latest version of the request
+		ifMatch := c.GetHeader("If-Match")
+		if ifMatch == "" {
+			return &actionError{428, gin.H{"error": "If-Match header is required, send the ETag from the last GET"}}
+		}
+		if !etag.Matches(ifMatch, leave.Version) {
+			etag.Set(c, leave.Version)
+			return &actionError{412, gin.H{"error": "The record was changed by someone else, reload it and try again"}}
+		}
+
+		// Only the assignee or their current delegate may decide it
+		allowed, onBehalfOf, err := canDecide(tx, &leave, approverIDUint, c.GetString("user_role"))
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			return &actionError{403, gin.H{"error": "This request is assigned to another approver"}}
+		}
+
+		if action == "approve" {
+			// Some leaves need a supporting document before approval
+			if h.requiresAttachment(&leave) {
+				var count int64
+				tx.Model(&core.LeaveAttachment{}).Where("leave_id = ?", leave.ID).Count(&count)
+				if count == 0 {
+					return &actionError{400, gin.H{"error": "A supporting document is required to approve this leave"}}
 				}
 			}
+
+			// Approving takes the leave from the student's balance
+			left, ok, err := h.checkBalance(tx, &leave, "approved")
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return &actionError{400, gin.H{
+					"error":          "Student does not have enough " + leave.LeaveType + " leave left",
+					"remaining_days": left,
+					"requested_days": leave.Hours / h.dayHours(),
+				}}
+			}
+		}
+
+		wasApproved := leave.Status == "approved"
+		leave.Status = actionText
+		if data.Remarks != nil {
+			leave.Remarks = data.Remarks
+		}
+		leave.ApprovedBy = &approverIDUint
+		leave.OnBehalfOf = onBehalfOf
+		leave.ActedBy = nil
+		if actor, ok := c.Get("actor_id"); ok {
+			actorID := actor.(uint)
+			leave.ActedBy = &actorID
+		}
+		now := time.Now()
+		leave.DecidedAt = &now
+		if key != "" {
+			leave.DecisionKey = &key
+		}
+		leave.Version++
+
+		err = tx.Save(&leave).Error
+		if isOverlapViolation(err) {
+			return &actionError{409, gin.H{"error": "Leave overlaps another pending or approved request"}}
+		}
+		if err != nil {
+			return err
+		}
+
+		// If approved, record every day within the leave period as leave,
+		// and if an approval is overturned, undo those entries
+		if action == "approve" {
+			marked, err = h.markLeaveDays(c.Request.Context(), tx, leave, approverIDUint)
+			if err != nil {
+				return err
+			}
+		} else if wasApproved {
+			if _, err := revokeLeaveEntries(tx, leave.ID); err != nil {
+				return err
+			}
 		}
+		return nil
+	})
+
+	var failed *actionError
+	if errors.As(err, &failed) {
+		c.JSON(failed.code, failed.body)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to %s leave %s: %v", action, leaveID, err)
+		c.JSON(500, gin.H{"error": "Failed to update leave request"})
+		return
+	}
+	etag.Set(c, leave.Version)
+	if replayed {
+		c.JSON(200, gin.H{
+			"message": "Leave request " + actionText,
+			"status":  leave.Status,
+		})
+		return
+	}
+
+	metrics.LeaveDecided(leave.LeaveType, leave.Status)
+	for range marked {
+		metrics.AttendanceMarked(false)
 	}
 
 	// Notify student via email
 	var student core.User
-	err = h.db.First(&student, leave.StudentID).Error
+	err = db.First(&student, leave.StudentID).Error
 	if err == nil {
 		subject := fmt.Sprintf("Leave Request #%d %s", leave.ID, actionText)
 
@@ -225,9 +444,10 @@ func (h *LeaveHandler) HandleLeaveAction(c *gin.Context) {
 			"Remarks: " + remarks + "\n\n" +
 			"Regards,\nFaculty"
 
-		// Send email in background using goroutines
+		// Send email in background using goroutines, keeping the request trace
+		ctx := tracing.Detach(c.Request.Context())
 		go func() {
-			sendErr := email.Send(student.Email, subject, body)
+			sendErr := email.SendContext(ctx, student.Email, subject, body)
 			if sendErr != nil {
 				log.Printf("Failed to send %s email: %v", actionText, sendErr)
 			}
@@ -240,8 +460,83 @@ func (h *LeaveHandler) HandleLeaveAction(c *gin.Context) {
 	})
 }
 
-// Gets all leave requests (only for admin/faculty/warden)
+// Records the days, or half days, of an approved leave as leave in the
+// student's attendance: days with no attendance yet in one insert, and
+// days marked absent by updating them. Returns the number of records
+// written.
+func (h *LeaveHandler) markLeaveDays(ctx context.Context, tx *gorm.DB, leave core.LeaveRequest, markerID uint) (int, error) {
+	ctx, span := tracing.Start(ctx, "leaves.mark_leave_days")
+	defer span.End()
+	span.SetAttributes(attribute.Int("leave.id", int(leave.ID)))
+
+	tx = tx.WithContext(ctx)
+	var existing []core.Attendance
+	err := tx.Select("date", "session").
+		Where("student_id = ? AND date >= ? AND date <= ?", leave.StudentID, leave.StartDate, leave.EndDate).
+		Find(&existing).Error
+	if err != nil {
+		tracing.RecordError(span, err)
+		return 0, err
+	}
+	// Dates come back in the local zone, compare them as UTC days
+	taken := make(map[string]bool, len(existing))
+	for _, att := range existing {
+		taken[att.Date.UTC().Format("2006-01-02")+" "+att.Session] = true
+	}
+
+	var records []core.Attendance
+	for d := leave.StartDate; !d.After(leave.EndDate); d = d.AddDate(0, 0, 1) {
+		// Partial leaves only take the half days they touch
+		session := h.sessionOn(&leave, d)
+		day := d.UTC().Format("2006-01-02")
+		if session == "" || taken[day+" full"] || taken[day+" "+session] {
+			continue
+		}
+		records = append(records, core.Attendance{
+			StudentID: leave.StudentID,
+			Date:      d,
+			Session:   session,
+			Status:    leaveStatus(&leave),
+			Present:   false,
+			LeaveID:   &leave.ID,
+			FromLeave: true,
+			MarkedBy:  markerID,
+		})
+	}
+
+	// Marks made since the lookup win over the leave
+	if len(records) > 0 {
+		err = tx.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(&records, 500).Error
+		if err != nil {
+			tracing.RecordError(span, err)
+			return 0, err
+		}
+	}
+
+	// Absences already marked for the leave's sessions become leave entries
+	converted, err := h.excuseAbsences(tx, &leave)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return 0, err
+	}
+	return len(records) + int(converted), nil
+}
+
+// Gets all leave requests (only for admin/faculty/warden).
+// ?assigned=me keeps those the user may decide, including through a
+// delegation, and ?status= filters by status.
 func (h *LeaveHandler) GetAllLeaves(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	query := db.Model(&core.LeaveRequest{})
+	if c.Query("assigned") == "me" {
+		userID := c.MustGet("user_id")
+		query = query.Where("assigned_to = ? OR assigned_to IN (?)", userID, delegatorsOf(db, userID))
+	}
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
 	// Get pagination parameters
 	page := 1
 	p := c.Query("page")
@@ -255,12 +550,12 @@ func (h *LeaveHandler) GetAllLeaves(c *gin.Context) {
 
 	// Get total count
 	var total int64
-	h.db.Model(&core.LeaveRequest{}).Count(&total)
+	query.Session(&gorm.Session{}).Count(&total)
 
 	// Get page of leaves
 	var leaves []core.LeaveRequest
 	offset := (page - 1) * pageSize
-	h.db.Offset(offset).
+	query.Offset(offset).
 		Limit(pageSize).
 		Order("created_at DESC").
 		Find(&leaves)
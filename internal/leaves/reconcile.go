@@ -0,0 +1,152 @@
+package leaves
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"postman-task/internal/core"
+	"postman-task/internal/metrics"
+	"postman-task/pkg/config"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// The attendance status for days of an approved leave
+func leaveStatus(leave *core.LeaveRequest) string {
+	if leave.LeaveType == "Medical" {
+		return "medical"
+	}
+	return "on_leave"
+}
+
+// Turns absences in the sessions of an approved leave into leave entries
+func (h *LeaveHandler) excuseAbsences(tx *gorm.DB, leave *core.LeaveRequest) (int64, error) {
+	var total int64
+	for d := leave.StartDate; !d.After(leave.EndDate); d = d.AddDate(0, 0, 1) {
+		session := h.sessionOn(leave, d)
+		if session == "" {
+			continue
+		}
+		result := tx.Model(&core.Attendance{}).
+			Where("student_id = ? AND date = ? AND session = ? AND status = 'absent'", leave.StudentID, d, session).
+			Updates(map[string]interface{}{
+				"status":   leaveStatus(leave),
+				"leave_id": leave.ID,
+				"version":  gorm.Expr("version + 1"),
+			})
+		if result.Error != nil {
+			return 0, result.Error
+		}
+		total += result.RowsAffected
+	}
+	return total, nil
+}
+
+// Undoes the leave entries of leaveID or, with 0, of every leave that is
+// no longer approved. Entries the leave inserted are deleted, absences it
+// excused become absences again.
+func revokeLeaveEntries(tx *gorm.DB, leaveID uint) (int64, error) {
+	entries := func() *gorm.DB {
+		query := tx.Model(&core.Attendance{}).Where("leave_id IS NOT NULL")
+		if leaveID != 0 {
+			return query.Where("leave_id = ?", leaveID)
+		}
+		return query.Where(`NOT EXISTS (SELECT 1 FROM leave_requests l
+			WHERE l.id = attendances.leave_id AND l.status = 'approved' AND l.deleted_at IS NULL)`)
+	}
+
+	deleted := entries().Where("from_leave").Delete(&core.Attendance{})
+	if deleted.Error != nil {
+		return 0, deleted.Error
+	}
+	result := entries().Updates(map[string]interface{}{
+		"status":   "absent",
+		"leave_id": nil,
+		"version":  gorm.Expr("version + 1"),
+	})
+	return deleted.RowsAffected + result.RowsAffected, result.Error
+}
+
+// What a reconciliation changed
+type ReconcileReport struct {
+	Leaves  int   `json:"leaves"`  // approved leaves checked
+	Marked  int   `json:"marked"`  // attendance recorded as leave
+	Revoked int64 `json:"revoked"` // leave entries deleted or turned back into absences
+}
+
+// Brings attendance in line with approved leave: every session of an
+// approved leave is recorded as leave rather than an absence, and entries
+// of leaves that were later rejected or deleted are undone
+func reconcile(ctx context.Context, h *LeaveHandler) (ReconcileReport, error) {
+	var report ReconcileReport
+	db := h.db.WithContext(ctx)
+
+	revoked, err := revokeLeaveEntries(db, 0)
+	if err != nil {
+		return report, err
+	}
+	report.Revoked = revoked
+
+	var batch []core.LeaveRequest
+	err = db.Where("status = 'approved'").FindInBatches(&batch, 100, func(_ *gorm.DB, _ int) error {
+		for _, leave := range batch {
+			err := h.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+				marker := leave.StudentID
+				if leave.ApprovedBy != nil {
+					marker = *leave.ApprovedBy
+				}
+				n, err := h.markLeaveDays(ctx, tx, leave, marker)
+				report.Marked += n
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			report.Leaves++
+		}
+		return nil
+	}).Error
+	return report, err
+}
+
+// Reconciles attendance with approved leave every interval
+func RunReconcile(ctx context.Context, db *gorm.DB, rules config.LeaveConfig, interval time.Duration) {
+	h := &LeaveHandler{db: db, rules: rules}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			start := time.Now()
+			report, err := reconcile(ctx, h)
+			metrics.JobRun("attendance_reconcile", start, err)
+			if err != nil {
+				log.Printf("Attendance reconciliation failed: %v", err)
+				continue
+			}
+			if report.Marked > 0 || report.Revoked > 0 {
+				log.Printf("Attendance reconciliation: %d leaves checked, %d marked as leave, %d revoked",
+					report.Leaves, report.Marked, report.Revoked)
+			}
+		}
+	}
+}
+
+// Runs the reconciliation now, admin only
+func (h *LeaveHandler) ReconcileAttendance(c *gin.Context) {
+	start := time.Now()
+	report, err := reconcile(c.Request.Context(), h)
+	metrics.JobRun("attendance_reconcile", start, err)
+	if err != nil {
+		log.Printf("Attendance reconciliation failed: %v", err)
+		c.JSON(500, gin.H{"error": "Reconciliation failed"})
+		return
+	}
+
+	c.JSON(200, report)
+}
@@ -0,0 +1,163 @@
+package metrics
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "campus"
+
+var (
+	// HTTP request latency per route
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by method, route and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	// Leave requests submitted by type
+	leavesSubmitted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "leaves_submitted_total",
+		Help:      "Leave requests submitted, by leave type.",
+	}, []string{"leave_type"})
+
+	// Leave requests approved or rejected by type
+	leaveDecisions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "leave_decisions_total",
+		Help:      "Leave requests approved or rejected, by leave type and status.",
+	}, []string{"leave_type", "status"})
+
+	// Attendance marks by status, use increase() over 1d for daily numbers
+	attendanceMarks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "attendance_marks_total",
+		Help:      "Attendance records marked, by status.",
+	}, []string{"status"})
+
+	// Emails sent and failed
+	emailsSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "emails_sent_total",
+		Help:      "Emails handed to the SMTP server, by result.",
+	}, []string{"result"})
+
+	// Requests rejected by rate limits
+	rateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limited_total",
+		Help:      "Requests rejected by a rate limit, by rule.",
+	}, []string{"rule"})
+
+	// Accounts locked after failed logins
+	accountLockouts = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "account_lockouts_total",
+		Help:      "Accounts locked after repeated failed logins.",
+	})
+
+	// Background job runs
+	jobRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "job_runs_total",
+		Help:      "Background job runs, by job name and result.",
+	}, []string{"job", "result"})
+
+	jobDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "job_duration_seconds",
+		Help:      "Background job run time, by job name.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12),
+	}, []string{"job"})
+)
+
+// Registers connection pool stats for the database
+func RegisterDB(sqlDB *sql.DB) {
+	prometheus.MustRegister(collectors.NewDBStatsCollector(sqlDB, "postgres"))
+}
+
+// Serves the metrics in prometheus format at /metrics on addr, apart from
+// the API
+func Serve(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return http.ListenAndServe(addr, mux)
+}
+
+// Records latency of every request
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		// Use the route pattern so ids don't blow up the label count
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+
+		httpDuration.WithLabelValues(
+			c.Request.Method,
+			route,
+			strconv.Itoa(c.Writer.Status()),
+		).Observe(time.Since(start).Seconds())
+	}
+}
+
+// Counts a submitted leave
+func LeaveSubmitted(leaveType string) {
+	leavesSubmitted.WithLabelValues(leaveType).Inc()
+}
+
+// Counts an approved or rejected leave
+func LeaveDecided(leaveType, status string) {
+	leaveDecisions.WithLabelValues(leaveType, status).Inc()
+}
+
+// Counts a marked attendance record
+func AttendanceMarked(present bool) {
+	status := "absent"
+	if present {
+		status = "present"
+	}
+	attendanceMarks.WithLabelValues(status).Inc()
+}
+
+// Counts an email send attempt
+func EmailSent(err error) {
+	if err != nil {
+		emailsSent.WithLabelValues("failure").Inc()
+		return
+	}
+	emailsSent.WithLabelValues("success").Inc()
+}
+
+// Counts a request rejected by a rate limit
+func RateLimited(rule string) {
+	rateLimited.WithLabelValues(rule).Inc()
+}
+
+// Counts an account lockout
+func AccountLocked() {
+	accountLockouts.Inc()
+}
+
+// Records a background job run
+func JobRun(job string, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	jobRuns.WithLabelValues(job, result).Inc()
+	jobDuration.WithLabelValues(job).Observe(time.Since(start).Seconds())
+}
@@ -1,14 +1,55 @@
 package email
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
 	"fmt"
+	"mime"
+	"mime/multipart"
 	"net/smtp"
+	"net/textproto"
+	"postman-task/internal/metrics"
+	"postman-task/internal/tracing"
 	"postman-task/pkg/config"
 	"strings"
 )
 
 // Sends a simple text email.
 func Send(to, subject, body string) error {
+	return SendContext(context.Background(), to, subject, body)
+}
+
+// Sends a simple text email as part of the trace in ctx.
+func SendContext(ctx context.Context, to, subject, body string) error {
+	_, span := tracing.Start(ctx, "email.send")
+	defer span.End()
+
+	err := send(to, subject, body, nil)
+	tracing.RecordError(span, err)
+	metrics.EmailSent(err)
+	return err
+}
+
+// A file attached to an email
+type Attachment struct {
+	Name        string
+	ContentType string
+	Data        []byte
+}
+
+// Sends a text email with files attached, as part of the trace in ctx.
+func SendWithAttachmentsContext(ctx context.Context, to, subject, body string, files ...Attachment) error {
+	_, span := tracing.Start(ctx, "email.send")
+	defer span.End()
+
+	err := send(to, subject, body, files)
+	tracing.RecordError(span, err)
+	metrics.EmailSent(err)
+	return err
+}
+
+func send(to, subject, body string, files []Attachment) error {
 	cfg := config.Load()
 
 	// Get smtp details from config
@@ -26,15 +67,54 @@ func Send(to, subject, body string) error {
 
 	auth := smtp.PlainAuth("", username, password, host)
 
-	msg := strings.Join([]string{
+	headers := []string{
 		fmt.Sprintf("From: %s", from),
 		fmt.Sprintf("To: %s", to),
 		fmt.Sprintf("Subject: %s", subject),
 		"MIME-version: 1.0;",
-		"Content-Type: text/plain; charset=\"UTF-8\";",
-		"",
-		body,
-	}, "\r\n")
+	}
+
+	var msg string
+	if len(files) == 0 {
+		msg = strings.Join(append(headers,
+			"Content-Type: text/plain; charset=\"UTF-8\";",
+			"",
+			body,
+		), "\r\n")
+	} else {
+		msg = multipartMessage(headers, body, files)
+	}
 
 	return smtp.SendMail(addr, auth, from, []string{to}, []byte(msg))
 }
+
+// Builds a multipart/mixed message with the text body first and each file
+// base64 encoded after it
+func multipartMessage(headers []string, body string, files []Attachment) string {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+
+	part, _ := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"text/plain; charset=\"UTF-8\""},
+	})
+	part.Write([]byte(body))
+
+	for _, f := range files {
+		part, _ := w.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {f.ContentType},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": f.Name})},
+		})
+		encoded := base64.StdEncoding.EncodeToString(f.Data)
+		// Lines of at most 76 characters, as MIME requires
+		for len(encoded) > 76 {
+			part.Write([]byte(encoded[:76] + "\r\n"))
+			encoded = encoded[76:]
+		}
+		part.Write([]byte(encoded))
+	}
+	w.Close()
+
+	headers = append(headers, "Content-Type: multipart/mixed; boundary=\""+w.Boundary()+"\"", "")
+	return strings.Join(headers, "\r\n") + "\r\n" + buf.String()
+}
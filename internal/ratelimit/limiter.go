@@ -0,0 +1,79 @@
+package ratelimit
+
+import (
+	"context"
+	"log"
+	"math"
+	"strconv"
+	"time"
+
+	"postman-task/internal/metrics"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A named limit of hits per window
+type Rule struct {
+	Name   string
+	Limit  int
+	Window time.Duration
+}
+
+type Limiter struct {
+	store Store
+}
+
+// Creates a limiter backed by store
+func NewLimiter(store Store) *Limiter {
+	return &Limiter{store: store}
+}
+
+// Counts a hit on key and reports whether it is within the rule,
+// and if not, how long until the caller may retry
+func (l *Limiter) Allow(ctx context.Context, rule Rule, key string) (bool, time.Duration) {
+	// A limit of zero turns the rule off
+	if rule.Limit <= 0 {
+		return true, 0
+	}
+
+	count, resetAt, err := l.store.Hit(ctx, rule.Name+":"+key, rule.Window)
+	if err != nil {
+		// Don't lock everyone out because the store is down
+		log.Printf("Rate limit store error: %v", err)
+		return true, 0
+	}
+
+	if count > rule.Limit {
+		metrics.RateLimited(rule.Name)
+		return false, time.Until(resetAt)
+	}
+	return true, 0
+}
+
+// Clears the count for key under rule
+func (l *Limiter) Reset(ctx context.Context, rule Rule, key string) error {
+	return l.store.Reset(ctx, rule.Name+":"+key)
+}
+
+// Limits requests per client IP
+func (l *Limiter) PerIP(rule Rule) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ok, retryAfter := l.Allow(c.Request.Context(), rule, c.ClientIP())
+		if !ok {
+			TooManyRequests(c, retryAfter, "Too many requests, try again later")
+			return
+		}
+		c.Next()
+	}
+}
+
+// Aborts with 429 and a Retry-After header in whole seconds
+func TooManyRequests(c *gin.Context, retryAfter time.Duration, message string) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.JSON(429, gin.H{"error": message})
+	c.Abort()
+}
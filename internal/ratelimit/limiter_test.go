@@ -0,0 +1,165 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A router limiting per IP, trusting X-Forwarded-For only from proxies as
+// the server does
+func testRouter(t *testing.T, l *Limiter, rule Rule, proxies []string) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	if err := r.SetTrustedProxies(proxies); err != nil {
+		t.Fatal(err)
+	}
+	r.POST("/login", l.PerIP(rule), func(c *gin.Context) {
+		c.JSON(200, gin.H{})
+	})
+	return r
+}
+
+// Posts from remote, with forwarded as X-Forwarded-For when set
+func post(r http.Handler, remote, forwarded string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/login", nil)
+	req.RemoteAddr = remote + ":1234"
+	if forwarded != "" {
+		req.Header.Set("X-Forwarded-For", forwarded)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+var loginRule = Rule{Name: "login_ip", Limit: 3, Window: time.Minute}
+
+func TestLimitsPerIP(t *testing.T) {
+	r := testRouter(t, NewLimiter(NewMemoryStore()), loginRule, nil)
+
+	for i := 0; i < 3; i++ {
+		if w := post(r, "192.0.2.1", ""); w.Code != 200 {
+			t.Fatalf("request %d got %d, want 200", i+1, w.Code)
+		}
+	}
+	w := post(r, "192.0.2.1", "")
+	if w.Code != 429 {
+		t.Fatalf("request over the limit got %d, want 429", w.Code)
+	}
+	retry, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	if err != nil || retry < 1 || retry > 60 {
+		t.Fatalf("Retry-After %q, want 1 to 60 seconds", w.Header().Get("Retry-After"))
+	}
+
+	if w := post(r, "192.0.2.2", ""); w.Code != 200 {
+		t.Fatalf("another IP got %d, want 200", w.Code)
+	}
+}
+
+func TestWindowAndReset(t *testing.T) {
+	l := NewLimiter(NewMemoryStore())
+	ctx := context.Background()
+	rule := Rule{Name: "login_account", Limit: 1, Window: 50 * time.Millisecond}
+
+	if ok, _ := l.Allow(ctx, rule, "a@b.c"); !ok {
+		t.Fatal("first hit refused")
+	}
+	if ok, _ := l.Allow(ctx, rule, "a@b.c"); ok {
+		t.Fatal("second hit allowed")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if ok, _ := l.Allow(ctx, rule, "a@b.c"); !ok {
+		t.Fatal("refused after the window")
+	}
+
+	l.Allow(ctx, rule, "a@b.c")
+	if err := l.Reset(ctx, rule, "a@b.c"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := l.Allow(ctx, rule, "a@b.c"); !ok {
+		t.Fatal("refused after reset")
+	}
+
+	// Rules count separately for the same key
+	if ok, _ := l.Allow(ctx, Rule{Name: "other", Limit: 1, Window: time.Minute}, "a@b.c"); !ok {
+		t.Fatal("refused under another rule")
+	}
+}
+
+type failingStore struct{}
+
+func (failingStore) Hit(context.Context, string, time.Duration) (int, time.Time, error) {
+	return 0, time.Time{}, errors.New("store is down")
+}
+
+func (failingStore) Reset(context.Context, string) error {
+	return errors.New("store is down")
+}
+
+func TestOpenWithoutLimitOrStore(t *testing.T) {
+	tests := []struct {
+		name  string
+		store Store
+		rule  Rule
+	}{
+		{"limit of zero", NewMemoryStore(), Rule{Name: "off", Limit: 0, Window: time.Minute}},
+		{"store down", failingStore{}, loginRule},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := testRouter(t, NewLimiter(tt.store), tt.rule, nil)
+			for i := 0; i < 10; i++ {
+				if w := post(r, "192.0.2.1", ""); w.Code != 200 {
+					t.Fatalf("request %d got %d, want 200", i+1, w.Code)
+				}
+			}
+		})
+	}
+}
+
+func TestForwardedForOnlyFromTrustedProxies(t *testing.T) {
+	proxy := "10.0.0.1"
+	tests := []struct {
+		name    string
+		proxies []string
+		remote  string
+		// X-Forwarded-For of each of four requests
+		forwarded []string
+		// whether the fourth is limited, i.e. all four counted as one client
+		limited bool
+	}{
+		{"no trusted proxies, spoofed header ignored", nil, "192.0.2.1",
+			[]string{"198.51.100.1", "198.51.100.2", "198.51.100.3", "198.51.100.4"}, true},
+		{"untrusted remote, header ignored", []string{proxy}, "192.0.2.1",
+			[]string{"198.51.100.1", "198.51.100.2", "198.51.100.3", "198.51.100.4"}, true},
+		{"trusted proxy, clients told apart", []string{proxy}, proxy,
+			[]string{"198.51.100.1", "198.51.100.2", "198.51.100.3", "198.51.100.4"}, false},
+		{"trusted proxy by CIDR", []string{"10.0.0.0/8"}, proxy,
+			[]string{"198.51.100.1", "198.51.100.2", "198.51.100.3", "198.51.100.4"}, false},
+		{"trusted proxy, same client", []string{proxy}, proxy,
+			[]string{"198.51.100.1", "198.51.100.1", "198.51.100.1", "198.51.100.1"}, true},
+		// The proxy appends the address it saw, so a client can only prepend
+		// made up ones
+		{"trusted proxy, client prepends spoofed hops", []string{proxy}, proxy,
+			[]string{"203.0.113.1, 198.51.100.1", "203.0.113.2, 198.51.100.1", "203.0.113.3, 198.51.100.1", "203.0.113.4, 198.51.100.1"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := testRouter(t, NewLimiter(NewMemoryStore()), loginRule, tt.proxies)
+			var last int
+			for _, forwarded := range tt.forwarded {
+				last = post(r, tt.remote, forwarded).Code
+			}
+			if limited := last == 429; limited != tt.limited {
+				t.Fatalf("last request got %d, limited %v, want %v", last, limited, tt.limited)
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Counts hits per key in fixed windows
+type Store interface {
+	// Adds a hit for key and returns the count in the current window
+	// along with the time the window resets
+	Hit(ctx context.Context, key string, window time.Duration) (int, time.Time, error)
+	// Clears the count for key
+	Reset(ctx context.Context, key string) error
+}
+
+// Creates a store by name, "memory" or "postgres"
+func NewStore(db *gorm.DB, kind string) (Store, error) {
+	switch kind {
+	case "", "memory":
+		return NewMemoryStore(), nil
+	case "postgres":
+		return NewPostgresStore(db)
+	default:
+		return nil, fmt.Errorf("unknown rate limit store %q", kind)
+	}
+}
+
+type entry struct {
+	count   int
+	resetAt time.Time
+}
+
+// Keeps counters in process memory, only good for a single instance
+type MemoryStore struct {
+	mu        sync.Mutex
+	entries   map[string]*entry
+	lastSweep time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entries: make(map[string]*entry)}
+}
+
+func (s *MemoryStore) Hit(ctx context.Context, key string, window time.Duration) (int, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.sweep(now)
+
+	e, ok := s.entries[key]
+	if !ok || !now.Before(e.resetAt) {
+		e = &entry{resetAt: now.Add(window)}
+		s.entries[key] = e
+	}
+	e.count++
+
+	return e.count, e.resetAt, nil
+}
+
+func (s *MemoryStore) Reset(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.entries, key)
+	return nil
+}
+
+// Drops expired windows once a minute so the map doesn't grow forever
+func (s *MemoryStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	for k, e := range s.entries {
+		if !now.Before(e.resetAt) {
+			delete(s.entries, k)
+		}
+	}
+	s.lastSweep = now
+}
+
+// Represents a rate limit window stored in postgres
+type Counter struct {
+	Key     string    `gorm:"primaryKey"`
+	Count   int       `gorm:"not null"`
+	ResetAt time.Time `gorm:"not null;index"`
+}
+
+func (Counter) TableName() string {
+	return "rate_limit_counters"
+}
+
+// Keeps counters in postgres so limits are shared between instances
+type PostgresStore struct {
+	db *gorm.DB
+
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+func NewPostgresStore(db *gorm.DB) (*PostgresStore, error) {
+	if err := db.AutoMigrate(&Counter{}); err != nil {
+		return nil, err
+	}
+	return &PostgresStore{db: db}, nil
+}
+
+func (s *PostgresStore) Hit(ctx context.Context, key string, window time.Duration) (int, time.Time, error) {
+	now := time.Now()
+	s.sweep(ctx, now)
+
+	// Start a new window if the old one expired, otherwise count up
+	var c Counter
+	err := s.db.WithContext(ctx).Raw(`
+		INSERT INTO rate_limit_counters (key, count, reset_at) VALUES (?, 1, ?)
+		ON CONFLICT (key) DO UPDATE SET
+			count = CASE WHEN rate_limit_counters.reset_at <= ? THEN 1 ELSE rate_limit_counters.count + 1 END,
+			reset_at = CASE WHEN rate_limit_counters.reset_at <= ? THEN EXCLUDED.reset_at ELSE rate_limit_counters.reset_at END
+		RETURNING key, count, reset_at`,
+		key, now.Add(window), now, now).Scan(&c).Error
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	return c.Count, c.ResetAt, nil
+}
+
+func (s *PostgresStore) Reset(ctx context.Context, key string) error {
+	return s.db.WithContext(ctx).Delete(&Counter{Key: key}).Error
+}
+
+// Deletes expired windows at most once a minute
+func (s *PostgresStore) sweep(ctx context.Context, now time.Time) {
+	s.mu.Lock()
+	if now.Sub(s.lastSweep) < time.Minute {
+		s.mu.Unlock()
+		return
+	}
+	s.lastSweep = now
+	s.mu.Unlock()
+
+	s.db.WithContext(ctx).Where("reset_at <= ?", now).Delete(&Counter{})
+}
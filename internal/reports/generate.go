@@ -0,0 +1,218 @@
+package reports
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"postman-task/internal/core"
+
+	"github.com/jung-kurt/gofpdf"
+	"gorm.io/gorm"
+)
+
+// Students listed in an absentees report
+const absenteeRows = 25
+
+// A report's contents before it is rendered
+type table struct {
+	title   string
+	period  string
+	columns []string
+	rows    [][]string
+}
+
+func percent(present, counted float64) string {
+	if counted == 0 {
+		return "-"
+	}
+	return strconv.FormatFloat(present/counted*100, 'f', 1, 64)
+}
+
+// Formats a number of days, which may include half days
+func days(n float64) string {
+	return strconv.FormatFloat(n, 'f', -1, 64)
+}
+
+// Builds the contents of def's report for from to to, from the analytics
+// rollups
+func build(db *gorm.DB, def *core.ReportDefinition, from, to time.Time) (*table, error) {
+	t := &table{
+		title:  def.Name,
+		period: from.Format("2 Jan 2006") + " - " + to.Format("2 Jan 2006"),
+	}
+	if def.Dept != "" {
+		t.period += ", " + def.Dept
+	}
+
+	args := []interface{}{from, to}
+	dept := ""
+	if def.Dept != "" {
+		dept = " AND dept = ?"
+		args = append(args, def.Dept)
+	}
+
+	switch def.Kind {
+	case "attendance":
+		var rows []struct {
+			Dept     string
+			Course   string
+			Present  float64
+			Counted  float64
+			Excluded float64
+		}
+		err := db.Raw(`SELECT dept, course, SUM(present) AS present, SUM(counted) AS counted, SUM(excluded) AS excluded
+			FROM rollup_course_days WHERE date >= ? AND date <= ?`+dept+`
+			GROUP BY dept, course ORDER BY dept, course`, args...).Scan(&rows).Error
+		if err != nil {
+			return nil, err
+		}
+		t.columns = []string{"Department", "Course", "Present", "Absent", "Excluded", "Attendance %"}
+		var present, counted, excluded float64
+		for _, r := range rows {
+			t.rows = append(t.rows, []string{r.Dept, r.Course,
+				days(r.Present), days(r.Counted - r.Present), days(r.Excluded), percent(r.Present, r.Counted)})
+			present, counted, excluded = present+r.Present, counted+r.Counted, excluded+r.Excluded
+		}
+		t.rows = append(t.rows, []string{"Total", "",
+			days(present), days(counted - present), days(excluded), percent(present, counted)})
+
+	case "leaves":
+		var rows []struct {
+			LeaveType string
+			Status    string
+			Count     int64
+			Hours     float64
+		}
+		err := db.Raw(`SELECT leave_type, status, SUM(count) AS count, SUM(hours) AS hours
+			FROM rollup_leave_days WHERE date >= ? AND date <= ?`+dept+`
+			GROUP BY leave_type, status ORDER BY leave_type, status`, args...).Scan(&rows).Error
+		if err != nil {
+			return nil, err
+		}
+		t.columns = []string{"Leave type", "Status", "Leaves", "Working hours"}
+		var count int64
+		var hours float64
+		for _, r := range rows {
+			t.rows = append(t.rows, []string{r.LeaveType, r.Status,
+				strconv.FormatInt(r.Count, 10), strconv.FormatFloat(r.Hours, 'f', 1, 64)})
+			count, hours = count+r.Count, hours+r.Hours
+		}
+		t.rows = append(t.rows, []string{"Total", "",
+			strconv.FormatInt(count, 10), strconv.FormatFloat(hours, 'f', 1, 64)})
+
+	case "absentees":
+		var rows []struct {
+			Name    string
+			Email   string
+			Dept    string
+			Course  string
+			Present float64
+			Counted float64
+		}
+		err := db.Raw(`SELECT u.name, u.email, u.dept, u.course, s.present, s.counted
+			FROM (
+				SELECT student_id, SUM(present) AS present, SUM(counted) AS counted
+				FROM rollup_student_days WHERE date >= ? AND date <= ?`+dept+`
+				GROUP BY student_id
+			) s JOIN users u ON u.id = s.student_id
+			WHERE s.counted > s.present
+			ORDER BY s.counted - s.present DESC, u.name
+			LIMIT ?`, append(args, absenteeRows)...).Scan(&rows).Error
+		if err != nil {
+			return nil, err
+		}
+		t.columns = []string{"Student", "Email", "Department", "Course", "Absent days", "Attendance %"}
+		for _, r := range rows {
+			t.rows = append(t.rows, []string{r.Name, r.Email, r.Dept, r.Course,
+				days(r.Counted - r.Present), percent(r.Present, r.Counted)})
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown report kind %q", def.Kind)
+	}
+	return t, nil
+}
+
+// Writes the table as CSV with a header row
+func renderCSV(t *table) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(t.columns)
+	for _, row := range t.rows {
+		cells := make([]string, len(row))
+		for i, cell := range row {
+			cells[i] = csvCell(cell)
+		}
+		w.Write(cells)
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// Quotes a cell that a spreadsheet would run as a formula, such as a name
+// starting with =. The lone "-" of an empty percentage is left alone.
+func csvCell(cell string) string {
+	if cell != "-" && cell != "" && strings.ContainsRune("=+-@\t\r", rune(cell[0])) {
+		return "'" + cell
+	}
+	return cell
+}
+
+// Writes the table as an A4 PDF, repeating the header row on each page
+func renderPDF(t *table) ([]byte, error) {
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	pdf.SetMargins(10, 12, 10)
+	pdf.SetAutoPageBreak(false, 12)
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+
+	width := 190 / float64(len(t.columns))
+	// Cuts text that would spill into the next cell, after translating it
+	// to the single-byte font encoding
+	fit := func(s string) string {
+		s = tr(s)
+		for len(s) > 0 && pdf.GetStringWidth(s) > width-2 {
+			s = s[:len(s)-1]
+		}
+		return s
+	}
+	header := func() {
+		pdf.SetFont("Helvetica", "B", 9)
+		pdf.SetFillColor(230, 230, 230)
+		for _, col := range t.columns {
+			pdf.CellFormat(width, 7, fit(col), "1", 0, "L", true, 0, "")
+		}
+		pdf.Ln(-1)
+		pdf.SetFont("Helvetica", "", 9)
+	}
+
+	pdf.AddPage()
+	pdf.SetFont("Helvetica", "B", 14)
+	pdf.CellFormat(190, 8, tr(t.title), "", 1, "L", false, 0, "")
+	pdf.SetFont("Helvetica", "", 10)
+	pdf.CellFormat(190, 6, tr(t.period), "", 1, "L", false, 0, "")
+	pdf.CellFormat(190, 6, "Generated "+time.Now().UTC().Format("2 Jan 2006 15:04 UTC"), "", 1, "L", false, 0, "")
+	pdf.Ln(4)
+	header()
+
+	if len(t.rows) == 0 {
+		pdf.CellFormat(190, 7, "No data for this period", "1", 1, "L", false, 0, "")
+	}
+	for _, row := range t.rows {
+		if pdf.GetY() > 280 {
+			pdf.AddPage()
+			header()
+		}
+		for _, cell := range row {
+			pdf.CellFormat(width, 6, fit(cell), "1", 0, "L", false, 0, "")
+		}
+		pdf.Ln(-1)
+	}
+
+	var buf bytes.Buffer
+	err := pdf.Output(&buf)
+	return buf.Bytes(), err
+}
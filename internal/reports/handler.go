@@ -0,0 +1,191 @@
+// Package reports sends attendance and leave summaries on a schedule.
+// Definitions say what to report and who gets it; every generated file is
+// kept in the archive for download.
+package reports
+
+import (
+	"log"
+	"mime"
+	"strconv"
+	"time"
+
+	"postman-task/internal/core"
+	"postman-task/internal/storage"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Handles report definitions and the archive
+type Handler struct {
+	db    *gorm.DB
+	store storage.Store
+}
+
+// Creates new handler
+func NewHandler(db *gorm.DB, store storage.Store) *Handler {
+	return &Handler{db: db, store: store}
+}
+
+// Adds a scheduled report, admin only
+func (h *Handler) CreateDefinition(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	var data core.ReportDefinitionRequest
+	if err := c.ShouldBindJSON(&data); err != nil {
+		c.JSON(400, gin.H{"error": "Bad request"})
+		return
+	}
+
+	def := core.ReportDefinition{
+		Name:       data.Name,
+		Kind:       data.Kind,
+		Format:     data.Format,
+		Dept:       data.Dept,
+		Schedule:   data.Schedule,
+		Hour:       6,
+		Recipients: data.Recipients,
+		CreatedBy:  c.MustGet("user_id").(uint),
+	}
+	if def.Format == "" {
+		def.Format = "pdf"
+	}
+	if data.Hour != nil {
+		def.Hour = *data.Hour
+	}
+	def.NextRunAt = nextRun(&def, time.Now())
+
+	if err := db.Create(&def).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Could not save report"})
+		return
+	}
+
+	c.JSON(200, def)
+}
+
+// Lists scheduled reports, admin only
+func (h *Handler) GetDefinitions(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	var defs []core.ReportDefinition
+	if err := db.Order("id").Find(&defs).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch reports"})
+		return
+	}
+
+	c.JSON(200, defs)
+}
+
+// Stops a scheduled report, its archive is kept. Admin only.
+func (h *Handler) DeleteDefinition(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	result := db.Delete(&core.ReportDefinition{}, c.Param("id"))
+	if result.Error != nil {
+		c.JSON(500, gin.H{"error": "Could not delete report"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(404, gin.H{"error": "Report not found"})
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "Report deleted"})
+}
+
+// Generates a report now, for the last period of its schedule or for
+// ?from= and ?to=. It is emailed too unless ?email=false. Admin only.
+func (h *Handler) RunDefinition(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	var def core.ReportDefinition
+	if err := db.First(&def, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Report not found"})
+		return
+	}
+
+	from, to := period(def.Schedule, time.Now())
+	if c.Query("from") != "" || c.Query("to") != "" {
+		var err1, err2 error
+		from, err1 = time.Parse("2006-01-02", c.Query("from"))
+		to, err2 = time.Parse("2006-01-02", c.Query("to"))
+		if err1 != nil || err2 != nil {
+			c.JSON(400, gin.H{"error": "Invalid date format. Use YYYY-MM-DD for both from and to"})
+			return
+		}
+		if to.Before(from) {
+			c.JSON(400, gin.H{"error": "to must not be before from"})
+			return
+		}
+	}
+
+	userID := c.MustGet("user_id").(uint)
+	report, err := h.produce(c.Request.Context(), &def, from, to, &userID, c.Query("email") != "false")
+	if err != nil {
+		log.Printf("Report %d failed: %v", def.ID, err)
+		c.JSON(500, gin.H{"error": "Could not generate report"})
+		return
+	}
+
+	c.JSON(200, report)
+}
+
+// Lists generated reports, newest first, optionally for ?definition_id=.
+// Admin only.
+func (h *Handler) GetReports(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	page := 1
+	if p, err := strconv.Atoi(c.Query("page")); err == nil && p > 0 {
+		page = p
+	}
+	pageSize := 30
+
+	query := db.Model(&core.Report{})
+	if id := c.Query("definition_id"); id != "" {
+		query = query.Where("definition_id = ?", id)
+	}
+
+	var total int64
+	query.Count(&total)
+
+	var reports []core.Report
+	err := query.Order("created_at DESC").
+		Offset((page - 1) * pageSize).
+		Limit(pageSize).
+		Find(&reports).Error
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch reports"})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"data":  reports,
+		"page":  page,
+		"total": total,
+	})
+}
+
+// Downloads a generated report, admin only
+func (h *Handler) DownloadReport(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	var report core.Report
+	if err := db.First(&report, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Report not found"})
+		return
+	}
+
+	file, err := h.store.Get(c.Request.Context(), report.StorageKey)
+	if err != nil {
+		log.Printf("Failed to open report %d: %v", report.ID, err)
+		c.JSON(404, gin.H{"error": "Report not found"})
+		return
+	}
+	defer file.Close()
+
+	c.DataFromReader(200, report.Size, report.ContentType, file, map[string]string{
+		"Content-Disposition": mime.FormatMediaType("attachment", map[string]string{"filename": report.FileName}),
+		"Cache-Control":       "private, no-store",
+	})
+}
@@ -0,0 +1,230 @@
+package reports
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"postman-task/internal/auth"
+	"postman-task/internal/core"
+	"postman-task/internal/metrics"
+	email "postman-task/internal/notifications"
+	"postman-task/internal/storage"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// The day, week (Monday to Sunday) or month before at, which a report
+// sent at that time covers
+func period(schedule string, at time.Time) (from, to time.Time) {
+	day := at.UTC().Truncate(24 * time.Hour)
+	switch schedule {
+	case "weekly":
+		monday := day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+		return monday.AddDate(0, 0, -7), monday.AddDate(0, 0, -1)
+	case "monthly":
+		first := time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return first.AddDate(0, -1, 0), first.AddDate(0, 0, -1)
+	default:
+		return day.AddDate(0, 0, -1), day.AddDate(0, 0, -1)
+	}
+}
+
+// The first time after after that def is due: daily at its hour, weekly
+// on Mondays and monthly on the 1st
+func nextRun(def *core.ReportDefinition, after time.Time) time.Time {
+	day := after.UTC().Truncate(24 * time.Hour)
+	hour := time.Duration(def.Hour) * time.Hour
+	switch def.Schedule {
+	case "weekly":
+		t := day.AddDate(0, 0, -(int(day.Weekday())+6)%7).Add(hour)
+		if !t.After(after) {
+			t = t.AddDate(0, 0, 7)
+		}
+		return t
+	case "monthly":
+		t := time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, time.UTC).Add(hour)
+		if !t.After(after) {
+			t = t.AddDate(0, 1, 0)
+		}
+		return t
+	default:
+		t := day.Add(hour)
+		if !t.After(after) {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t
+	}
+}
+
+// Generates def's report for from to to, archives it and, if deliver is
+// set, emails it to the recipients. Delivery failures are kept on the
+// report rather than failing it.
+func (h *Handler) produce(ctx context.Context, def *core.ReportDefinition, from, to time.Time, createdBy *uint, deliver bool) (*core.Report, error) {
+	db := h.db.WithContext(ctx)
+
+	t, err := build(db, def, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	var data []byte
+	contentType := "text/csv"
+	if def.Format == "csv" {
+		data, err = renderCSV(t)
+	} else {
+		data, err = renderPDF(t)
+		contentType = "application/pdf"
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	_, random, err := auth.NewOpaqueToken()
+	if err != nil {
+		return nil, err
+	}
+	key := "reports/" + strconv.FormatUint(uint64(def.ID), 10) + "/" + random[:32]
+	if err := h.store.Put(ctx, key, bytes.NewReader(data), int64(len(data)), contentType); err != nil {
+		return nil, err
+	}
+
+	report := core.Report{
+		DefinitionID: def.ID,
+		Name:         def.Name,
+		Kind:         def.Kind,
+		Format:       def.Format,
+		Dept:         def.Dept,
+		PeriodStart:  from,
+		PeriodEnd:    to,
+		FileName:     fmt.Sprintf("%s-%s-%s.%s", def.Kind, from.Format("20060102"), to.Format("20060102"), def.Format),
+		ContentType:  contentType,
+		Size:         int64(len(data)),
+		StorageKey:   key,
+		CreatedBy:    createdBy,
+	}
+	if err := db.Create(&report).Error; err != nil {
+		if err := h.store.Delete(ctx, key); err != nil {
+			log.Printf("Failed to delete stored report %s: %v", key, err)
+		}
+		return nil, err
+	}
+
+	if !deliver {
+		return &report, nil
+	}
+
+	subject := fmt.Sprintf("%s: %s", def.Name, t.period)
+	body := fmt.Sprintf("Hello,\n\nAttached is the %s report \"%s\" for %s.\n\nThis report is sent %s. Contact an administrator to change its recipients.\n",
+		def.Kind, def.Name, t.period, def.Schedule)
+	file := email.Attachment{Name: report.FileName, ContentType: contentType, Data: data}
+
+	var failed []string
+	for _, recipient := range def.Recipients {
+		if err := email.SendWithAttachmentsContext(ctx, recipient, subject, body, file); err != nil {
+			log.Printf("Failed to email report %d to %s: %v", report.ID, recipient, err)
+			failed = append(failed, recipient)
+			continue
+		}
+		report.SentTo++
+	}
+	if len(failed) > 0 {
+		report.Error = "Could not email " + strings.Join(failed, ", ")
+	}
+	err = db.Model(&report).Updates(map[string]interface{}{"sent_to": report.SentTo, "error": report.Error}).Error
+	return &report, err
+}
+
+// Claims the definition due earliest, other than those in skip, and moves
+// it to its next run, so other instances skip it. Returns nil when nothing
+// is due.
+func (h *Handler) claimDue(ctx context.Context, now time.Time, skip []uint) (*core.ReportDefinition, time.Time, error) {
+	var def core.ReportDefinition
+	var due time.Time
+	err := h.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		query := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).Where("next_run_at <= ?", now)
+		if len(skip) > 0 {
+			query = query.Where("id NOT IN ?", skip)
+		}
+		if err := query.Order("next_run_at").First(&def).Error; err != nil {
+			return err
+		}
+		due = def.NextRunAt
+		def.NextRunAt = nextRun(&def, now)
+		return tx.Model(&def).Updates(map[string]interface{}{
+			"next_run_at": def.NextRunAt,
+			"last_run_at": now,
+		}).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, due, nil
+	}
+	if err != nil {
+		return nil, due, err
+	}
+	return &def, due, nil
+}
+
+// Hands a claimed definition back after a failed run so the next check
+// retries it, unless it was changed in the meantime
+func (h *Handler) releaseClaim(ctx context.Context, def *core.ReportDefinition, due time.Time) error {
+	return h.db.WithContext(ctx).Model(&core.ReportDefinition{}).
+		Where("id = ? AND next_run_at = ?", def.ID, def.NextRunAt).
+		Update("next_run_at", due).Error
+}
+
+// Sends every report that is due. Each covers the period before it was
+// due, so a late run still reports on the right days. A report that fails
+// stays due and is retried on the next check.
+func (h *Handler) runDue(ctx context.Context) (int, error) {
+	sent := 0
+	var failed []uint
+	for {
+		def, due, err := h.claimDue(ctx, time.Now(), failed)
+		if err != nil || def == nil {
+			return sent, err
+		}
+
+		from, to := period(def.Schedule, due)
+		if _, err := h.produce(ctx, def, from, to, nil, true); err != nil {
+			log.Printf("Scheduled report %d failed, retrying on the next check: %v", def.ID, err)
+			failed = append(failed, def.ID)
+			if err := h.releaseClaim(ctx, def, due); err != nil {
+				log.Printf("Failed to release scheduled report %d, its run is skipped: %v", def.ID, err)
+			}
+			continue
+		}
+		sent++
+	}
+}
+
+// Sends due reports every interval
+func Run(ctx context.Context, db *gorm.DB, store storage.Store, interval time.Duration) {
+	h := &Handler{db: db, store: store}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			start := time.Now()
+			sent, err := h.runDue(ctx)
+			metrics.JobRun("scheduled_reports", start, err)
+			if err != nil {
+				log.Printf("Scheduled reports failed: %v", err)
+				continue
+			}
+			if sent > 0 {
+				log.Printf("Scheduled reports: %d sent", sent)
+			}
+		}
+	}
+}
@@ -0,0 +1,318 @@
+// Package rollup keeps daily aggregates of attendance and leave so the
+// analytics endpoints don't recount the source tables on every load.
+// Days are recomputed whole, from the rows changed since the last refresh,
+// and Rebuild recomputes any range for backfills.
+package rollup
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"postman-task/internal/metrics"
+	"postman-task/pkg/config"
+
+	"gorm.io/gorm"
+)
+
+// A student's attendance on a day, scored with the status policy like the
+// stats: half-day entries left by partial leaves take half a day each.
+// Dept and course are the student's at the time of the refresh.
+type StudentDay struct {
+	Date      time.Time `gorm:"primaryKey"`
+	StudentID uint      `gorm:"primaryKey;autoIncrement:false;index"`
+	Dept      string    `gorm:"not null;index"`
+	Course    string    `gorm:"not null;default:''"`
+	Present   float64   `gorm:"not null;default:0"`
+	Counted   float64   `gorm:"not null;default:0"` // the part of the day not excluded
+	Excluded  float64   `gorm:"not null;default:0"`
+}
+
+func (StudentDay) TableName() string {
+	return "rollup_student_days"
+}
+
+// A department's attendance on a day
+type DeptDay struct {
+	Date     time.Time `gorm:"primaryKey"`
+	Dept     string    `gorm:"primaryKey"`
+	Students int       `gorm:"not null;default:0"` // students marked that day
+	Present  float64   `gorm:"not null;default:0"`
+	Counted  float64   `gorm:"not null;default:0"`
+	Excluded float64   `gorm:"not null;default:0"`
+}
+
+func (DeptDay) TableName() string {
+	return "rollup_dept_days"
+}
+
+// A course's attendance in a department on a day
+type CourseDay struct {
+	Date     time.Time `gorm:"primaryKey"`
+	Dept     string    `gorm:"primaryKey"`
+	Course   string    `gorm:"primaryKey"`
+	Students int       `gorm:"not null;default:0"`
+	Present  float64   `gorm:"not null;default:0"`
+	Counted  float64   `gorm:"not null;default:0"`
+	Excluded float64   `gorm:"not null;default:0"`
+}
+
+func (CourseDay) TableName() string {
+	return "rollup_course_days"
+}
+
+// Leaves applied for on a day, by department, type and current status
+type LeaveDay struct {
+	Date      time.Time `gorm:"primaryKey"`
+	Dept      string    `gorm:"primaryKey"`
+	LeaveType string    `gorm:"primaryKey"`
+	Status    string    `gorm:"primaryKey"`
+	Count     int       `gorm:"not null;default:0"`
+	Hours     float64   `gorm:"not null;default:0"`
+}
+
+func (LeaveDay) TableName() string {
+	return "rollup_leave_days"
+}
+
+// When the rollups were last brought up to date
+type State struct {
+	Name        string    `gorm:"primaryKey"`
+	RefreshedAt time.Time `gorm:"not null"`
+}
+
+func (State) TableName() string {
+	return "rollup_state"
+}
+
+const stateName = "daily"
+
+// Rows changed this close to the last refresh are picked up again, in case
+// their transaction committed after it
+const overlap = time.Minute
+
+// Creates the rollup tables
+func Migrate(db *gorm.DB) error {
+	return db.AutoMigrate(&StudentDay{}, &DeptDay{}, &CourseDay{}, &LeaveDay{}, &State{})
+}
+
+// Recomputes the rollups of every day from from to to, inclusive
+func Refresh(ctx context.Context, db *gorm.DB, policy config.AttendanceConfig, from, to time.Time) error {
+	presentList, presentArgs := statusList(policy.PresentStatuses)
+	excludedList, excludedArgs := statusList(policy.ExcludedStatuses)
+	end := to.AddDate(0, 0, 1)
+
+	return db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, model := range []interface{}{&StudentDay{}, &DeptDay{}, &CourseDay{}, &LeaveDay{}} {
+			if err := tx.Where("date >= ? AND date < ?", from, end).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+
+		// Scored as in attendance.scoreDays: an excluded day is out whole,
+		// otherwise each half-day entry left by a partial leave takes half
+		// off a present day and excluded halves come off the total
+		var args []interface{}
+		args = append(append(append(args, presentArgs...), excludedArgs...), from, end)
+		args = append(append(append(args, excludedArgs...), excludedArgs...), presentArgs...)
+		err := tx.Exec(`INSERT INTO rollup_student_days (date, student_id, dept, course, present, counted, excluded)
+			WITH days AS (
+				SELECT date, student_id,
+					MAX(CASE WHEN session = 'full' THEN status END) AS status,
+					SUM(CASE WHEN session <> 'full' AND status NOT IN (`+presentList+`) THEN 0.5 ELSE 0 END) AS halves_away,
+					SUM(CASE WHEN session <> 'full' AND status IN (`+excludedList+`) THEN 0.5 ELSE 0 END) AS halves_excluded
+				FROM attendances
+				WHERE deleted_at IS NULL AND date >= ? AND date < ?
+				GROUP BY date, student_id
+			), scored AS (
+				SELECT date, student_id,
+					CASE WHEN status IN (`+excludedList+`) THEN 1 ELSE halves_excluded END AS excluded,
+					CASE WHEN status IN (`+excludedList+`) THEN 0
+						WHEN status IN (`+presentList+`) THEN GREATEST(1 - halves_away, 0)
+						ELSE 0 END AS present
+				FROM days
+			)
+			SELECT s.date, s.student_id, u.dept, u.course, s.present, GREATEST(1 - s.excluded, 0), s.excluded
+			FROM scored s JOIN users u ON u.id = s.student_id`, args...).Error
+		if err != nil {
+			return err
+		}
+
+		err = tx.Exec(`INSERT INTO rollup_dept_days (date, dept, students, present, counted, excluded)
+			SELECT date, dept, COUNT(*), SUM(present), SUM(counted), SUM(excluded)
+			FROM rollup_student_days WHERE date >= ? AND date < ?
+			GROUP BY date, dept`, from, end).Error
+		if err != nil {
+			return err
+		}
+
+		err = tx.Exec(`INSERT INTO rollup_course_days (date, dept, course, students, present, counted, excluded)
+			SELECT date, dept, course, COUNT(*), SUM(present), SUM(counted), SUM(excluded)
+			FROM rollup_student_days WHERE date >= ? AND date < ?
+			GROUP BY date, dept, course`, from, end).Error
+		if err != nil {
+			return err
+		}
+
+		// Leaves count on the UTC day they were applied for
+		return tx.Exec(`INSERT INTO rollup_leave_days (date, dept, leave_type, status, count, hours)
+			SELECT date_trunc('day', l.created_at AT TIME ZONE 'UTC') AT TIME ZONE 'UTC' AS day,
+				u.dept, l.leave_type, l.status, COUNT(*), COALESCE(SUM(l.hours), 0)
+			FROM leave_requests l JOIN users u ON u.id = l.student_id
+			WHERE l.deleted_at IS NULL AND l.created_at >= ? AND l.created_at < ?
+			GROUP BY 1, 2, 3, 4`, from, end).Error
+	})
+}
+
+// Recomputes the rollups from from to to a month at a time. A zero from
+// starts at the earliest attendance or leave, a zero to ends today. Only a
+// full rebuild counts as a refresh, a partial one leaves other changed days
+// to the next Update.
+func Rebuild(ctx context.Context, db *gorm.DB, policy config.AttendanceConfig, from, to time.Time) error {
+	db = db.WithContext(ctx)
+	start := time.Now()
+	full := from.IsZero() && to.IsZero()
+
+	if from.IsZero() {
+		var earliest sql.NullTime
+		err := db.Raw(`SELECT LEAST(
+				(SELECT MIN(date) FROM attendances),
+				(SELECT MIN(created_at) FROM leave_requests))`).Row().Scan(&earliest)
+		if err != nil {
+			return err
+		}
+		if !earliest.Valid {
+			if full {
+				return markRefreshed(db, start)
+			}
+			return nil
+		}
+		from = earliest.Time
+	}
+	if to.IsZero() {
+		to = time.Now()
+	}
+	from = from.UTC().Truncate(24 * time.Hour)
+	to = to.UTC().Truncate(24 * time.Hour)
+
+	for chunk := from; !chunk.After(to); {
+		end := chunk.AddDate(0, 1, -1)
+		if end.After(to) {
+			end = to
+		}
+		if err := Refresh(ctx, db, policy, chunk, end); err != nil {
+			return err
+		}
+		chunk = end.AddDate(0, 0, 1)
+	}
+	if full {
+		return markRefreshed(db, start)
+	}
+	return nil
+}
+
+// Recomputes the days with attendance or leaves changed since the last
+// refresh, and the days of students whose department or course changed
+// since. Rebuilds everything the first time.
+func Update(ctx context.Context, db *gorm.DB, policy config.AttendanceConfig) (int, error) {
+	db = db.WithContext(ctx)
+	start := time.Now()
+
+	var state State
+	err := db.First(&state, "name = ?", stateName).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, Rebuild(ctx, db, policy, time.Time{}, time.Time{})
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// A student moved to another department or course since shows up as
+	// rollup rows that no longer match them, their days are relabelled
+	since := state.RefreshedAt.Add(-overlap)
+	rows, err := db.Raw(`SELECT date FROM attendances WHERE updated_at > ? OR deleted_at > ?
+		UNION
+		SELECT date_trunc('day', created_at AT TIME ZONE 'UTC') AT TIME ZONE 'UTC'
+		FROM leave_requests WHERE updated_at > ? OR deleted_at > ?
+		UNION
+		SELECT r.date FROM rollup_student_days r JOIN users u ON u.id = r.student_id
+		WHERE u.updated_at > ? AND (r.dept <> u.dept OR r.course <> u.course)
+		UNION
+		SELECT date_trunc('day', l.created_at AT TIME ZONE 'UTC') AT TIME ZONE 'UTC'
+		FROM leave_requests l JOIN users u ON u.id = l.student_id
+		WHERE u.updated_at > ? AND EXISTS (SELECT 1 FROM rollup_student_days r
+			WHERE r.student_id = u.id AND r.dept <> u.dept)`,
+		since, since, since, since, since, since).Rows()
+	if err != nil {
+		return 0, err
+	}
+	var days []time.Time
+	for rows.Next() {
+		var day time.Time
+		if err := rows.Scan(&day); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		days = append(days, day)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, day := range days {
+		if err := Refresh(ctx, db, policy, day, day); err != nil {
+			return 0, err
+		}
+	}
+	return len(days), markRefreshed(db, start)
+}
+
+func markRefreshed(db *gorm.DB, at time.Time) error {
+	return db.Save(&State{Name: stateName, RefreshedAt: at}).Error
+}
+
+// When the rollups were last brought up to date, zero if never
+func RefreshedAt(db *gorm.DB) (time.Time, error) {
+	var state State
+	err := db.First(&state, "name = ?", stateName).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return time.Time{}, nil
+	}
+	return state.RefreshedAt, err
+}
+
+// The SQL list of statuses as placeholders and their args
+func statusList(statuses []string) (string, []interface{}) {
+	if len(statuses) == 0 {
+		return "''", nil
+	}
+	args := make([]interface{}, len(statuses))
+	for i, s := range statuses {
+		args[i] = s
+	}
+	return strings.TrimSuffix(strings.Repeat("?,", len(statuses)), ","), args
+}
+
+// Brings the rollups up to date every interval
+func Run(ctx context.Context, db *gorm.DB, policy config.AttendanceConfig, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			start := time.Now()
+			_, err := Update(ctx, db, policy)
+			metrics.JobRun("analytics_rollup", start, err)
+			if err != nil {
+				log.Printf("Analytics rollup failed: %v", err)
+			}
+		}
+	}
+}
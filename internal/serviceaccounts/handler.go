@@ -0,0 +1,286 @@
+// Package serviceaccounts manages non-human accounts, such as the gate
+// kiosk or LMS sync scripts, and the API keys they authenticate with.
+package serviceaccounts
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"postman-task/internal/auth"
+	"postman-task/internal/core"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Role given to service accounts
+const Role = "service"
+
+var (
+	errInvalidKey = errors.New("invalid api key")
+	nonSlug       = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+type Handler struct {
+	db *gorm.DB
+}
+
+// Creates new handler
+func NewHandler(db *gorm.DB) *Handler {
+	return &Handler{db: db}
+}
+
+// Checks API keys against the database and records their last use
+func NewKeyCheck(db *gorm.DB) auth.APIKeyCheck {
+	return func(ctx context.Context, key, clientIP string) (*auth.APIKeyPrincipal, error) {
+		prefix, err := auth.APIKeyPrefix(key)
+		if err != nil {
+			return nil, err
+		}
+
+		// Deleted accounts aren't preloaded, leaving User empty
+		var k core.APIKey
+		err = db.WithContext(ctx).Preload("User").Where("prefix = ?", prefix).First(&k).Error
+		if err != nil {
+			return nil, errInvalidKey
+		}
+		if subtle.ConstantTimeCompare([]byte(auth.HashOpaqueToken(key)), []byte(k.KeyHash)) != 1 {
+			return nil, errInvalidKey
+		}
+
+		now := time.Now()
+		if k.RevokedAt != nil || (k.ExpiresAt != nil && k.ExpiresAt.Before(now)) {
+			return nil, errInvalidKey
+		}
+		if k.User.ID == 0 || k.User.Role != Role || k.User.DeactivatedAt != nil {
+			return nil, errInvalidKey
+		}
+
+		// At most one write a minute per key
+		db.WithContext(ctx).Model(&core.APIKey{}).
+			Where("id = ? AND (last_used_at IS NULL OR last_used_at < ?)", k.ID, now.Add(-time.Minute)).
+			Updates(map[string]interface{}{"last_used_at": now, "last_used_ip": clientIP})
+
+		return &auth.APIKeyPrincipal{
+			KeyID:  k.ID,
+			UserID: k.UserID,
+			Role:   k.User.Role,
+			Scopes: k.Scopes,
+		}, nil
+	}
+}
+
+// Finds a service account by the :id param
+func (h *Handler) findAccount(c *gin.Context, db *gorm.DB) (*core.User, bool) {
+	var account core.User
+	if err := db.Where("role = ?", Role).First(&account, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Service account not found"})
+		return nil, false
+	}
+	return &account, true
+}
+
+// Lists the scopes keys can be given, admin only
+func (h *Handler) GetScopes(c *gin.Context) {
+	scopes := make([]gin.H, 0, len(auth.Scopes))
+	for name, routes := range auth.Scopes {
+		scopes = append(scopes, gin.H{"scope": name, "routes": routes})
+	}
+	sort.Slice(scopes, func(i, j int) bool {
+		return scopes[i]["scope"].(string) < scopes[j]["scope"].(string)
+	})
+	c.JSON(200, gin.H{"scopes": scopes})
+}
+
+// Creates a service account, admin only
+func (h *Handler) CreateServiceAccount(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	var data core.ServiceAccountRequest
+	if err := c.ShouldBindJSON(&data); err != nil {
+		c.JSON(400, gin.H{"error": "Bad request"})
+		return
+	}
+
+	slug := strings.Trim(nonSlug.ReplaceAllString(strings.ToLower(data.Name), "-"), "-")
+	if slug == "" {
+		c.JSON(400, gin.H{"error": "Name must contain letters or digits"})
+		return
+	}
+	if data.Dept == "" {
+		data.Dept = "Services"
+	}
+
+	// Service accounts have no usable password
+	random, _, err := auth.NewOpaqueToken()
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Server error"})
+		return
+	}
+	hash, err := auth.HashPassword(random)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Server error"})
+		return
+	}
+
+	// Deleted accounts still hold their email
+	email := slug + "@service.invalid"
+	var existing core.User
+	db.Unscoped().Where("email = ?", email).First(&existing)
+	if existing.ID != 0 {
+		c.JSON(400, gin.H{"error": "Service account name already in use"})
+		return
+	}
+
+	now := time.Now()
+	account := core.User{
+		Name:            data.Name,
+		Email:           email,
+		Password:        hash,
+		Role:            Role,
+		Dept:            data.Dept,
+		EmailVerifiedAt: &now,
+	}
+	if err := db.Create(&account).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Could not create service account"})
+		return
+	}
+
+	account.Password = ""
+	c.JSON(200, account)
+}
+
+// Lists service accounts with their keys, admin only
+func (h *Handler) GetServiceAccounts(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	var accounts []core.User
+	db.Where("role = ?", Role).Order("name").Find(&accounts)
+
+	ids := make([]uint, len(accounts))
+	for i, a := range accounts {
+		ids[i] = a.ID
+	}
+	var keys []core.APIKey
+	db.Where("user_id IN ?", ids).Order("created_at DESC").Find(&keys)
+
+	byAccount := make(map[uint][]core.APIKey)
+	for _, k := range keys {
+		byAccount[k.UserID] = append(byAccount[k.UserID], k)
+	}
+
+	items := make([]gin.H, len(accounts))
+	for i, a := range accounts {
+		a.Password = ""
+		accountKeys := byAccount[a.ID]
+		if accountKeys == nil {
+			accountKeys = []core.APIKey{}
+		}
+		items[i] = gin.H{"account": a, "keys": accountKeys}
+	}
+	c.JSON(200, gin.H{"items": items})
+}
+
+// Deletes a service account and revokes its keys, admin only
+func (h *Handler) DeleteServiceAccount(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	account, ok := h.findAccount(c, db)
+	if !ok {
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&core.APIKey{}).
+			Where("user_id = ? AND revoked_at IS NULL", account.ID).
+			Update("revoked_at", time.Now()).Error
+		if err != nil {
+			return err
+		}
+		return tx.Delete(account).Error
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Could not delete service account"})
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "Service account deleted"})
+}
+
+// Issues a new API key, shown only in this response, admin only
+func (h *Handler) CreateAPIKey(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	var data core.APIKeyRequest
+	if err := c.ShouldBindJSON(&data); err != nil {
+		c.JSON(400, gin.H{"error": "Bad request"})
+		return
+	}
+	for _, scope := range data.Scopes {
+		if _, ok := auth.Scopes[scope]; !ok {
+			c.JSON(400, gin.H{"error": "Unknown scope " + scope})
+			return
+		}
+	}
+
+	account, ok := h.findAccount(c, db)
+	if !ok {
+		return
+	}
+
+	key, prefix, hash, err := auth.NewAPIKey()
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Server error"})
+		return
+	}
+
+	apiKey := core.APIKey{
+		UserID:  account.ID,
+		Name:    data.Name,
+		Prefix:  prefix,
+		KeyHash: hash,
+		Scopes:  data.Scopes,
+	}
+	if data.ExpiresInDays > 0 {
+		expires := time.Now().AddDate(0, 0, data.ExpiresInDays)
+		apiKey.ExpiresAt = &expires
+	}
+	if err := db.Create(&apiKey).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Could not create API key"})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"key":     key,
+		"api_key": apiKey,
+	})
+}
+
+// Revokes an API key, admin only
+func (h *Handler) RevokeAPIKey(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	account, ok := h.findAccount(c, db)
+	if !ok {
+		return
+	}
+
+	result := db.Model(&core.APIKey{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", c.Param("key_id"), account.ID).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		c.JSON(500, gin.H{"error": "Could not revoke API key"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(404, gin.H{"error": "API key not found or already revoked"})
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "API key revoked"})
+}
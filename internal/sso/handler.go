@@ -0,0 +1,64 @@
+package sso
+
+import (
+	"errors"
+	"log"
+	"sync"
+
+	"postman-task/internal/core"
+	"postman-task/pkg/config"
+
+	"github.com/crewjam/saml"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Finishes a login for a resolved user the same way as a password login,
+// including the second factor
+type LoginFunc func(c *gin.Context, user *core.User)
+
+// Handles single sign-on through OIDC and SAML
+type Handler struct {
+	db          *gorm.DB
+	login       LoginFunc
+	cfg         config.SSOConfig
+	provisioner *Provisioner
+
+	// Providers are set up on first use so the API starts without the IdP
+	mu   sync.Mutex
+	oidc *oidcClient
+	saml *saml.ServiceProvider
+}
+
+// Creates a new SSO handler
+func NewHandler(db *gorm.DB, login LoginFunc, cfg *config.Config) *Handler {
+	if cfg.SSO.OIDC.Enabled || cfg.SSO.SAML.Enabled {
+		if err := db.AutoMigrate(&State{}); err != nil {
+			log.Printf("SSO state migration failed: %v", err)
+		}
+	}
+
+	return &Handler{
+		db:          db,
+		login:       login,
+		cfg:         cfg.SSO,
+		provisioner: NewProvisioner(db, cfg.SSO.Provisioning),
+	}
+}
+
+// Signs in the user behind id, with the same second factor and token as
+// the password login
+func (h *Handler) completeLogin(c *gin.Context, id Identity) {
+	user, err := h.provisioner.ResolveUser(c.Request.Context(), id)
+	if errors.Is(err, ErrNotProvisioned) || errors.Is(err, ErrDeactivated) || errors.Is(err, ErrPrivileged) {
+		c.JSON(403, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("SSO login for %s subject %s failed: %v", id.Provider, id.Subject, err)
+		c.JSON(401, gin.H{"error": "Could not sign in with identity provider"})
+		return
+	}
+
+	h.login(c, user)
+}
@@ -0,0 +1,161 @@
+package sso
+
+import (
+	"context"
+	"fmt"
+
+	"postman-task/internal/auth"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/oauth2"
+)
+
+type oidcClient struct {
+	verifier *oidc.IDTokenVerifier
+	oauth    oauth2.Config
+}
+
+// Discovers the provider on first use and caches the client
+func (h *Handler) oidcClient(ctx context.Context) (*oidcClient, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.oidc != nil {
+		return h.oidc, nil
+	}
+
+	cfg := h.cfg.OIDC
+	provider, err := oidc.NewProvider(ctx, cfg.Issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	h.oidc = &oidcClient{
+		verifier: provider.Verifier(&oidc.Config{ClientID: cfg.ClientID}),
+		oauth: oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       cfg.Scopes,
+		},
+	}
+	return h.oidc, nil
+}
+
+// Redirects to the provider using the authorization code flow with PKCE
+func (h *Handler) OIDCLogin(c *gin.Context) {
+	if !h.cfg.OIDC.Enabled {
+		c.JSON(404, gin.H{"error": "OIDC login is not enabled"})
+		return
+	}
+
+	client, err := h.oidcClient(c.Request.Context())
+	if err != nil {
+		c.JSON(502, gin.H{"error": "Identity provider unavailable"})
+		return
+	}
+
+	state, _, err1 := auth.NewOpaqueToken()
+	nonce, _, err2 := auth.NewOpaqueToken()
+	if err1 != nil || err2 != nil {
+		c.JSON(500, gin.H{"error": "Server error"})
+		return
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	err = saveState(c.Request.Context(), h.db, State{
+		State:    state,
+		Provider: "oidc",
+		Verifier: verifier,
+		Nonce:    nonce,
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Server error"})
+		return
+	}
+
+	url := client.oauth.AuthCodeURL(state, oauth2.S256ChallengeOption(verifier), oidc.Nonce(nonce))
+	c.Redirect(302, url)
+}
+
+// Finishes the login when the provider redirects back
+func (h *Handler) OIDCCallback(c *gin.Context) {
+	if !h.cfg.OIDC.Enabled {
+		c.JSON(404, gin.H{"error": "OIDC login is not enabled"})
+		return
+	}
+	ctx := c.Request.Context()
+
+	if e := c.Query("error"); e != "" {
+		c.JSON(401, gin.H{"error": "Identity provider returned " + e})
+		return
+	}
+
+	state, err := takeState(ctx, h.db, c.Query("state"), "oidc")
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid or expired login state"})
+		return
+	}
+
+	client, err := h.oidcClient(ctx)
+	if err != nil {
+		c.JSON(502, gin.H{"error": "Identity provider unavailable"})
+		return
+	}
+
+	// Swap the code for tokens, proving we started the flow
+	token, err := client.oauth.Exchange(ctx, c.Query("code"), oauth2.VerifierOption(state.Verifier))
+	if err != nil {
+		c.JSON(401, gin.H{"error": "Could not exchange authorization code"})
+		return
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		c.JSON(401, gin.H{"error": "No id_token in token response"})
+		return
+	}
+	idToken, err := client.verifier.Verify(ctx, rawIDToken)
+	if err != nil || idToken.Nonce != state.Nonce {
+		c.JSON(401, gin.H{"error": "Invalid id_token"})
+		return
+	}
+
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		c.JSON(401, gin.H{"error": "Invalid id_token"})
+		return
+	}
+
+	id := Identity{
+		Provider: "oidc",
+		Subject:  idToken.Subject,
+		Claims:   flattenClaims(claims),
+	}
+	id.Email = id.Claim(h.cfg.Provisioning.EmailClaim)
+	id.Name = id.Claim(h.cfg.Provisioning.NameClaim)
+	id.EmailVerified, _ = claims["email_verified"].(bool)
+
+	h.completeLogin(c, id)
+}
+
+// Turns JSON claims into string lists so rules can match any of them
+func flattenClaims(claims map[string]interface{}) map[string][]string {
+	out := make(map[string][]string, len(claims))
+	for k, v := range claims {
+		switch v := v.(type) {
+		case string:
+			out[k] = []string{v}
+		case []interface{}:
+			for _, item := range v {
+				out[k] = append(out[k], fmt.Sprint(item))
+			}
+		case nil:
+		default:
+			out[k] = []string{fmt.Sprint(v)}
+		}
+	}
+	return out
+}
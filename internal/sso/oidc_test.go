@@ -0,0 +1,220 @@
+package sso
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"postman-task/internal/auth"
+	"postman-task/internal/core"
+	"postman-task/internal/sso/mockidp"
+	"postman-task/internal/users"
+	"postman-task/pkg/config"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Connects to the database in TEST_DATABASE_URL, login state and users
+// live in postgres
+func testDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	db, err := gorm.Open(postgres.Open(url), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AutoMigrate(&core.User{}, &core.ExternalIdentity{}, &core.TwoFactorPolicy{},
+		&core.TwoFactorChallenge{}, &State{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+type oidcFixture struct {
+	db    *gorm.DB
+	jwt   *auth.JWTManager
+	idp   *mockidp.Server
+	api   *httptest.Server
+	email string
+}
+
+// Serves the OIDC routes with the mock provider as the issuer
+func newOIDCFixture(t *testing.T) *oidcFixture {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	db := testDB(t)
+
+	// A fresh email per run so runs don't see each other's users
+	email := fmt.Sprintf("oidc-%d@example.com", time.Now().UnixNano())
+	t.Cleanup(func() {
+		db.Unscoped().Where("user_id IN (?)", db.Unscoped().Model(&core.User{}).Select("id").Where("email = ?", email)).
+			Delete(&core.ExternalIdentity{})
+		db.Unscoped().Where("email = ?", email).Delete(&core.User{})
+	})
+
+	idp, err := mockidp.New("campus-api", "mock-secret", mockidp.User{Subject: "sub-" + email, Email: email, Name: "Ada"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	idpServer := httptest.NewServer(idp)
+	t.Cleanup(idpServer.Close)
+	idp.Issuer = idpServer.URL
+
+	jwt := auth.NewJWTManager(config.JWTConfig{
+		SecretKey: "test-secret",
+		Algorithm: "HS256",
+		Issuer:    "campus-api",
+		Audience:  "campus-api",
+		TokenTTL:  time.Hour,
+	})
+
+	r := gin.New()
+	api := httptest.NewServer(r)
+	t.Cleanup(api.Close)
+
+	cfg := &config.Config{TwoFactor: config.TwoFactorConfig{ChallengeTTL: time.Minute}, SSO: config.SSOConfig{
+		OIDC: config.OIDCConfig{
+			Enabled:      true,
+			Issuer:       idpServer.URL,
+			ClientID:     "campus-api",
+			ClientSecret: "mock-secret",
+			RedirectURL:  api.URL + "/callback",
+			Scopes:       []string{"openid", "email", "profile"},
+		},
+		Provisioning: config.ProvisioningConfig{
+			JIT:         true,
+			DefaultRole: "student",
+			DefaultDept: "General",
+			EmailClaim:  "email",
+			NameClaim:   "name",
+		},
+	}}
+	h := NewHandler(db, users.NewUserHandler(db, jwt, nil, nil, cfg).CompleteLogin, cfg)
+	r.GET("/login", h.OIDCLogin)
+	r.GET("/callback", h.OIDCCallback)
+
+	return &oidcFixture{db: db, jwt: jwt, idp: idp, api: api, email: email}
+}
+
+// Runs the whole redirect dance and returns the final status and body
+func (f *oidcFixture) login(t *testing.T) (int, map[string]interface{}) {
+	t.Helper()
+	resp, err := http.Get(f.api.URL + "/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var body map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("callback did not return JSON: %v", err)
+	}
+	return resp.StatusCode, body
+}
+
+func TestOIDCLoginCreatesAndReusesUser(t *testing.T) {
+	f := newOIDCFixture(t)
+
+	code, body := f.login(t)
+	if code != 200 {
+		t.Fatalf("first login: status %d, body %v", code, body)
+	}
+	claims, err := f.jwt.ValidateToken(body["token"].(string))
+	if err != nil {
+		t.Fatalf("returned token is invalid: %v", err)
+	}
+
+	var user core.User
+	if err := f.db.Where("email = ?", f.email).First(&user).Error; err != nil {
+		t.Fatalf("user was not provisioned: %v", err)
+	}
+	if claims.UserID != user.ID || user.Role != "student" {
+		t.Fatalf("token for user %d role %s, want %d student", claims.UserID, user.Role, user.ID)
+	}
+	if user.EmailVerifiedAt == nil {
+		t.Fatal("email verified by the provider was not marked verified")
+	}
+
+	// Same subject again is the same user, not a second account
+	code, body = f.login(t)
+	if code != 200 {
+		t.Fatalf("second login: status %d, body %v", code, body)
+	}
+	var count int64
+	f.db.Model(&core.User{}).Where("email = ?", f.email).Count(&count)
+	if count != 1 {
+		t.Fatalf("%d users with the email, want 1", count)
+	}
+}
+
+func TestOIDCLoginLinking(t *testing.T) {
+	tests := []struct {
+		name     string
+		role     string
+		verified bool
+		want     int
+	}{
+		{"verified email links", "faculty", true, 200},
+		{"unverified email does not link", "faculty", false, 401},
+		{"admin is never linked", "admin", true, 403},
+		{"service account is never linked", "service", true, 403},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newOIDCFixture(t)
+			existing := core.User{Name: "Existing", Email: f.email, Role: tt.role, Dept: "CS"}
+			if err := f.db.Create(&existing).Error; err != nil {
+				t.Fatal(err)
+			}
+			f.idp.SetUser(mockidp.User{
+				Subject: "sub-" + f.email,
+				Email:   f.email,
+				Name:    "Ada",
+				Claims:  map[string]interface{}{"email_verified": tt.verified},
+			})
+
+			code, body := f.login(t)
+			if code != tt.want {
+				t.Fatalf("status %d, want %d, body %v", code, tt.want, body)
+			}
+
+			var links int64
+			f.db.Model(&core.ExternalIdentity{}).Where("user_id = ?", existing.ID).Count(&links)
+			if linked := links > 0; linked != (tt.want == 200) {
+				t.Fatalf("linked = %v, want %v", linked, tt.want == 200)
+			}
+		})
+	}
+}
+
+func TestOIDCLoginAsksForSecondFactor(t *testing.T) {
+	f := newOIDCFixture(t)
+	now := time.Now()
+	existing := core.User{Name: "Existing", Email: f.email, Role: "faculty", Dept: "CS", TwoFactorEnabledAt: &now}
+	if err := f.db.Create(&existing).Error; err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.db.Where("user_id = ?", existing.ID).Delete(&core.TwoFactorChallenge{}) })
+
+	code, body := f.login(t)
+	if code != 200 {
+		t.Fatalf("status %d, body %v", code, body)
+	}
+	if body["two_factor_required"] != true || body["challenge_token"] == nil {
+		t.Fatalf("expected a two-factor challenge, got %v", body)
+	}
+	if _, ok := body["token"]; ok {
+		t.Fatal("token issued before the second factor")
+	}
+}
@@ -0,0 +1,181 @@
+package sso
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"postman-task/internal/core"
+	"postman-task/pkg/config"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrNotProvisioned = errors.New("no account exists for this identity")
+	ErrDeactivated    = errors.New("account is deactivated")
+	ErrPrivileged     = errors.New("admin and service accounts can't be linked by email")
+)
+
+// A user as described by an external identity provider
+type Identity struct {
+	Provider      string // "oidc", "saml" or "ldap"
+	Subject       string // stable id at the provider
+	Email         string
+	EmailVerified bool
+	Name          string
+	Claims        map[string][]string // every claim or attribute, as strings
+}
+
+// Looks up one claim value
+func (id Identity) Claim(name string) string {
+	if name == "" || len(id.Claims[name]) == 0 {
+		return ""
+	}
+	return id.Claims[name][0]
+}
+
+// Maps external identities to users, creating them if allowed
+type Provisioner struct {
+	db  *gorm.DB
+	cfg config.ProvisioningConfig
+}
+
+func NewProvisioner(db *gorm.DB, cfg config.ProvisioningConfig) *Provisioner {
+	return &Provisioner{db: db, cfg: cfg}
+}
+
+// Picks a role using the first matching rule, or "" if none match
+func (p *Provisioner) MapRole(id Identity) string {
+	for _, rule := range p.cfg.RoleRules {
+		for _, v := range id.Claims[rule.Claim] {
+			if strings.EqualFold(v, rule.Value) {
+				return rule.Role
+			}
+		}
+	}
+	return ""
+}
+
+// Finds the user linked to id. Unlinked identities are linked to the user
+// with the same verified email, except admin and service accounts, or a
+// new user is created when JIT is on.
+func (p *Provisioner) ResolveUser(ctx context.Context, id Identity) (*core.User, error) {
+	db := p.db.WithContext(ctx)
+
+	if id.Subject == "" {
+		return nil, errors.New("identity has no subject")
+	}
+
+	var user core.User
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// Already linked
+		var link core.ExternalIdentity
+		err := tx.Where("provider = ? AND subject = ?", id.Provider, id.Subject).First(&link).Error
+		if err == nil {
+			if err := tx.First(&user, link.UserID).Error; err != nil {
+				return ErrNotProvisioned
+			}
+			return p.syncRole(tx, &user, id)
+		}
+		if err != gorm.ErrRecordNotFound {
+			return err
+		}
+
+		if id.Email == "" {
+			return errors.New("identity has no email")
+		}
+
+		// Link to an existing account, only when the provider vouches for the email
+		err = tx.Where("email = ?", id.Email).First(&user).Error
+		switch {
+		case err == nil:
+			if !id.EmailVerified {
+				return fmt.Errorf("email %s is not verified by the identity provider", id.Email)
+			}
+			// Whoever controls the email at the IdP would get these accounts
+			if user.Role == "admin" || user.Role == "service" {
+				return ErrPrivileged
+			}
+			if err := p.syncRole(tx, &user, id); err != nil {
+				return err
+			}
+		case err == gorm.ErrRecordNotFound:
+			if !p.cfg.JIT {
+				return ErrNotProvisioned
+			}
+			if err := p.create(tx, &user, id); err != nil {
+				return err
+			}
+		default:
+			return err
+		}
+
+		return tx.Create(&core.ExternalIdentity{
+			UserID:   user.ID,
+			Provider: id.Provider,
+			Subject:  id.Subject,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if user.DeactivatedAt != nil {
+		return nil, ErrDeactivated
+	}
+	return &user, nil
+}
+
+// Creates a user from id. It has no password so it can only log in through the provider.
+func (p *Provisioner) create(tx *gorm.DB, user *core.User, id Identity) error {
+	role := p.MapRole(id)
+	if role == "" {
+		role = p.cfg.DefaultRole
+	}
+	dept := id.Claim(p.cfg.DeptClaim)
+	if dept == "" {
+		dept = p.cfg.DefaultDept
+	}
+	name := id.Name
+	if name == "" {
+		name = id.Email
+	}
+
+	*user = core.User{
+		Name:     name,
+		Email:    id.Email,
+		Password: "",
+		Role:     role,
+		Dept:     dept,
+	}
+	if id.EmailVerified {
+		now := time.Now()
+		user.EmailVerifiedAt = &now
+	}
+	return tx.Create(user).Error
+}
+
+// Re-applies role rules when configured to
+func (p *Provisioner) syncRole(tx *gorm.DB, user *core.User, id Identity) error {
+	if !p.cfg.UpdateRoles {
+		return nil
+	}
+	role := p.MapRole(id)
+	if role == "" || role == user.Role {
+		return nil
+	}
+
+	// The role is in the token, so revoke older ones
+	err := tx.Model(user).Updates(map[string]interface{}{
+		"role":          role,
+		"token_version": gorm.Expr("token_version + 1"),
+		"version":       gorm.Expr("version + 1"),
+	}).Error
+	if err != nil {
+		return err
+	}
+	return tx.First(user, user.ID).Error
+}
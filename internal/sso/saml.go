@@ -0,0 +1,219 @@
+package sso
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/xml"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"postman-task/internal/auth"
+
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlsp"
+	"github.com/gin-gonic/gin"
+)
+
+// Builds the service provider on first use and caches it
+func (h *Handler) samlProvider(ctx context.Context) (*saml.ServiceProvider, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.saml != nil {
+		return h.saml, nil
+	}
+
+	cfg := h.cfg.SAML
+	keyPair, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := keyPair.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("saml key must be RSA")
+	}
+	cert, err := x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	idpMetadata, err := loadIDPMetadata(ctx, cfg.IDPMetadataFile, cfg.IDPMetadataURL)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := url.Parse(strings.TrimSuffix(cfg.RootURL, "/"))
+	if err != nil {
+		return nil, err
+	}
+
+	h.saml = &saml.ServiceProvider{
+		EntityID:    cfg.EntityID,
+		Key:         key,
+		Certificate: cert,
+		MetadataURL: *root.JoinPath("/api/v1/auth/saml/metadata"),
+		AcsURL:      *root.JoinPath("/api/v1/auth/saml/acs"),
+		IDPMetadata: idpMetadata,
+	}
+	return h.saml, nil
+}
+
+// Reads IdP metadata from a file if given, otherwise fetches it
+func loadIDPMetadata(ctx context.Context, file, rawURL string) (*saml.EntityDescriptor, error) {
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		return samlsp.ParseMetadata(data)
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return samlsp.FetchMetadata(ctx, http.DefaultClient, *u)
+}
+
+// Serves the service provider metadata for the IdP admin
+func (h *Handler) SAMLMetadata(c *gin.Context) {
+	if !h.cfg.SAML.Enabled {
+		c.JSON(404, gin.H{"error": "SAML login is not enabled"})
+		return
+	}
+
+	sp, err := h.samlProvider(c.Request.Context())
+	if err != nil {
+		log.Printf("SAML setup failed: %v", err)
+		c.JSON(502, gin.H{"error": "SAML is not configured correctly"})
+		return
+	}
+
+	data, err := xml.MarshalIndent(sp.Metadata(), "", "  ")
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Server error"})
+		return
+	}
+	c.Data(200, "application/samlmetadata+xml", data)
+}
+
+// Redirects to the IdP with a new authentication request
+func (h *Handler) SAMLLogin(c *gin.Context) {
+	if !h.cfg.SAML.Enabled {
+		c.JSON(404, gin.H{"error": "SAML login is not enabled"})
+		return
+	}
+
+	sp, err := h.samlProvider(c.Request.Context())
+	if err != nil {
+		log.Printf("SAML setup failed: %v", err)
+		c.JSON(502, gin.H{"error": "SAML is not configured correctly"})
+		return
+	}
+
+	req, err := sp.MakeAuthenticationRequest(
+		sp.GetSSOBindingLocation(saml.HTTPRedirectBinding),
+		saml.HTTPRedirectBinding,
+		saml.HTTPPostBinding,
+	)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Server error"})
+		return
+	}
+
+	// Remember the request id so only responses to it are accepted
+	relayState, _, err := auth.NewOpaqueToken()
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Server error"})
+		return
+	}
+	err = saveState(c.Request.Context(), h.db, State{
+		State:    relayState,
+		Provider: "saml",
+		Nonce:    req.ID,
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Server error"})
+		return
+	}
+
+	redirect, err := req.Redirect(relayState, sp)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Server error"})
+		return
+	}
+	c.Redirect(302, redirect.String())
+}
+
+// Assertion consumer service, the IdP posts the signed response here
+func (h *Handler) SAMLACS(c *gin.Context) {
+	if !h.cfg.SAML.Enabled {
+		c.JSON(404, gin.H{"error": "SAML login is not enabled"})
+		return
+	}
+	ctx := c.Request.Context()
+
+	sp, err := h.samlProvider(ctx)
+	if err != nil {
+		log.Printf("SAML setup failed: %v", err)
+		c.JSON(502, gin.H{"error": "SAML is not configured correctly"})
+		return
+	}
+
+	if err := c.Request.ParseForm(); err != nil {
+		c.JSON(400, gin.H{"error": "Bad request"})
+		return
+	}
+	state, err := takeState(ctx, h.db, c.Request.PostForm.Get("RelayState"), "saml")
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid or expired login state"})
+		return
+	}
+
+	assertion, err := sp.ParseResponse(c.Request, []string{state.Nonce})
+	if err != nil {
+		log.Printf("SAML response rejected: %v", err)
+		c.JSON(401, gin.H{"error": "Invalid SAML response"})
+		return
+	}
+	if assertion.Subject == nil || assertion.Subject.NameID == nil {
+		c.JSON(401, gin.H{"error": "SAML assertion has no subject"})
+		return
+	}
+
+	id := Identity{
+		Provider:      "saml",
+		Subject:       assertion.Subject.NameID.Value,
+		EmailVerified: h.cfg.SAML.TrustEmail,
+		Claims:        samlAttributes(assertion),
+	}
+	id.Email = id.Claim(h.cfg.Provisioning.EmailClaim)
+	if id.Email == "" && strings.Contains(id.Subject, "@") {
+		id.Email = id.Subject
+	}
+	id.Name = id.Claim(h.cfg.Provisioning.NameClaim)
+
+	h.completeLogin(c, id)
+}
+
+// Collects attribute values under both their name and friendly name
+func samlAttributes(assertion *saml.Assertion) map[string][]string {
+	out := map[string][]string{}
+	for _, stmt := range assertion.AttributeStatements {
+		for _, attr := range stmt.Attributes {
+			for _, v := range attr.Values {
+				out[attr.Name] = append(out[attr.Name], v.Value)
+				if attr.FriendlyName != "" {
+					out[attr.FriendlyName] = append(out[attr.FriendlyName], v.Value)
+				}
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,56 @@
+package sso
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// How long a user has to finish logging in at the provider
+const stateTTL = 10 * time.Minute
+
+var errUnknownState = errors.New("unknown or expired login state")
+
+// Represents a login started at an identity provider.
+// Kept in postgres so the callback can land on any instance.
+type State struct {
+	State     string    `gorm:"primaryKey"`
+	Provider  string    `gorm:"not null"`
+	Verifier  string    // PKCE code verifier
+	Nonce     string    // OIDC nonce or SAML request id
+	ExpiresAt time.Time `gorm:"not null;index"`
+}
+
+func (State) TableName() string {
+	return "sso_states"
+}
+
+// Saves a new login state
+func saveState(ctx context.Context, db *gorm.DB, s State) error {
+	s.ExpiresAt = time.Now().Add(stateTTL)
+	db = db.WithContext(ctx)
+
+	// Drop abandoned logins while we're here
+	db.Where("expires_at <= ?", time.Now()).Delete(&State{})
+
+	return db.Create(&s).Error
+}
+
+// Removes and returns a login state, so each can only be used once
+func takeState(ctx context.Context, db *gorm.DB, state, provider string) (*State, error) {
+	var s State
+	result := db.WithContext(ctx).
+		Clauses(clause.Returning{}).
+		Where("state = ? AND provider = ? AND expires_at > ?", state, provider, time.Now()).
+		Delete(&s)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, errUnknownState
+	}
+	return &s, nil
+}
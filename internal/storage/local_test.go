@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocalStoreRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	s, err := NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Put(ctx, "leaves/1/abc", strings.NewReader("certificate"), 11, "application/pdf"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	f, err := s.Get(ctx, "leaves/1/abc")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	data, err := io.ReadAll(f)
+	f.Close()
+	if err != nil || string(data) != "certificate" {
+		t.Fatalf("Get returned %q, %v", data, err)
+	}
+
+	// Overwriting replaces the whole file
+	if err := s.Put(ctx, "leaves/1/abc", strings.NewReader("new"), 3, "application/pdf"); err != nil {
+		t.Fatalf("Put again: %v", err)
+	}
+	f, err = s.Get(ctx, "leaves/1/abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ = io.ReadAll(f)
+	f.Close()
+	if string(data) != "new" {
+		t.Fatalf("after overwrite got %q", data)
+	}
+
+	if err := s.Delete(ctx, "leaves/1/abc"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := s.Get(ctx, "leaves/1/abc"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get after Delete: %v, want ErrNotFound", err)
+	}
+	// Deleting twice is fine
+	if err := s.Delete(ctx, "leaves/1/abc"); err != nil {
+		t.Fatalf("second Delete: %v", err)
+	}
+}
+
+func TestLocalStoreMissing(t *testing.T) {
+	s, err := NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(context.Background(), "leaves/9/none"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("got %v, want ErrNotFound", err)
+	}
+}
+
+func TestLocalStoreRejectsKeysOutsideDir(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	s, err := NewLocalStore(filepath.Join(root, "files"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"../escape", "leaves/../../escape", "/etc/passwd", ""} {
+		t.Run(key, func(t *testing.T) {
+			if err := s.Put(ctx, key, strings.NewReader("x"), 1, "text/plain"); err == nil {
+				t.Fatalf("Put accepted %q", key)
+			}
+			if _, err := s.Get(ctx, key); err == nil || errors.Is(err, ErrNotFound) {
+				t.Fatalf("Get of %q: %v, want an invalid key error", key, err)
+			}
+			if err := s.Delete(ctx, key); err == nil {
+				t.Fatalf("Delete accepted %q", key)
+			}
+		})
+	}
+
+	if _, err := os.Stat(filepath.Join(root, "escape")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("a file was written outside the store")
+	}
+}
+
+func TestLocalStoreLeavesNoTempFiles(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewLocalStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A reader that fails half way must not leave a partial file behind
+	r := io.MultiReader(strings.NewReader("half"), errReader{})
+	if err := s.Put(context.Background(), "leaves/2/abc", r, 8, "text/plain"); err == nil {
+		t.Fatal("Put succeeded with a failing reader")
+	}
+
+	entries, err := os.ReadDir(filepath.Join(dir, "leaves", "2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("left %d files behind", len(entries))
+	}
+}
+
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
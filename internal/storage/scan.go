@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+var ErrInfected = errors.New("file failed virus scan")
+
+// Checks uploads for malware before they are stored
+type Scanner interface {
+	// Returns ErrInfected (wrapped) for infected files, other errors
+	// mean the scan itself failed
+	Scan(ctx context.Context, r io.Reader) error
+}
+
+// Creates a scanner by name, "none" or "clamav"
+func NewScanner(kind, clamavAddr string) (Scanner, error) {
+	switch kind {
+	case "", "none":
+		return NoopScanner{}, nil
+	case "clamav":
+		return &ClamAVScanner{Addr: clamavAddr}, nil
+	default:
+		return nil, fmt.Errorf("unknown virus scanner %q", kind)
+	}
+}
+
+// Accepts every file
+type NoopScanner struct{}
+
+func (NoopScanner) Scan(ctx context.Context, r io.Reader) error {
+	return nil
+}
+
+// Streams files to a clamd daemon over TCP with the INSTREAM command
+type ClamAVScanner struct {
+	Addr string // host:port of clamd
+}
+
+func (s *ClamAVScanner) Scan(ctx context.Context, r io.Reader) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(time.Minute)
+	}
+	conn.SetDeadline(deadline)
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return err
+	}
+
+	// Chunks are prefixed with their length, a zero length ends the stream
+	buf := make([]byte, 32*1024)
+	size := make([]byte, 4)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, err := conn.Write(size); err != nil {
+				return err
+			}
+			if _, err := conn.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	binary.BigEndian.PutUint32(size, 0)
+	if _, err := conn.Write(size); err != nil {
+		return err
+	}
+
+	// "stream: OK" or "stream: <signature> FOUND"
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	reply = strings.TrimRight(reply, "\x00\n")
+	switch {
+	case strings.HasSuffix(reply, "OK"):
+		return nil
+	case strings.HasSuffix(reply, "FOUND"):
+		return fmt.Errorf("%w: %s", ErrInfected, strings.TrimPrefix(reply, "stream: "))
+	default:
+		return fmt.Errorf("clamav: %s", reply)
+	}
+}
@@ -0,0 +1,34 @@
+// Package storage keeps uploaded files on the local disk or in an
+// S3-compatible bucket.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"postman-task/pkg/config"
+)
+
+var ErrNotFound = errors.New("file not found")
+
+// Stores files by key, keys are slash separated paths like "leaves/1/abc"
+type Store interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Opens a stored file, returning ErrNotFound if there is none
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// Creates a store by name, "local" or "s3"
+func NewStore(cfg config.StorageConfig) (Store, error) {
+	switch cfg.Backend {
+	case "", "local":
+		return NewLocalStore(cfg.LocalDir)
+	case "s3":
+		return NewS3Store(cfg.S3)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.Backend)
+	}
+}
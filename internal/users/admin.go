@@ -0,0 +1,228 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"postman-task/internal/auth"
+	"postman-task/internal/core"
+	"postman-task/internal/etag"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Rejects tokens of deactivated or deleted users, tokens issued before
+// the user's token version was last bumped, and ended impersonations
+func NewUserCheck(db *gorm.DB) auth.UserCheck {
+	return func(ctx context.Context, claims *auth.Claims) error {
+		var user core.User
+		err := db.WithContext(ctx).
+			Select("id", "deactivated_at", "token_version").
+			First(&user, claims.UserID).Error
+		if err != nil {
+			return err
+		}
+		if user.DeactivatedAt != nil {
+			return errors.New("user is deactivated")
+		}
+		if claims.Version != user.TokenVersion {
+			return errors.New("token has been revoked")
+		}
+		if claims.Actor != nil {
+			return checkImpersonation(ctx, db, claims)
+		}
+		return nil
+	}
+}
+
+// Invalidates every token issued to the user so far
+func revokeTokens(db *gorm.DB, userID uint) error {
+	return db.Model(&core.User{}).Where("id = ?", userID).
+		UpdateColumn("token_version", gorm.Expr("token_version + 1")).Error
+}
+
+// Admins can't lock themselves out
+func isSelf(c *gin.Context, user *core.User) bool {
+	userID, _ := c.Get("user_id")
+	id, ok := userID.(uint)
+	return ok && id == user.ID
+}
+
+// Updates a user's role, department, course or advisor, admin only
+func (h *UserHandler) UpdateUser(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	var data core.UpdateUserRequest
+	if err := c.ShouldBindJSON(&data); err != nil {
+		c.JSON(400, gin.H{"error": "Bad request"})
+		return
+	}
+
+	// Find user
+	var user core.User
+	if err := db.First(&user, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "User not found"})
+		return
+	}
+	if !etag.Match(c, user.Version) {
+		return
+	}
+
+	updates := map[string]interface{}{}
+	if data.Dept != nil {
+		updates["dept"] = *data.Dept
+	}
+	if data.Course != nil {
+		updates["course"] = *data.Course
+	}
+	if data.AdvisorID != nil {
+		if *data.AdvisorID == 0 {
+			updates["advisor_id"] = nil
+		} else {
+			// Advisors decide leave requests, so must be faculty or wardens
+			var advisor core.User
+			err := db.Where("role IN ?", []string{"faculty", "warden"}).First(&advisor, *data.AdvisorID).Error
+			if err != nil {
+				c.JSON(400, gin.H{"error": "Advisor must be a faculty member or warden"})
+				return
+			}
+			updates["advisor_id"] = advisor.ID
+		}
+	}
+	roleChanged := data.Role != nil && *data.Role != user.Role
+	if roleChanged {
+		if isSelf(c, &user) {
+			c.JSON(400, gin.H{"error": "Cannot change your own role"})
+			return
+		}
+		updates["role"] = *data.Role
+		// The role is in the token, so make them log in again
+		updates["token_version"] = gorm.Expr("token_version + 1")
+	}
+	if len(updates) == 0 {
+		c.JSON(400, gin.H{"error": "Nothing to update"})
+		return
+	}
+
+	ok, err := etag.Update(db, &user, user.Version, updates)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Could not update user"})
+		return
+	}
+	if !ok {
+		etag.Stale(c)
+		return
+	}
+
+	db.First(&user, user.ID)
+	user.Password = ""
+	etag.Set(c, user.Version)
+	c.JSON(200, user)
+}
+
+// Deactivates a user, blocking login and revoking their tokens, admin only
+func (h *UserHandler) DeactivateUser(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	// Find user
+	var user core.User
+	if err := db.First(&user, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "User not found"})
+		return
+	}
+	if !etag.Match(c, user.Version) {
+		return
+	}
+	if isSelf(c, &user) {
+		c.JSON(400, gin.H{"error": "Cannot deactivate yourself"})
+		return
+	}
+	if user.DeactivatedAt != nil {
+		c.JSON(400, gin.H{"error": "User already deactivated"})
+		return
+	}
+
+	ok, err := etag.Update(db, &user, user.Version, map[string]interface{}{
+		"deactivated_at": time.Now(),
+		"token_version":  gorm.Expr("token_version + 1"),
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Could not deactivate user"})
+		return
+	}
+	if !ok {
+		etag.Stale(c)
+		return
+	}
+
+	etag.Set(c, user.Version+1)
+
+	c.JSON(200, gin.H{"message": "User deactivated"})
+}
+
+// Reactivates a deactivated user, admin only
+func (h *UserHandler) ReactivateUser(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	// Find user
+	var user core.User
+	if err := db.First(&user, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "User not found"})
+		return
+	}
+	if !etag.Match(c, user.Version) {
+		return
+	}
+	if user.DeactivatedAt == nil {
+		c.JSON(400, gin.H{"error": "User is not deactivated"})
+		return
+	}
+
+	ok, err := etag.Update(db, &user, user.Version, map[string]interface{}{
+		"deactivated_at": nil,
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Could not reactivate user"})
+		return
+	}
+	if !ok {
+		etag.Stale(c)
+		return
+	}
+
+	etag.Set(c, user.Version+1)
+
+	c.JSON(200, gin.H{"message": "User reactivated"})
+}
+
+// Soft deletes a user, admin only
+func (h *UserHandler) DeleteUser(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	// Find user
+	var user core.User
+	if err := db.First(&user, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "User not found"})
+		return
+	}
+	if isSelf(c, &user) {
+		c.JSON(400, gin.H{"error": "Cannot delete yourself"})
+		return
+	}
+
+	// Sets deleted_at, the row and its history stay in the database
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := revokeTokens(tx, user.ID); err != nil {
+			return err
+		}
+		return tx.Delete(&user).Error
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Could not delete user"})
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "User deleted"})
+}
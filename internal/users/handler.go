@@ -1,30 +1,45 @@
 package users
 
 import (
+	"errors"
+	"log"
 	"postman-task/internal/auth"
 	"postman-task/internal/core"
+	"postman-task/internal/directory"
+	"postman-task/internal/etag"
+	"postman-task/internal/ratelimit"
+	"postman-task/pkg/config"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 )
 
 type UserHandler struct {
-	db  *gorm.DB
-	jwt *auth.JWTManager
+	db        *gorm.DB
+	jwt       *auth.JWTManager
+	limiter   *ratelimit.Limiter
+	directory *directory.Directory // nil when LDAP is off
+	cfg       *config.Config
 }
 
 // Creates a new user handler
-func NewUserHandler(db *gorm.DB, jwt *auth.JWTManager) *UserHandler {
+func NewUserHandler(db *gorm.DB, jwt *auth.JWTManager, limiter *ratelimit.Limiter, dir *directory.Directory, cfg *config.Config) *UserHandler {
 	return &UserHandler{
-		db:  db,
-		jwt: jwt,
+		db:        db,
+		jwt:       jwt,
+		limiter:   limiter,
+		directory: dir,
+		cfg:       cfg,
 	}
 }
 
 // Register a new user
 func (h *UserHandler) Register(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
 	// Get data from request
 	var data core.RegisterRequest
 	if err := c.ShouldBindJSON(&data); err != nil {
@@ -51,21 +66,27 @@ func (h *UserHandler) Register(c *gin.Context) {
 			return
 		}
 
-		claims, err := h.jwt.ValidateToken(tokenParts[1])
+		claims, err := h.jwt.Authenticate(c.Request.Context(), tokenParts[1])
 		if err != nil || claims.Role != "admin" {
 			c.JSON(403, gin.H{"error": "Only admin can register faculty/warden"})
 			return
 		}
 	}
 
-	// Check if user exists
+	// Check if user exists, deleted users still hold their email
 	var existingUser core.User
-	h.db.Where("email = ?", data.Email).First(&existingUser)
+	db.Unscoped().Where("email = ?", data.Email).First(&existingUser)
 	if existingUser.ID != 0 {
 		c.JSON(400, gin.H{"error": "Email already in use"})
 		return
 	}
 
+	// Check password strength
+	if err := auth.ValidatePassword(h.cfg.Password, data.Password); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
 	// Hash password
 	hash, err := auth.HashPassword(data.Password)
 	if err != nil {
@@ -80,15 +101,21 @@ func (h *UserHandler) Register(c *gin.Context) {
 		Password: hash,
 		Role:     data.Role,
 		Dept:     data.Dept,
+		Course:   data.Course,
 	}
 
 	// Save to database
-	result := h.db.Create(&user)
+	result := db.Create(&user)
 	if result.Error != nil {
 		c.JSON(500, gin.H{"error": "Could not create user"})
 		return
 	}
 
+	// Send verification link
+	if err := h.sendVerification(c, db, &user); err != nil {
+		log.Printf("Could not create verification token for user %d: %v", user.ID, err)
+	}
+
 	// Return success
 	c.JSON(200, gin.H{
 		"message": "User created",
@@ -102,6 +129,8 @@ func (h *UserHandler) Register(c *gin.Context) {
 
 // Login user
 func (h *UserHandler) Login(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
 	// Get login data
 	var data core.LoginRequest
 	if err := c.ShouldBindJSON(&data); err != nil {
@@ -109,41 +138,87 @@ func (h *UserHandler) Login(c *gin.Context) {
 		return
 	}
 
-	// Find user
+	// Limit attempts against this account from any IP
+	ok, retryAfter := h.limiter.Allow(c.Request.Context(), h.loginAccountRule(), strings.ToLower(data.Email))
+	if !ok {
+		ratelimit.TooManyRequests(c, retryAfter, "Too many login attempts, try again later")
+		return
+	}
+
+	// Find user, directory users may not have a row yet
 	var user core.User
-	result := h.db.Where("email = ?", data.Email).First(&user)
-	if result.Error != nil {
+	result := db.Where("email = ?", data.Email).First(&user)
+	found := result.Error == nil
+
+	// Service accounts only authenticate with API keys
+	if found && user.Role == "service" {
+		c.JSON(401, gin.H{"error": "Invalid credentials"})
+		return
+	}
+	if !found && h.directory == nil {
 		c.JSON(401, gin.H{"error": "Invalid credentials"})
 		return
 	}
 
-	// Check password
-	if !auth.CheckPasswordHash(data.Password, user.Password) {
+	// Refuse locked accounts without checking the password
+	if found && isLocked(&user) {
+		ratelimit.TooManyRequests(c, time.Until(*user.LockedUntil), "Account locked, try again later")
+		return
+	}
+
+	// Check the local password, then the directory
+	authenticated := found && auth.CheckPasswordHash(data.Password, user.Password)
+	if !authenticated && h.directory != nil {
+		entry, err := h.directory.Authenticate(data.Email, data.Password)
+		if err == nil {
+			dirUser, err := h.directory.UpsertUser(c.Request.Context(), *entry)
+			if errors.Is(err, directory.ErrPrivileged) {
+				log.Printf("LDAP login refused for %s: %v", data.Email, err)
+				c.JSON(401, gin.H{"error": "Invalid credentials"})
+				return
+			}
+			if err != nil {
+				c.JSON(500, gin.H{"error": "Server error"})
+				return
+			}
+			user, authenticated = *dirUser, true
+		} else if err != directory.ErrInvalidCredentials {
+			log.Printf("LDAP login failed: %v", err)
+		}
+	}
+
+	if !authenticated {
+		if found {
+			if err := h.recordFailedLogin(db, &user); err != nil {
+				c.JSON(500, gin.H{"error": "Server error"})
+				return
+			}
+		}
 		c.JSON(401, gin.H{"error": "Invalid credentials"})
 		return
 	}
 
-	// Generate token
-	token, err := h.jwt.GenerateToken(user.ID, user.Email, user.Role)
-	if err != nil {
-		c.JSON(500, gin.H{"error": "Could not generate token"})
+	// Deactivated accounts can't log in
+	if user.DeactivatedAt != nil {
+		c.JSON(403, gin.H{"error": "Account deactivated"})
 		return
 	}
 
-	// Return token
-	c.JSON(200, gin.H{
-		"token": token,
-		"user": gin.H{
-			"id":    user.ID,
-			"name":  user.Name,
-			"email": user.Email,
-			"role":  user.Role,
-		},
-	})
+	// Unverified accounts can't log in when verification is required
+	if h.cfg.Account.RequireVerifiedEmail && user.EmailVerifiedAt == nil {
+		c.JSON(403, gin.H{"error": "Email not verified"})
+		return
+	}
+
+	// Earlier failures are forgotten once a token is issued, not before a
+	// second factor
+	h.CompleteLogin(c, &user)
 }
 
 // Get all users, admin only
 func (h *UserHandler) GetUsers(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
 	// Get pagination parameters
 	page := 1
 	p := c.Query("page")
@@ -157,12 +232,12 @@ func (h *UserHandler) GetUsers(c *gin.Context) {
 
 	// Get total count
 	var total int64
-	h.db.Model(&core.User{}).Count(&total)
+	db.Model(&core.User{}).Count(&total)
 
 	// Get page of users
 	var users []core.User
 	offset := (page - 1) * pageSize
-	h.db.Offset(offset).
+	db.Offset(offset).
 		Limit(pageSize).
 		Find(&users)
 
@@ -184,12 +259,14 @@ func (h *UserHandler) GetUsers(c *gin.Context) {
 
 // Get user by ID
 func (h *UserHandler) GetUserByID(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
 	// Get user ID from URL
 	id := c.Param("id")
 
 	// Find user
 	var user core.User
-	result := h.db.First(&user, id)
+	result := db.First(&user, id)
 
 	if result.Error != nil {
 		c.JSON(404, gin.H{"error": "User not found"})
@@ -199,5 +276,103 @@ func (h *UserHandler) GetUserByID(c *gin.Context) {
 	// Remove password from data
 	user.Password = ""
 
+	etag.Set(c, user.Version)
+	c.JSON(200, user)
+}
+
+// Get the logged in user
+func (h *UserHandler) GetMe(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(401, gin.H{"error": "Not authorized"})
+		return
+	}
+
+	var user core.User
+	if err := db.First(&user, userID).Error; err != nil {
+		c.JSON(404, gin.H{"error": "User not found"})
+		return
+	}
+
+	user.Password = ""
+	etag.Set(c, user.Version)
+	c.JSON(200, user)
+}
+
+// Update the logged in user's profile
+func (h *UserHandler) UpdateMe(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(401, gin.H{"error": "Not authorized"})
+		return
+	}
+
+	var data core.UpdateProfileRequest
+	if err := c.ShouldBindJSON(&data); err != nil {
+		c.JSON(400, gin.H{"error": "Bad request"})
+		return
+	}
+
+	// Find user
+	var user core.User
+	if err := db.First(&user, userID).Error; err != nil {
+		c.JSON(404, gin.H{"error": "User not found"})
+		return
+	}
+	if !etag.Match(c, user.Version) {
+		return
+	}
+
+	updates := map[string]interface{}{}
+	if data.Name != nil {
+		updates["name"] = *data.Name
+	}
+	emailChanged := data.Email != nil && *data.Email != user.Email
+	if emailChanged {
+		// The email resets the password, so a stolen session can't take it over
+		if !auth.CheckPasswordHash(data.CurrentPassword, user.Password) {
+			c.JSON(401, gin.H{"error": "Current password is incorrect"})
+			return
+		}
+
+		// Check the new email is free
+		var count int64
+		db.Unscoped().Model(&core.User{}).Where("email = ?", *data.Email).Count(&count)
+		if count > 0 {
+			c.JSON(400, gin.H{"error": "Email already in use"})
+			return
+		}
+		updates["email"] = *data.Email
+		updates["email_verified_at"] = nil
+	}
+	if len(updates) == 0 {
+		c.JSON(400, gin.H{"error": "Nothing to update"})
+		return
+	}
+
+	ok, err := etag.Update(db, &user, user.Version, updates)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Could not update profile"})
+		return
+	}
+	if !ok {
+		etag.Stale(c)
+		return
+	}
+	db.First(&user, user.ID)
+
+	// A new email has to be verified again
+	if emailChanged {
+		if err := h.sendVerification(c, db, &user); err != nil {
+			log.Printf("Could not create verification token for user %d: %v", user.ID, err)
+		}
+	}
+
+	user.Password = ""
+	etag.Set(c, user.Version)
 	c.JSON(200, user)
 }
@@ -0,0 +1,150 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"postman-task/internal/auth"
+	"postman-task/internal/core"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Checks the impersonation session is still open and the admin behind it
+// still active, so ending the session or deactivating the admin cuts it off
+func checkImpersonation(ctx context.Context, db *gorm.DB, claims *auth.Claims) error {
+	var count int64
+	err := db.WithContext(ctx).Model(&core.ImpersonationSession{}).
+		Joins("JOIN users ON users.id = impersonation_sessions.actor_id").
+		Where("impersonation_sessions.id = ? AND impersonation_sessions.actor_id = ? AND impersonation_sessions.user_id = ?",
+			claims.Actor.SessionID, claims.Actor.UserID, claims.UserID).
+		Where("impersonation_sessions.ended_at IS NULL AND impersonation_sessions.expires_at > ?", time.Now()).
+		Where("users.role = ? AND users.deactivated_at IS NULL AND users.deleted_at IS NULL", "admin").
+		Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return errors.New("impersonation session has ended")
+	}
+	return nil
+}
+
+// Starts acting as another user, admin only. Returns a short-lived token
+// for that user which also names the admin.
+func (h *UserHandler) Impersonate(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	// No impersonating from inside an impersonation
+	if _, ok := c.Get("actor_id"); ok {
+		c.JSON(403, gin.H{"error": "Not allowed while impersonating"})
+		return
+	}
+
+	var data core.ImpersonateRequest
+	if err := c.ShouldBindJSON(&data); err != nil {
+		c.JSON(400, gin.H{"error": "Bad request"})
+		return
+	}
+
+	// Find user
+	var user core.User
+	if err := db.First(&user, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "User not found"})
+		return
+	}
+	if isSelf(c, &user) {
+		c.JSON(400, gin.H{"error": "Cannot impersonate yourself"})
+		return
+	}
+	// Admins can't borrow each other's rights, and service accounts use keys
+	if user.Role == "admin" || user.Role == "service" {
+		c.JSON(403, gin.H{"error": "Cannot impersonate this user"})
+		return
+	}
+	if user.DeactivatedAt != nil {
+		c.JSON(400, gin.H{"error": "User is deactivated"})
+		return
+	}
+
+	session := core.ImpersonationSession{
+		ActorID:   c.MustGet("user_id").(uint),
+		UserID:    user.ID,
+		Reason:    data.Reason,
+		ExpiresAt: time.Now().Add(h.cfg.JWT.ImpersonationTTL),
+	}
+	if err := db.Create(&session).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Could not start impersonation"})
+		return
+	}
+
+	actor := auth.Actor{UserID: session.ActorID, SessionID: session.ID}
+	token, err := h.jwt.GenerateImpersonationToken(user.ID, user.Email, user.Role, user.TokenVersion,
+		actor, h.cfg.JWT.ImpersonationTTL)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Could not generate token"})
+		return
+	}
+
+	log.Printf("Impersonation session %d: admin %d started acting as user %d: %s",
+		session.ID, session.ActorID, user.ID, session.Reason)
+
+	c.JSON(200, gin.H{
+		"token":      token,
+		"session_id": session.ID,
+		"expires_at": session.ExpiresAt,
+		"user": gin.H{
+			"id":    user.ID,
+			"name":  user.Name,
+			"email": user.Email,
+			"role":  user.Role,
+		},
+	})
+}
+
+// Ends the impersonation the request's token belongs to
+func (h *UserHandler) EndImpersonation(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	actorID, ok := c.Get("actor_id")
+	if !ok {
+		c.JSON(400, gin.H{"error": "Not impersonating"})
+		return
+	}
+
+	// Any open session of this admin for this user
+	err := db.Model(&core.ImpersonationSession{}).
+		Where("actor_id = ? AND user_id = ? AND ended_at IS NULL", actorID, c.MustGet("user_id")).
+		Update("ended_at", time.Now()).Error
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Could not end impersonation"})
+		return
+	}
+
+	log.Printf("Impersonation: admin %v stopped acting as user %v", actorID, c.MustGet("user_id"))
+	c.JSON(200, gin.H{"message": "Impersonation ended"})
+}
+
+// Lists impersonation sessions, newest first, admin only.
+// ?user_id= and ?actor_id= filter them.
+func (h *UserHandler) GetImpersonationSessions(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	query := db.Model(&core.ImpersonationSession{})
+	if id := c.Query("user_id"); id != "" {
+		query = query.Where("user_id = ?", id)
+	}
+	if id := c.Query("actor_id"); id != "" {
+		query = query.Where("actor_id = ?", id)
+	}
+
+	var sessions []core.ImpersonationSession
+	if err := query.Order("created_at DESC").Limit(100).Find(&sessions).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Server error"})
+		return
+	}
+	c.JSON(200, gin.H{"items": sessions})
+}
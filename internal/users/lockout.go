@@ -0,0 +1,104 @@
+package users
+
+import (
+	"strings"
+	"time"
+
+	"postman-task/internal/core"
+	"postman-task/internal/metrics"
+	"postman-task/internal/ratelimit"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Limit on login attempts against one account from any IP
+func (h *UserHandler) loginAccountRule() ratelimit.Rule {
+	return ratelimit.Rule{
+		Name:   "login_account",
+		Limit:  h.cfg.RateLimit.LoginPerAccount,
+		Window: h.cfg.RateLimit.Window,
+	}
+}
+
+// Counts a failed login and locks the account every time the count
+// reaches a multiple of the threshold, doubling the lock each time
+func (h *UserHandler) recordFailedLogin(db *gorm.DB, user *core.User) error {
+	err := db.Model(user).
+		Clauses(clause.Returning{Columns: []clause.Column{{Name: "failed_logins"}}}).
+		UpdateColumn("failed_logins", gorm.Expr("failed_logins + 1")).Error
+	if err != nil {
+		return err
+	}
+
+	threshold := h.cfg.Lockout.Threshold
+	if threshold <= 0 || user.FailedLogins%threshold != 0 {
+		return nil
+	}
+
+	lockedUntil := time.Now().Add(h.lockDuration(user.FailedLogins / threshold))
+	user.LockedUntil = &lockedUntil
+	metrics.AccountLocked()
+
+	return db.Model(user).UpdateColumn("locked_until", lockedUntil).Error
+}
+
+// Works out how long the nth lockout lasts
+func (h *UserHandler) lockDuration(n int) time.Duration {
+	d := h.cfg.Lockout.Duration
+	max := h.cfg.Lockout.MaxDuration
+	for i := 1; i < n; i++ {
+		d *= 2
+		if max > 0 && d >= max {
+			return max
+		}
+	}
+	if max > 0 && d > max {
+		return max
+	}
+	return d
+}
+
+// Whether failed logins have the account locked right now
+func isLocked(user *core.User) bool {
+	return user.LockedUntil != nil && user.LockedUntil.After(time.Now())
+}
+
+// Clears failed logins after a successful one
+func clearFailedLogins(db *gorm.DB, user *core.User) error {
+	if user.FailedLogins == 0 && user.LockedUntil == nil {
+		return nil
+	}
+	user.FailedLogins = 0
+	user.LockedUntil = nil
+	return db.Model(user).UpdateColumns(map[string]interface{}{
+		"failed_logins": 0,
+		"locked_until":  nil,
+	}).Error
+}
+
+// Unlocks an account locked by failed logins, admin only
+func (h *UserHandler) UnlockUser(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	// Find user
+	var user core.User
+	if err := db.First(&user, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "User not found"})
+		return
+	}
+
+	// Reset the lock and any account rate limit
+	err := db.Model(&user).UpdateColumns(map[string]interface{}{
+		"failed_logins": 0,
+		"locked_until":  nil,
+	}).Error
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Could not unlock user"})
+		return
+	}
+	h.limiter.Reset(c.Request.Context(), h.loginAccountRule(), strings.ToLower(user.Email))
+
+	c.JSON(200, gin.H{"message": "User unlocked"})
+}
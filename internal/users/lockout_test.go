@@ -0,0 +1,60 @@
+package users
+
+import (
+	"testing"
+	"time"
+
+	"postman-task/internal/core"
+	"postman-task/pkg/config"
+)
+
+func lockoutHandler(duration, max time.Duration) *UserHandler {
+	return &UserHandler{cfg: &config.Config{Lockout: config.LockoutConfig{Threshold: 5, Duration: duration, MaxDuration: max}}}
+}
+
+func TestLockDuration(t *testing.T) {
+	tests := []struct {
+		name     string
+		duration time.Duration
+		max      time.Duration
+		n        int
+		want     time.Duration
+	}{
+		{"first lock", 5 * time.Minute, time.Hour, 1, 5 * time.Minute},
+		{"second lock doubles", 5 * time.Minute, time.Hour, 2, 10 * time.Minute},
+		{"fourth lock", 5 * time.Minute, time.Hour, 4, 40 * time.Minute},
+		{"capped", 5 * time.Minute, time.Hour, 5, time.Hour},
+		{"stays capped", 5 * time.Minute, time.Hour, 10, time.Hour},
+		{"no overflow after many locks", 5 * time.Minute, time.Hour, 1000, time.Hour},
+		{"cap reached exactly", 15 * time.Minute, time.Hour, 3, time.Hour},
+		{"first lock over the cap", 2 * time.Hour, time.Hour, 1, time.Hour},
+		{"no cap", 5 * time.Minute, 0, 4, 40 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := lockoutHandler(tt.duration, tt.max).lockDuration(tt.n); got != tt.want {
+				t.Fatalf("lock %d lasts %s, want %s", tt.n, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsLocked(t *testing.T) {
+	past, future := time.Now().Add(-time.Minute), time.Now().Add(time.Minute)
+	tests := []struct {
+		name        string
+		lockedUntil *time.Time
+		want        bool
+	}{
+		{"never locked", nil, false},
+		{"lock over", &past, false},
+		{"locked", &future, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isLocked(&core.User{LockedUntil: tt.lockedUntil}); got != tt.want {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,307 @@
+package users
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"postman-task/internal/auth"
+	"postman-task/internal/core"
+	email "postman-task/internal/notifications"
+	"postman-task/internal/tracing"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	purposeVerifyEmail   = "verify_email"
+	purposeResetPassword = "reset_password"
+)
+
+var errInvalidToken = errors.New("invalid or expired token")
+
+// Creates a token for user, replacing any unused one with the same purpose
+func issueToken(db *gorm.DB, userID uint, purpose string, ttl time.Duration) (string, error) {
+	token, hash, err := auth.NewOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		err := tx.Model(&core.UserToken{}).
+			Where("user_id = ? AND purpose = ? AND used_at IS NULL", userID, purpose).
+			Update("used_at", now).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Create(&core.UserToken{
+			UserID:    userID,
+			Purpose:   purpose,
+			TokenHash: hash,
+			ExpiresAt: now.Add(ttl),
+		}).Error
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Marks a token used and returns it, failing if it was used or expired
+func consumeToken(db *gorm.DB, token, purpose string) (*core.UserToken, error) {
+	now := time.Now()
+	var t core.UserToken
+	result := db.Model(&t).
+		Clauses(clause.Returning{}).
+		Where("token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?",
+			auth.HashOpaqueToken(token), purpose, now).
+		Update("used_at", now)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, errInvalidToken
+	}
+	return &t, nil
+}
+
+// Sends an email in the background, keeping the request trace
+func sendEmail(c *gin.Context, to, subject, body string) {
+	ctx := tracing.Detach(c.Request.Context())
+	go func() {
+		err := email.SendContext(ctx, to, subject, body)
+		if err != nil {
+			log.Printf("Failed to send %q email: %v", subject, err)
+		}
+	}()
+}
+
+// Creates and emails a verification link to user
+func (h *UserHandler) sendVerification(c *gin.Context, db *gorm.DB, user *core.User) error {
+	token, err := issueToken(db, user.ID, purposeVerifyEmail, h.cfg.Account.VerifyTokenTTL)
+	if err != nil {
+		return err
+	}
+
+	body := "Hi " + user.Name + ",\n\n" +
+		"Please verify your email address by opening the link below:\n\n" +
+		h.cfg.Account.AppURL + "/verify-email?token=" + token + "\n\n" +
+		"Regards,\nAdmin"
+	sendEmail(c, user.Email, "Verify your email", body)
+	return nil
+}
+
+// Verifies a user's email with the emailed token
+func (h *UserHandler) VerifyEmail(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	var data core.VerifyEmailRequest
+	if err := c.ShouldBindJSON(&data); err != nil {
+		c.JSON(400, gin.H{"error": "Bad request"})
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		t, err := consumeToken(tx, data.Token, purposeVerifyEmail)
+		if err != nil {
+			return err
+		}
+		return tx.Model(&core.User{}).Where("id = ?", t.UserID).
+			Update("email_verified_at", time.Now()).Error
+	})
+	if err == errInvalidToken {
+		c.JSON(400, gin.H{"error": "Invalid or expired token"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Server error"})
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "Email verified"})
+}
+
+// Sends a new verification email
+func (h *UserHandler) ResendVerification(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	var data core.EmailRequest
+	if err := c.ShouldBindJSON(&data); err != nil {
+		c.JSON(400, gin.H{"error": "Bad request"})
+		return
+	}
+
+	// Same reply whether or not the account exists
+	var user core.User
+	err := db.Where("email = ?", data.Email).First(&user).Error
+	if err == nil && user.EmailVerifiedAt == nil {
+		if err := h.sendVerification(c, db, &user); err != nil {
+			c.JSON(500, gin.H{"error": "Server error"})
+			return
+		}
+	}
+
+	c.JSON(200, gin.H{"message": "If the account exists and is unverified, an email has been sent"})
+}
+
+// Emails a password reset link
+func (h *UserHandler) ForgotPassword(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	var data core.EmailRequest
+	if err := c.ShouldBindJSON(&data); err != nil {
+		c.JSON(400, gin.H{"error": "Bad request"})
+		return
+	}
+
+	// Same reply whether or not the account exists
+	var user core.User
+	err := db.Where("email = ?", data.Email).First(&user).Error
+	if err == nil {
+		token, err := issueToken(db, user.ID, purposeResetPassword, h.cfg.Account.ResetTokenTTL)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Server error"})
+			return
+		}
+
+		body := "Hi " + user.Name + ",\n\n" +
+			"Someone asked to reset your password. If it was you, open the link below:\n\n" +
+			h.cfg.Account.AppURL + "/reset-password?token=" + token + "\n\n" +
+			"The link expires in " + h.cfg.Account.ResetTokenTTL.String() + ". " +
+			"If you did not ask for this you can ignore this email.\n\n" +
+			"Regards,\nAdmin"
+		sendEmail(c, user.Email, "Reset your password", body)
+	}
+
+	c.JSON(200, gin.H{"message": "If the account exists, a reset email has been sent"})
+}
+
+// Sets a new password using the emailed token
+func (h *UserHandler) ResetPassword(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	var data core.ResetPasswordRequest
+	if err := c.ShouldBindJSON(&data); err != nil {
+		c.JSON(400, gin.H{"error": "Bad request"})
+		return
+	}
+
+	// Check the password before using up the token
+	if err := auth.ValidatePassword(h.cfg.Password, data.NewPassword); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	hash, err := auth.HashPassword(data.NewPassword)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Server error"})
+		return
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		t, err := consumeToken(tx, data.Token, purposeResetPassword)
+		if err != nil {
+			return err
+		}
+
+		// The user proved they own the email, so also verify it and lift any
+		// lock. Sessions from before the reset are logged out.
+		return tx.Model(&core.User{}).Where("id = ?", t.UserID).Updates(map[string]interface{}{
+			"password":          hash,
+			"failed_logins":     0,
+			"locked_until":      nil,
+			"email_verified_at": gorm.Expr("COALESCE(email_verified_at, ?)", time.Now()),
+			"token_version":     gorm.Expr("token_version + 1"),
+		}).Error
+	})
+	if err == errInvalidToken {
+		c.JSON(400, gin.H{"error": "Invalid or expired token"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Server error"})
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "Password reset"})
+}
+
+// Changes the logged in user's password
+func (h *UserHandler) ChangePassword(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(401, gin.H{"error": "Not authorized"})
+		return
+	}
+
+	var data core.ChangePasswordRequest
+	if err := c.ShouldBindJSON(&data); err != nil {
+		c.JSON(400, gin.H{"error": "Bad request"})
+		return
+	}
+
+	// Find user
+	var user core.User
+	if err := db.First(&user, userID).Error; err != nil {
+		c.JSON(404, gin.H{"error": "User not found"})
+		return
+	}
+
+	// Check current password
+	if !auth.CheckPasswordHash(data.CurrentPassword, user.Password) {
+		c.JSON(401, gin.H{"error": "Current password is incorrect"})
+		return
+	}
+
+	if data.NewPassword == data.CurrentPassword {
+		c.JSON(400, gin.H{"error": "New password must be different"})
+		return
+	}
+	if err := auth.ValidatePassword(h.cfg.Password, data.NewPassword); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	hash, err := auth.HashPassword(data.NewPassword)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Server error"})
+		return
+	}
+
+	// Save the password, drop any outstanding reset links and log out
+	// every other session
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&user).Update("password", hash).Error; err != nil {
+			return err
+		}
+		if err := revokeTokens(tx, user.ID); err != nil {
+			return err
+		}
+		return tx.Model(&core.UserToken{}).
+			Where("user_id = ? AND purpose = ? AND used_at IS NULL", user.ID, purposeResetPassword).
+			Update("used_at", time.Now()).Error
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Could not change password"})
+		return
+	}
+
+	// The caller's token was revoked too, give them a new one
+	if err := db.Select("token_version").First(&user, user.ID).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Server error"})
+		return
+	}
+	token, err := h.jwt.GenerateToken(user.ID, user.Email, user.Role, user.TokenVersion)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Could not generate token"})
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "Password changed", "token": token})
+}
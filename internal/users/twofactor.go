@@ -0,0 +1,578 @@
+package users
+
+import (
+	"errors"
+	"time"
+
+	"postman-task/internal/auth"
+	"postman-task/internal/core"
+	"postman-task/internal/ratelimit"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+var (
+	errInvalidChallenge = errors.New("invalid or expired challenge")
+	errInvalidCode      = errors.New("invalid code")
+	errSetupNotStarted  = errors.New("two-factor setup has not been started")
+)
+
+// Creates the initial two-factor policy from config if none is stored
+func SeedTwoFactorPolicy(db *gorm.DB, roles []string) error {
+	var count int64
+	if err := db.Model(&core.TwoFactorPolicy{}).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 || len(roles) == 0 {
+		return nil
+	}
+
+	policies := make([]core.TwoFactorPolicy, len(roles))
+	for i, role := range roles {
+		policies[i] = core.TwoFactorPolicy{Role: role}
+	}
+	return db.Create(&policies).Error
+}
+
+// Checks whether the policy requires two-factor for role
+func roleRequiresTwoFactor(db *gorm.DB, role string) (bool, error) {
+	var count int64
+	err := db.Model(&core.TwoFactorPolicy{}).Where("role = ?", role).Count(&count).Error
+	return count > 0, err
+}
+
+// Finishes a login once the user is known, by password, directory or SSO.
+// Asks for a second factor if the user has one or their role needs one,
+// otherwise issues the token.
+func (h *UserHandler) CompleteLogin(c *gin.Context, user *core.User) {
+	db := h.db.WithContext(c.Request.Context())
+
+	required, err := roleRequiresTwoFactor(db, user.Role)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Server error"})
+		return
+	}
+	if user.TwoFactorEnabledAt != nil || required {
+		h.startChallenge(c, db, user, user.TwoFactorEnabledAt == nil)
+		return
+	}
+
+	h.respondWithToken(c, user)
+}
+
+// Issues a token for user, same shape for every login path
+func (h *UserHandler) respondWithToken(c *gin.Context, user *core.User) {
+	// Forget earlier failures now the whole login succeeded
+	if err := clearFailedLogins(h.db.WithContext(c.Request.Context()), user); err != nil {
+		c.JSON(500, gin.H{"error": "Server error"})
+		return
+	}
+
+	token, err := h.jwt.GenerateToken(user.ID, user.Email, user.Role, user.TokenVersion)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Could not generate token"})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"token": token,
+		"user": gin.H{
+			"id":    user.ID,
+			"name":  user.Name,
+			"email": user.Email,
+			"role":  user.Role,
+		},
+	})
+}
+
+// Replies to a correct password with a challenge for the second step
+// instead of a token. setup is true when the user still has to enrol.
+func (h *UserHandler) startChallenge(c *gin.Context, db *gorm.DB, user *core.User, setup bool) {
+	token, hash, err := auth.NewOpaqueToken()
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Server error"})
+		return
+	}
+
+	challenge := core.TwoFactorChallenge{
+		UserID:    user.ID,
+		TokenHash: hash,
+		ExpiresAt: time.Now().Add(h.cfg.TwoFactor.ChallengeTTL),
+	}
+	if err := db.Create(&challenge).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Server error"})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"two_factor_required": true,
+		"setup_required":      setup,
+		"challenge_token":     token,
+		"expires_at":          challenge.ExpiresAt,
+	})
+}
+
+// Loads an unexpired challenge and its user
+func findChallenge(db *gorm.DB, token string) (*core.TwoFactorChallenge, *core.User, error) {
+	var challenge core.TwoFactorChallenge
+	err := db.Where("token_hash = ? AND expires_at > ?", auth.HashOpaqueToken(token), time.Now()).
+		First(&challenge).Error
+	if err != nil {
+		return nil, nil, errInvalidChallenge
+	}
+
+	var user core.User
+	if err := db.First(&user, challenge.UserID).Error; err != nil {
+		return nil, nil, errInvalidChallenge
+	}
+	return &challenge, &user, nil
+}
+
+// Counts a wrong code as a failed login, dropping the challenge once it
+// has too many or the account gets locked
+func (h *UserHandler) failChallenge(db *gorm.DB, challenge *core.TwoFactorChallenge, user *core.User) error {
+	if err := h.recordFailedLogin(db, user); err != nil {
+		return err
+	}
+	if challenge.Attempts+1 >= h.cfg.TwoFactor.MaxAttempts || isLocked(user) {
+		return db.Delete(challenge).Error
+	}
+	return db.Model(challenge).UpdateColumn("attempts", gorm.Expr("attempts + 1")).Error
+}
+
+// Replies to an error from enabling two-factor or replacing recovery
+// codes, only wrong input is the user's to see
+func twoFactorError(c *gin.Context, err error) {
+	if errors.Is(err, errInvalidCode) || errors.Is(err, errSetupNotStarted) {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(500, gin.H{"error": "Server error"})
+}
+
+// Checks an authenticator code and remembers its step so it can't be reused
+func checkTOTP(db *gorm.DB, user *core.User, code string) (bool, error) {
+	step, ok := auth.VerifyTOTP(user.TOTPSecret, code, user.TOTPLastStep)
+	if !ok {
+		return false, nil
+	}
+
+	// Only one request can move the step forward
+	result := db.Model(&core.User{}).
+		Where("id = ? AND totp_last_step < ?", user.ID, step).
+		UpdateColumn("totp_last_step", step)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	user.TOTPLastStep = step
+	return result.RowsAffected == 1, nil
+}
+
+// Uses up a recovery code
+func useRecoveryCode(db *gorm.DB, user *core.User, code string) (bool, error) {
+	result := db.Model(&core.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", user.ID, auth.HashRecoveryCode(code)).
+		Update("used_at", time.Now())
+	return result.RowsAffected == 1, result.Error
+}
+
+// Replaces the user's recovery codes with new ones
+func (h *UserHandler) newRecoveryCodes(tx *gorm.DB, user *core.User) ([]string, error) {
+	codes, hashes, err := auth.NewRecoveryCodes(h.cfg.TwoFactor.RecoveryCodes)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Where("user_id = ?", user.ID).Delete(&core.RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+	rows := make([]core.RecoveryCode, len(hashes))
+	for i, hash := range hashes {
+		rows[i] = core.RecoveryCode{UserID: user.ID, CodeHash: hash}
+	}
+	if err := tx.Create(&rows).Error; err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Creates a pending secret and replies with what the authenticator app needs
+func (h *UserHandler) beginSetup(c *gin.Context, db *gorm.DB, user *core.User) {
+	if user.TwoFactorEnabledAt != nil {
+		c.JSON(400, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+
+	key, err := auth.NewTOTPKey(h.cfg.TwoFactor.Issuer, user.Email)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Server error"})
+		return
+	}
+	qr, err := auth.TOTPQRCode(key)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Server error"})
+		return
+	}
+
+	if err := db.Model(user).Update("totp_secret", key.Secret()).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Server error"})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"secret":           key.Secret(),
+		"provisioning_uri": key.URL(),
+		"qr_code":          qr,
+	})
+}
+
+// Enables two-factor once the user proves the app works, returning recovery codes
+func (h *UserHandler) enable(db *gorm.DB, user *core.User, code string) ([]string, error) {
+	if user.TwoFactorEnabledAt != nil || user.TOTPSecret == "" {
+		return nil, errSetupNotStarted
+	}
+
+	var codes []string
+	err := db.Transaction(func(tx *gorm.DB) error {
+		ok, err := checkTOTP(tx, user, code)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errInvalidCode
+		}
+
+		now := time.Now()
+		if err := tx.Model(user).Update("two_factor_enabled_at", now).Error; err != nil {
+			return err
+		}
+		user.TwoFactorEnabledAt = &now
+
+		codes, err = h.newRecoveryCodes(tx, user)
+		return err
+	})
+	return codes, err
+}
+
+// Second login step, takes an authenticator or recovery code
+func (h *UserHandler) LoginTwoFactor(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	var data core.TwoFactorLoginRequest
+	if err := c.ShouldBindJSON(&data); err != nil || (data.Code == "" && data.RecoveryCode == "") {
+		c.JSON(400, gin.H{"error": "Bad request"})
+		return
+	}
+
+	challenge, user, err := findChallenge(db, data.ChallengeToken)
+	if err != nil || user.TwoFactorEnabledAt == nil {
+		c.JSON(401, gin.H{"error": "Invalid or expired challenge"})
+		return
+	}
+	if isLocked(user) {
+		ratelimit.TooManyRequests(c, time.Until(*user.LockedUntil), "Account locked, try again later")
+		return
+	}
+
+	var ok bool
+	if data.Code != "" {
+		ok, err = checkTOTP(db, user, data.Code)
+	} else {
+		ok, err = useRecoveryCode(db, user, data.RecoveryCode)
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Server error"})
+		return
+	}
+	if !ok {
+		if err := h.failChallenge(db, challenge, user); err != nil {
+			c.JSON(500, gin.H{"error": "Server error"})
+			return
+		}
+		c.JSON(401, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	db.Delete(challenge)
+	h.respondWithToken(c, user)
+}
+
+// Starts enrolment for a user the policy forces to use two-factor
+func (h *UserHandler) SetupTwoFactorChallenge(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	var data core.TwoFactorLoginRequest
+	if err := c.ShouldBindJSON(&data); err != nil {
+		c.JSON(400, gin.H{"error": "Bad request"})
+		return
+	}
+
+	_, user, err := findChallenge(db, data.ChallengeToken)
+	if err != nil {
+		c.JSON(401, gin.H{"error": "Invalid or expired challenge"})
+		return
+	}
+
+	h.beginSetup(c, db, user)
+}
+
+// Finishes forced enrolment and logs the user in
+func (h *UserHandler) ConfirmTwoFactorChallenge(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	var data core.TwoFactorLoginRequest
+	if err := c.ShouldBindJSON(&data); err != nil || data.Code == "" {
+		c.JSON(400, gin.H{"error": "Bad request"})
+		return
+	}
+
+	challenge, user, err := findChallenge(db, data.ChallengeToken)
+	if err != nil {
+		c.JSON(401, gin.H{"error": "Invalid or expired challenge"})
+		return
+	}
+	if isLocked(user) {
+		ratelimit.TooManyRequests(c, time.Until(*user.LockedUntil), "Account locked, try again later")
+		return
+	}
+
+	codes, err := h.enable(db, user, data.Code)
+	if errors.Is(err, errInvalidCode) {
+		if err := h.failChallenge(db, challenge, user); err != nil {
+			c.JSON(500, gin.H{"error": "Server error"})
+			return
+		}
+	}
+	if err != nil {
+		twoFactorError(c, err)
+		return
+	}
+	db.Delete(challenge)
+
+	if err := clearFailedLogins(db, user); err != nil {
+		c.JSON(500, gin.H{"error": "Server error"})
+		return
+	}
+	token, err := h.jwt.GenerateToken(user.ID, user.Email, user.Role, user.TokenVersion)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Could not generate token"})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"token":          token,
+		"recovery_codes": codes,
+	})
+}
+
+// Starts enrolment for the logged in user
+func (h *UserHandler) SetupTwoFactor(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	var user core.User
+	if err := db.First(&user, c.MustGet("user_id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "User not found"})
+		return
+	}
+
+	h.beginSetup(c, db, &user)
+}
+
+// Enables two-factor for the logged in user
+func (h *UserHandler) ConfirmTwoFactor(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	var data core.TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&data); err != nil {
+		c.JSON(400, gin.H{"error": "Bad request"})
+		return
+	}
+
+	var user core.User
+	if err := db.First(&user, c.MustGet("user_id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "User not found"})
+		return
+	}
+
+	codes, err := h.enable(db, &user, data.Code)
+	if err != nil {
+		twoFactorError(c, err)
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"message":        "Two-factor authentication enabled",
+		"recovery_codes": codes,
+	})
+}
+
+// Replaces the logged in user's recovery codes
+func (h *UserHandler) RegenerateRecoveryCodes(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	var data core.TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&data); err != nil {
+		c.JSON(400, gin.H{"error": "Bad request"})
+		return
+	}
+
+	var user core.User
+	if err := db.First(&user, c.MustGet("user_id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "User not found"})
+		return
+	}
+	if user.TwoFactorEnabledAt == nil {
+		c.JSON(400, gin.H{"error": "Two-factor authentication is not enabled"})
+		return
+	}
+
+	var codes []string
+	err := db.Transaction(func(tx *gorm.DB) error {
+		ok, err := checkTOTP(tx, &user, data.Code)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errInvalidCode
+		}
+		codes, err = h.newRecoveryCodes(tx, &user)
+		return err
+	})
+	if err != nil {
+		twoFactorError(c, err)
+		return
+	}
+
+	c.JSON(200, gin.H{"recovery_codes": codes})
+}
+
+// Turns off two-factor for the logged in user, unless their role requires it
+func (h *UserHandler) DisableTwoFactor(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	var data core.TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&data); err != nil {
+		c.JSON(400, gin.H{"error": "Bad request"})
+		return
+	}
+
+	var user core.User
+	if err := db.First(&user, c.MustGet("user_id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "User not found"})
+		return
+	}
+	if user.TwoFactorEnabledAt == nil {
+		c.JSON(400, gin.H{"error": "Two-factor authentication is not enabled"})
+		return
+	}
+
+	required, err := roleRequiresTwoFactor(db, user.Role)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Server error"})
+		return
+	}
+	if required {
+		c.JSON(403, gin.H{"error": "Two-factor authentication is required for your role"})
+		return
+	}
+
+	ok, err := checkTOTP(db, &user, data.Code)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Server error"})
+		return
+	}
+	if !ok {
+		c.JSON(400, gin.H{"error": errInvalidCode.Error()})
+		return
+	}
+
+	if err := clearTwoFactor(db, user.ID); err != nil {
+		c.JSON(500, gin.H{"error": "Could not disable two-factor authentication"})
+		return
+	}
+	c.JSON(200, gin.H{"message": "Two-factor authentication disabled"})
+}
+
+// Removes the secret and recovery codes of a user
+func clearTwoFactor(db *gorm.DB, userID uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&core.User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+			"totp_secret":           "",
+			"two_factor_enabled_at": nil,
+		}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", userID).Delete(&core.RecoveryCode{}).Error
+	})
+}
+
+// Resets two-factor for a user who lost their device, admin only
+func (h *UserHandler) ResetTwoFactor(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	var user core.User
+	if err := db.First(&user, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "User not found"})
+		return
+	}
+
+	// Also revoke their tokens, the device may be in someone else's hands
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := clearTwoFactor(tx, user.ID); err != nil {
+			return err
+		}
+		return revokeTokens(tx, user.ID)
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Could not reset two-factor authentication"})
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "Two-factor authentication reset"})
+}
+
+// Gets the roles that must use two-factor, admin only
+func (h *UserHandler) GetTwoFactorPolicy(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	var policies []core.TwoFactorPolicy
+	db.Order("role").Find(&policies)
+
+	roles := make([]string, len(policies))
+	for i, p := range policies {
+		roles[i] = p.Role
+	}
+	c.JSON(200, gin.H{"roles": roles})
+}
+
+// Sets the roles that must use two-factor, admin only
+func (h *UserHandler) SetTwoFactorPolicy(c *gin.Context) {
+	db := h.db.WithContext(c.Request.Context())
+
+	var data core.TwoFactorPolicyRequest
+	if err := c.ShouldBindJSON(&data); err != nil {
+		c.JSON(400, gin.H{"error": "Bad request"})
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("1 = 1").Delete(&core.TwoFactorPolicy{}).Error; err != nil {
+			return err
+		}
+		for _, role := range data.Roles {
+			err := tx.FirstOrCreate(&core.TwoFactorPolicy{}, core.TwoFactorPolicy{Role: role}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Could not save policy"})
+		return
+	}
+
+	c.JSON(200, gin.H{"roles": data.Roles})
+}
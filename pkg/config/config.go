@@ -1,18 +1,35 @@
 package config
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"time"
 
 	"github.com/spf13/viper"
 )
 
 type Config struct {
-	Database DatabaseConfig
-	Server   ServerConfig
-	JWT      JWTConfig
-	Admin    AdminConfig
-	Email    EmailConfig
+	Database    DatabaseConfig
+	Server      ServerConfig
+	JWT         JWTConfig
+	Admin       AdminConfig
+	Email       EmailConfig
+	Tracing     TracingConfig
+	RateLimit   RateLimitConfig `mapstructure:"rate_limit"`
+	Idempotency IdempotencyConfig
+	Lockout     LockoutConfig
+	Password    PasswordConfig
+	Account     AccountConfig
+	SSO         SSOConfig
+	LDAP        LDAPConfig
+	TwoFactor   TwoFactorConfig `mapstructure:"two_factor"`
+	Storage     StorageConfig
+	Attachments AttachmentConfig
+	Leaves      LeaveConfig
+	Attendance  AttendanceConfig
+	Analytics   AnalyticsConfig
+	Reports     ReportConfig
 }
 
 type DatabaseConfig struct {
@@ -20,11 +37,52 @@ type DatabaseConfig struct {
 }
 
 type ServerConfig struct {
-	Port string
+	Port           string
+	Mode           string   `mapstructure:"mode"`            // "development" or "production"
+	MetricsAddr    string   `mapstructure:"metrics_addr"`    // separate listener for /metrics, keep it off the public network; empty turns it off
+	TrustedProxies []string `mapstructure:"trusted_proxies"` // IPs or CIDRs whose X-Forwarded-For is believed, none by default
 }
 
+// Secrets that have shipped as defaults and must not be used in production
+var defaultJWTSecrets = []string{"", "mojakey", "mojkey"}
+
+const defaultKeyEncryptionKey = "mojakeyseal"
+
+const defaultGatePassSecret = "mojagatepass"
+
 type JWTConfig struct {
-	SecretKey string
+	SecretKey        string        `mapstructure:"secret_key"`         // used by HS256 only
+	Algorithm        string        `mapstructure:"algorithm"`          // HS256, RS256, ES256 or EdDSA
+	KeyEncryptionKey string        `mapstructure:"key_encryption_key"` // seals the asymmetric private keys kept in postgres
+	RotationInterval time.Duration `mapstructure:"rotation_interval"`
+	KeyOverlap       time.Duration `mapstructure:"key_overlap"` // keep verifying a retired key, must exceed the token lifetime
+	Issuer           string        `mapstructure:"issuer"`
+	Audience         string        `mapstructure:"audience"`
+	TokenTTL         time.Duration `mapstructure:"token_ttl"`
+	Leeway           time.Duration `mapstructure:"leeway"` // allowed clock skew for exp, nbf and iat
+	ImpersonationTTL time.Duration `mapstructure:"impersonation_ttl"`
+}
+
+// Reports whether HS256 is in use with a well known secret
+func (c JWTConfig) UsesDefaultSecret() bool {
+	if c.Algorithm != "HS256" {
+		return false
+	}
+	for _, s := range defaultJWTSecrets {
+		if c.SecretKey == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether an asymmetric algorithm is in use with the well known
+// key encryption key
+func (c JWTConfig) UsesDefaultKeyEncryptionKey() bool {
+	if c.Algorithm == "HS256" {
+		return false
+	}
+	return c.KeyEncryptionKey == "" || c.KeyEncryptionKey == defaultKeyEncryptionKey
 }
 
 type AdminConfig struct {
@@ -40,6 +98,202 @@ type EmailConfig struct {
 	FromEmail    string `mapstructure:"from_email"`
 }
 
+type TracingConfig struct {
+	Exporter    string  `mapstructure:"exporter"` // "none" or "otlp"
+	Endpoint    string  `mapstructure:"endpoint"` // host:port of the OTLP/HTTP collector
+	Insecure    bool    `mapstructure:"insecure"`
+	ServiceName string  `mapstructure:"service_name"`
+	SampleRatio float64 `mapstructure:"sample_ratio"`
+}
+
+type RateLimitConfig struct {
+	Store           string        `mapstructure:"store"` // "memory" or "postgres"
+	Window          time.Duration `mapstructure:"window"`
+	LoginPerIP      int           `mapstructure:"login_per_ip"`
+	LoginPerAccount int           `mapstructure:"login_per_account"`
+	RegisterPerIP   int           `mapstructure:"register_per_ip"`
+	ResetPerIP      int           `mapstructure:"reset_per_ip"`
+}
+
+type LockoutConfig struct {
+	Threshold   int           `mapstructure:"threshold"`    // failed logins before locking
+	Duration    time.Duration `mapstructure:"duration"`     // first lock, doubles each time
+	MaxDuration time.Duration `mapstructure:"max_duration"` // longest lock
+}
+
+type PasswordConfig struct {
+	MinLength     int  `mapstructure:"min_length"`
+	RequireUpper  bool `mapstructure:"require_upper"`
+	RequireLower  bool `mapstructure:"require_lower"`
+	RequireDigit  bool `mapstructure:"require_digit"`
+	RequireSymbol bool `mapstructure:"require_symbol"`
+}
+
+type AccountConfig struct {
+	AppURL               string        `mapstructure:"app_url"` // frontend used in email links
+	RequireVerifiedEmail bool          `mapstructure:"require_verified_email"`
+	VerifyTokenTTL       time.Duration `mapstructure:"verify_token_ttl"`
+	ResetTokenTTL        time.Duration `mapstructure:"reset_token_ttl"`
+}
+
+type SSOConfig struct {
+	OIDC         OIDCConfig
+	SAML         SAMLConfig
+	Provisioning ProvisioningConfig
+}
+
+type OIDCConfig struct {
+	Enabled      bool     `mapstructure:"enabled"`
+	Issuer       string   `mapstructure:"issuer"`
+	ClientID     string   `mapstructure:"client_id"`
+	ClientSecret string   `mapstructure:"client_secret"`
+	RedirectURL  string   `mapstructure:"redirect_url"` // must point at /api/v1/auth/oidc/callback
+	Scopes       []string `mapstructure:"scopes"`
+}
+
+type SAMLConfig struct {
+	Enabled         bool   `mapstructure:"enabled"`
+	EntityID        string `mapstructure:"entity_id"`
+	RootURL         string `mapstructure:"root_url"` // public base url of this API
+	IDPMetadataURL  string `mapstructure:"idp_metadata_url"`
+	IDPMetadataFile string `mapstructure:"idp_metadata_file"` // used instead of the url if set
+	CertFile        string `mapstructure:"cert_file"`
+	KeyFile         string `mapstructure:"key_file"`
+	TrustEmail      bool   `mapstructure:"trust_email"` // the IdP checks email ownership, so assertions may link to existing accounts
+}
+
+// How identities from an IdP or directory become users
+type ProvisioningConfig struct {
+	JIT         bool       `mapstructure:"jit"`          // create unknown users on first login
+	UpdateRoles bool       `mapstructure:"update_roles"` // re-apply role rules on every login
+	DefaultRole string     `mapstructure:"default_role"`
+	DefaultDept string     `mapstructure:"default_dept"`
+	EmailClaim  string     `mapstructure:"email_claim"`
+	NameClaim   string     `mapstructure:"name_claim"`
+	DeptClaim   string     `mapstructure:"dept_claim"`
+	RoleRules   []RoleRule `mapstructure:"role_rules"`
+}
+
+// Gives Role to identities whose Claim contains Value, first match wins
+type RoleRule struct {
+	Claim string `mapstructure:"claim"`
+	Value string `mapstructure:"value"`
+	Role  string `mapstructure:"role"`
+}
+
+type LDAPConfig struct {
+	Enabled            bool          `mapstructure:"enabled"`
+	URL                string        `mapstructure:"url"` // ldap:// or ldaps://
+	StartTLS           bool          `mapstructure:"start_tls"`
+	InsecureSkipVerify bool          `mapstructure:"insecure_skip_verify"`
+	BindDN             string        `mapstructure:"bind_dn"` // service account used for searches
+	BindPassword       string        `mapstructure:"bind_password"`
+	BaseDN             string        `mapstructure:"base_dn"`
+	UserFilter         string        `mapstructure:"user_filter"` // %s is replaced with the escaped email
+	SyncFilter         string        `mapstructure:"sync_filter"` // users to sync
+	UIDAttr            string        `mapstructure:"uid_attr"`    // stable id, entryUUID or objectGUID
+	EmailAttr          string        `mapstructure:"email_attr"`
+	NameAttr           string        `mapstructure:"name_attr"`
+	DeptAttr           string        `mapstructure:"dept_attr"`
+	GroupAttr          string        `mapstructure:"group_attr"`
+	DefaultRole        string        `mapstructure:"default_role"`
+	DefaultDept        string        `mapstructure:"default_dept"`
+	GroupRules         []GroupRule   `mapstructure:"group_rules"`
+	SyncInterval       time.Duration `mapstructure:"sync_interval"` // 0 turns off scheduled sync
+}
+
+// Gives Role (and Dept, if set) to members of Group, first match wins.
+// Group is matched against the full DN or the CN.
+type GroupRule struct {
+	Group string `mapstructure:"group"`
+	Role  string `mapstructure:"role"`
+	Dept  string `mapstructure:"dept"`
+}
+
+type TwoFactorConfig struct {
+	Issuer        string        `mapstructure:"issuer"`         // name shown in authenticator apps
+	RequiredRoles []string      `mapstructure:"required_roles"` // initial policy, admins can change it
+	ChallengeTTL  time.Duration `mapstructure:"challenge_ttl"`
+	MaxAttempts   int           `mapstructure:"max_attempts"` // wrong codes per challenge
+	RecoveryCodes int           `mapstructure:"recovery_codes"`
+}
+
+type StorageConfig struct {
+	Backend  string `mapstructure:"backend"`   // "local" or "s3"
+	LocalDir string `mapstructure:"local_dir"` // used by the local backend
+	S3       S3Config
+}
+
+type S3Config struct {
+	Endpoint  string `mapstructure:"endpoint"` // host:port, e.g. s3.amazonaws.com or minio:9000
+	AccessKey string `mapstructure:"access_key"`
+	SecretKey string `mapstructure:"secret_key"`
+	Bucket    string `mapstructure:"bucket"`
+	Region    string `mapstructure:"region"`
+	UseSSL    bool   `mapstructure:"use_ssl"`
+}
+
+type AttachmentConfig struct {
+	MaxSize           int64    `mapstructure:"max_size"` // bytes
+	MaxPerLeave       int      `mapstructure:"max_per_leave"`
+	AllowedTypes      []string `mapstructure:"allowed_types"`       // sniffed MIME types
+	RequiredTypes     []string `mapstructure:"required_types"`      // leave types that need a document to be approved
+	RequiredAfterDays int      `mapstructure:"required_after_days"` // longer leaves need a document, 0 turns off
+	Scanner           string   `mapstructure:"scanner"`             // "none" or "clamav"
+	ClamAVAddr        string   `mapstructure:"clamav_addr"`
+}
+
+type IdempotencyConfig struct {
+	Store  string        `mapstructure:"store"`  // "memory" or "postgres"
+	Window time.Duration `mapstructure:"window"` // how long responses are kept for replay
+}
+
+type LeaveConfig struct {
+	BackdateDays    int                `mapstructure:"backdate_days"`     // how far in the past a leave may start, 0 means from today
+	ExamExemptTypes []string           `mapstructure:"exam_exempt_types"` // leave types allowed during exams
+	DayStart        time.Duration      `mapstructure:"day_start"`         // since midnight, the working day and its two halves
+	Midday          time.Duration      `mapstructure:"midday"`
+	DayEnd          time.Duration      `mapstructure:"day_end"`
+	Allowances      map[string]float64 `mapstructure:"allowances"` // days per year by lowercased leave type, missing means unlimited
+	GatePass        GatePassConfig     `mapstructure:"gate_pass"`
+}
+
+// Checks the working day is in order, everything measured in days and
+// half days divides by its length
+func (c LeaveConfig) Validate() error {
+	if c.DayStart < 0 || c.DayStart >= c.Midday || c.Midday >= c.DayEnd || c.DayEnd > 24*time.Hour {
+		return fmt.Errorf("leaves: need 0 <= day_start < midday < day_end <= 24h, got %s, %s and %s",
+			c.DayStart, c.Midday, c.DayEnd)
+	}
+	return nil
+}
+
+type GatePassConfig struct {
+	Secret    string        `mapstructure:"secret"`     // signs the QR codes, changing it voids every pass
+	VerifyURL string        `mapstructure:"verify_url"` // public verification endpoint the QR code links to
+	Grace     time.Duration `mapstructure:"grace"`      // how early and late the pass is accepted around the leave
+}
+
+// Reports whether passes are signed with an empty or the well known secret
+func (c GatePassConfig) UsesDefaultSecret() bool {
+	return c.Secret == "" || c.Secret == defaultGatePassSecret
+}
+
+type AttendanceConfig struct {
+	PresentStatuses   []string      `mapstructure:"present_statuses"`   // count as attended
+	ExcludedStatuses  []string      `mapstructure:"excluded_statuses"`  // left out of the total, e.g. approved leave
+	ReconcileInterval time.Duration `mapstructure:"reconcile_interval"` // how often attendance is matched to approved leave, 0 turns off
+	YearStartMonth    int           `mapstructure:"year_start_month"`   // first month of the academic year, 1-12
+}
+
+type AnalyticsConfig struct {
+	RollupInterval time.Duration `mapstructure:"rollup_interval"` // how often the daily rollups are brought up to date, 0 turns off
+}
+
+type ReportConfig struct {
+	CheckInterval time.Duration `mapstructure:"check_interval"` // how often due reports are looked for, 0 turns off
+}
+
 func Load() *Config {
 	viper.SetConfigName("config")
 	viper.SetConfigType("yaml")
@@ -47,7 +301,19 @@ func Load() *Config {
 
 	// Set defaults
 	viper.SetDefault("server.port", "8080")
+	viper.SetDefault("server.mode", "development")
+	viper.SetDefault("server.metrics_addr", "127.0.0.1:9090")
+	viper.SetDefault("server.trusted_proxies", nil)
 	viper.SetDefault("jwt.secret_key", "mojakey")
+	viper.SetDefault("jwt.algorithm", "HS256")
+	viper.SetDefault("jwt.key_encryption_key", defaultKeyEncryptionKey)
+	viper.SetDefault("jwt.rotation_interval", "720h")
+	viper.SetDefault("jwt.key_overlap", "48h")
+	viper.SetDefault("jwt.issuer", "campus-api")
+	viper.SetDefault("jwt.audience", "campus-api")
+	viper.SetDefault("jwt.token_ttl", "24h")
+	viper.SetDefault("jwt.leeway", "30s")
+	viper.SetDefault("jwt.impersonation_ttl", "15m")
 	viper.SetDefault("admin.email", "admin@example.com")
 	viper.SetDefault("admin.password", "admin123")
 
@@ -57,7 +323,103 @@ func Load() *Config {
 	viper.SetDefault("email.smtp_password", "")
 	viper.SetDefault("email.from_email", "")
 
+	viper.SetDefault("tracing.exporter", "none")
+	viper.SetDefault("tracing.endpoint", "localhost:4318")
+	viper.SetDefault("tracing.insecure", true)
+	viper.SetDefault("tracing.service_name", "campus-api")
+	viper.SetDefault("tracing.sample_ratio", 1.0)
+
+	viper.SetDefault("rate_limit.store", "memory")
+	viper.SetDefault("rate_limit.window", "1m")
+	viper.SetDefault("rate_limit.login_per_ip", 10)
+	viper.SetDefault("rate_limit.login_per_account", 5)
+	viper.SetDefault("rate_limit.register_per_ip", 5)
+	viper.SetDefault("rate_limit.reset_per_ip", 5)
+
+	viper.SetDefault("idempotency.store", "postgres")
+	viper.SetDefault("idempotency.window", "24h")
+
+	viper.SetDefault("lockout.threshold", 5)
+	viper.SetDefault("lockout.duration", "5m")
+	viper.SetDefault("lockout.max_duration", "1h")
+
+	viper.SetDefault("password.min_length", 8)
+	viper.SetDefault("password.require_upper", false)
+	viper.SetDefault("password.require_lower", true)
+	viper.SetDefault("password.require_digit", true)
+	viper.SetDefault("password.require_symbol", false)
+
+	viper.SetDefault("account.app_url", "http://localhost:8080")
+	viper.SetDefault("account.require_verified_email", false)
+	viper.SetDefault("account.verify_token_ttl", "48h")
+	viper.SetDefault("account.reset_token_ttl", "1h")
+
+	viper.SetDefault("sso.oidc.enabled", false)
+	viper.SetDefault("sso.oidc.redirect_url", "http://localhost:8080/api/v1/auth/oidc/callback")
+	viper.SetDefault("sso.oidc.scopes", []string{"openid", "email", "profile"})
+	viper.SetDefault("sso.saml.enabled", false)
+	viper.SetDefault("sso.saml.root_url", "http://localhost:8080")
+	viper.SetDefault("sso.saml.trust_email", false)
+	viper.SetDefault("sso.provisioning.jit", true)
+	viper.SetDefault("sso.provisioning.update_roles", false)
+	viper.SetDefault("sso.provisioning.default_role", "student")
+	viper.SetDefault("sso.provisioning.default_dept", "General")
+	viper.SetDefault("sso.provisioning.email_claim", "email")
+	viper.SetDefault("sso.provisioning.name_claim", "name")
+	viper.SetDefault("sso.provisioning.dept_claim", "department")
+
+	viper.SetDefault("ldap.enabled", false)
+	viper.SetDefault("ldap.url", "ldap://localhost:389")
+	viper.SetDefault("ldap.user_filter", "(&(objectClass=person)(mail=%s))")
+	viper.SetDefault("ldap.sync_filter", "(objectClass=person)")
+	viper.SetDefault("ldap.uid_attr", "entryUUID")
+	viper.SetDefault("ldap.email_attr", "mail")
+	viper.SetDefault("ldap.name_attr", "cn")
+	viper.SetDefault("ldap.dept_attr", "departmentNumber")
+	viper.SetDefault("ldap.group_attr", "memberOf")
+	viper.SetDefault("ldap.default_role", "student")
+	viper.SetDefault("ldap.default_dept", "General")
+	viper.SetDefault("ldap.sync_interval", "0")
+
+	viper.SetDefault("two_factor.issuer", "Campus Portal")
+	viper.SetDefault("two_factor.required_roles", []string{})
+	viper.SetDefault("two_factor.challenge_ttl", "5m")
+	viper.SetDefault("two_factor.max_attempts", 5)
+	viper.SetDefault("two_factor.recovery_codes", 10)
+
+	viper.SetDefault("storage.backend", "local")
+	viper.SetDefault("storage.local_dir", "uploads")
+	viper.SetDefault("storage.s3.region", "us-east-1")
+
+	viper.SetDefault("attachments.max_size", 5<<20)
+	viper.SetDefault("attachments.max_per_leave", 5)
+	viper.SetDefault("attachments.allowed_types", []string{"application/pdf", "image/jpeg", "image/png"})
+	viper.SetDefault("attachments.required_types", []string{"Medical"})
+	viper.SetDefault("attachments.required_after_days", 0)
+	viper.SetDefault("attachments.scanner", "none")
+	viper.SetDefault("attachments.clamav_addr", "localhost:3310")
+
+	viper.SetDefault("leaves.backdate_days", 0)
+	viper.SetDefault("leaves.exam_exempt_types", []string{"Medical", "Emergency"})
+	viper.SetDefault("leaves.day_start", "9h")
+	viper.SetDefault("leaves.midday", "13h")
+	viper.SetDefault("leaves.day_end", "17h")
+	viper.SetDefault("leaves.gate_pass.secret", defaultGatePassSecret)
+	viper.SetDefault("leaves.gate_pass.verify_url", "http://localhost:8080/api/v1/gate-pass/verify")
+	viper.SetDefault("leaves.gate_pass.grace", "2h")
+
+	viper.SetDefault("attendance.present_statuses", []string{"present", "late"})
+	viper.SetDefault("attendance.excluded_statuses", []string{"on_leave", "medical", "excused"})
+	viper.SetDefault("attendance.reconcile_interval", "1h")
+	viper.SetDefault("attendance.year_start_month", 8)
+
+	viper.SetDefault("analytics.rollup_interval", "5m")
+
+	viper.SetDefault("reports.check_interval", "1m")
+
 	viper.BindEnv("database.url", "DATABASE_URL")
+	viper.BindEnv("jwt.key_encryption_key", "JWT_KEY_ENCRYPTION_KEY")
+	viper.BindEnv("leaves.gate_pass.secret", "GATE_PASS_SECRET")
 
 	// Read the config file
 	if err := viper.ReadInConfig(); err != nil {
@@ -71,6 +433,10 @@ func Load() *Config {
 		log.Fatal("Config error:", err)
 	}
 
+	if err := config.Leaves.Validate(); err != nil {
+		log.Fatal("Config error: ", err)
+	}
+
 	if config.Database.URL == "" {
 		config.Database.URL = os.Getenv("DATABASE_URL")
 	}